@@ -0,0 +1,256 @@
+//go:build go1.16
+// +build go1.16
+
+package plist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Batch decodes or converts many property list files at once, on a bounded pool of workers.
+//
+// Files are chosen from an fs.FS by a glob pattern: the syntax of path.Match, applied
+// to each slash-separated element of the path, where an element of ** matches any
+// number of directories (including none). "**/Info.plist" matches every Info.plist in
+// the file system, and "Apps/*/Entitlements.plist" one per directory under Apps.
+type Batch struct {
+	workers      int
+	indent       string
+	shareObjects bool
+}
+
+// A BatchResult is the outcome of decoding or converting a single file.
+type BatchResult struct {
+	// Path is the file's path within the file system.
+	Path string
+
+	// Format is the format the file was found to be in.
+	Format int
+
+	// Value holds the file's contents, as Unmarshal would decode them into an interface{}.
+	// It is only set by Decode.
+	Value interface{}
+
+	// Data holds the converted document. It is only set by Convert.
+	Data []byte
+
+	// Err is the error encountered reading, decoding or converting the file, if any.
+	Err error
+}
+
+// NewBatch returns a Batch that processes up to workers files at a time.
+// If workers is zero or negative, it processes runtime.GOMAXPROCS(0) files at a time.
+func NewBatch(workers int) *Batch {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &Batch{workers: workers}
+}
+
+// Indent turns on pretty-printing for documents produced by Convert, as Encoder.Indent does.
+func (b *Batch) Indent(indent string) {
+	b.indent = indent
+}
+
+// ShareObjects controls whether Decode preserves containers that are referenced more
+// than once, as Decoder.ShareObjects does. Convert keeps them as Encoder.Convert does.
+func (b *Batch) ShareObjects(share bool) {
+	b.shareObjects = share
+}
+
+// Decode decodes every file in fsys whose path matches pattern.
+//
+// It returns one result for every file that matched, sorted by path. A file that cannot be
+// read or decoded does not stop the others; its error is reported in its result. Errors
+// reading a directory are reported in the same way, with the directory's path.
+// The returned error is only set if the pattern is malformed or ctx is done.
+//
+// When ctx is done, files that have not yet been started are given ctx.Err() as their
+// error, and Decode returns ctx.Err() once the files already in progress are finished.
+func (b *Batch) Decode(ctx context.Context, fsys fs.FS, pattern string) ([]BatchResult, error) {
+	return b.run(ctx, fsys, pattern, func(w *batchWorker, r *BatchResult, doc []byte) {
+		r.Value, r.Format, r.Err = w.decode(doc)
+	})
+}
+
+// Convert re-encodes every file in fsys whose path matches pattern in the given format,
+// keeping what Encoder.Convert keeps, such as the order of dictionary keys.
+// The converted documents are returned in each result's Data; nothing is written back to fsys.
+//
+// Results and errors are reported as they are by Decode.
+func (b *Batch) Convert(ctx context.Context, fsys fs.FS, pattern string, format int) ([]BatchResult, error) {
+	return b.run(ctx, fsys, pattern, func(w *batchWorker, r *BatchResult, doc []byte) {
+		r.Data, r.Format, r.Err = w.convert(doc, format)
+	})
+}
+
+// A batchWorker holds the Decoder and Encoder one worker reuses for every file it processes.
+type batchWorker struct {
+	reader  *bytes.Reader
+	decoder *Decoder
+	buffer  bytes.Buffer
+	encoder *Encoder
+}
+
+func newBatchWorker(b *Batch) *batchWorker {
+	w := &batchWorker{reader: bytes.NewReader(nil)}
+	w.decoder = NewDecoder(w.reader)
+	w.decoder.ShareObjects(b.shareObjects)
+	w.encoder = NewEncoder(&w.buffer)
+	w.encoder.Indent(b.indent)
+	w.encoder.ShareObjects(b.shareObjects)
+	return w
+}
+
+func (w *batchWorker) decode(doc []byte) (val interface{}, format int, err error) {
+	w.reader.Reset(doc)
+	w.decoder.Reset(w.reader)
+	err = w.decoder.Decode(&val)
+	return val, w.decoder.Format, err
+}
+
+func (w *batchWorker) convert(doc []byte, format int) ([]byte, int, error) {
+	w.reader.Reset(doc)
+	w.buffer.Reset()
+	w.encoder.format = format
+	w.encoder.Reset(&w.buffer)
+	docFormat, err := w.encoder.Convert(w.reader)
+	if err != nil {
+		return nil, docFormat, err
+	}
+	return append([]byte(nil), w.buffer.Bytes()...), docFormat, nil
+}
+
+func (b *Batch) run(ctx context.Context, fsys fs.FS, pattern string, process func(*batchWorker, *BatchResult, []byte)) ([]BatchResult, error) {
+	results, err := globFS(ctx, fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := b.workers
+	if workers > len(results) {
+		workers = len(results)
+	}
+
+	jobs := make(chan *BatchResult)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			w := newBatchWorker(b)
+			for r := range jobs {
+				doc, err := fs.ReadFile(fsys, r.Path)
+				if err != nil {
+					r.Err = err
+					continue
+				}
+				process(w, r, doc)
+			}
+		}()
+	}
+
+	for i := range results {
+		r := &results[i]
+		if r.Err != nil {
+			// A directory that could not be read.
+			continue
+		}
+		if ctx.Err() != nil {
+			r.Err = ctx.Err()
+			continue
+		}
+		select {
+		case jobs <- r:
+		case <-ctx.Done():
+			r.Err = ctx.Err()
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return results, ctx.Err()
+}
+
+// globFS returns a result for every file in fsys that matches pattern, sorted by path,
+// and one with an error for every directory that could not be read along the way.
+func globFS(ctx context.Context, fsys fs.FS, pattern string) ([]BatchResult, error) {
+	elems := strings.Split(pattern, "/")
+	for _, e := range elems {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only walk the part of the tree the pattern can match.
+	root := "."
+	literal := 0
+	for literal < len(elems)-1 && !hasGlobMeta(elems[literal]) {
+		literal++
+	}
+	if literal > 0 {
+		root = path.Join(elems[:literal]...)
+	}
+
+	var results []BatchResult
+	err := fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if name == root && errors.Is(err, fs.ErrNotExist) {
+				// Nothing matches.
+				return fs.SkipDir
+			}
+			results = append(results, BatchResult{Path: name, Err: err})
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && matchGlob(elems, strings.Split(name, "/")) {
+			results = append(results, BatchResult{Path: name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, nil
+}
+
+func hasGlobMeta(elem string) bool {
+	return strings.ContainsAny(elem, `*?[\`)
+}
+
+// matchGlob reports whether the path elements in name match the pattern elements in pattern.
+func matchGlob(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try every number of directories, fewest first.
+			for skip := 0; skip <= len(name); skip++ {
+				if matchGlob(pattern[1:], name[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
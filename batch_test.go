@@ -0,0 +1,198 @@
+//go:build go1.16
+// +build go1.16
+
+package plist
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func batchTestFS(t *testing.T) fstest.MapFS {
+	info := map[string]interface{}{"CFBundleIdentifier": "net.howett.plist", "CFBundleVersion": uint64(12)}
+	fsys := fstest.MapFS{
+		"README":                            {Data: []byte("not a property list")},
+		"Apps/Broken.app/Info.plist":        {Data: []byte("<plist><dict><key>a</key></plist>")},
+		"Apps/Deep/Nested.app/Info.plist":   {},
+		"Apps/Text.app/Info.plist":          {Data: []byte(`{CFBundleIdentifier = net.howett.plist; CFBundleVersion = <*I12>;}`)},
+		"Apps/Text.app/Entitlements.plist":  {Data: []byte(`{}`)},
+		"Apps/XML.app/Info.plist":           {},
+		"Apps/Binary.app/Info.plist":        {},
+		"Apps/Binary.app/Other/Info.plist2": {Data: []byte(`{}`)},
+	}
+	for name, format := range map[string]int{
+		"Apps/Deep/Nested.app/Info.plist": BinaryFormat,
+		"Apps/XML.app/Info.plist":         XMLFormat,
+		"Apps/Binary.app/Info.plist":      BinaryFormat,
+	} {
+		doc, err := Marshal(info, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys[name] = &fstest.MapFile{Data: doc}
+	}
+	return fsys
+}
+
+func TestBatchDecode(t *testing.T) {
+	fsys := batchTestFS(t)
+	expected := map[string]interface{}{"CFBundleIdentifier": "net.howett.plist", "CFBundleVersion": uint64(12)}
+
+	results, err := NewBatch(2).Decode(context.Background(), fsys, "**/Info.plist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{
+		"Apps/Binary.app/Info.plist",
+		"Apps/Broken.app/Info.plist",
+		"Apps/Deep/Nested.app/Info.plist",
+		"Apps/Text.app/Info.plist",
+		"Apps/XML.app/Info.plist",
+	}
+	formats := []int{BinaryFormat, XMLFormat, BinaryFormat, GNUStepFormat, XMLFormat}
+	if len(results) != len(paths) {
+		t.Fatalf("expected %d results, got %d: %+v", len(paths), len(results), results)
+	}
+	for i, r := range results {
+		if r.Path != paths[i] {
+			t.Errorf("result %d: expected path %s, got %s", i, paths[i], r.Path)
+			continue
+		}
+		if r.Path == "Apps/Broken.app/Info.plist" {
+			if r.Err == nil {
+				t.Errorf("%s: expected an error", r.Path)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Path, r.Err)
+			continue
+		}
+		if r.Format != formats[i] {
+			t.Errorf("%s: expected format %s, got %s", r.Path, FormatNames[formats[i]], FormatNames[r.Format])
+		}
+		if !reflect.DeepEqual(r.Value, expected) {
+			t.Errorf("%s: expected %#v, got %#v", r.Path, expected, r.Value)
+		}
+	}
+}
+
+func TestBatchGlob(t *testing.T) {
+	fsys := batchTestFS(t)
+	for pattern, expected := range map[string][]string{
+		"Apps/*/Info.plist":     {"Apps/Binary.app/Info.plist", "Apps/Broken.app/Info.plist", "Apps/Text.app/Info.plist", "Apps/XML.app/Info.plist"},
+		"Apps/Text.app/*.plist": {"Apps/Text.app/Entitlements.plist", "Apps/Text.app/Info.plist"},
+		"**/Other/*":            {"Apps/Binary.app/Other/Info.plist2"},
+		"README":                {"README"},
+		"Apps/**/Deep/**":       {"Apps/Deep/Nested.app/Info.plist"},
+		"Missing/**/*.plist":    nil,
+	} {
+		subtest(t, pattern, func(t *testing.T) {
+			results, err := NewBatch(0).Decode(context.Background(), fsys, pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, r := range results {
+				paths = append(paths, r.Path)
+			}
+			if !reflect.DeepEqual(paths, expected) {
+				t.Errorf("expected %v, got %v", expected, paths)
+			}
+		})
+	}
+
+	if _, err := NewBatch(0).Decode(context.Background(), fsys, "Apps/[/Info.plist"); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+func TestBatchConvert(t *testing.T) {
+	fsys := batchTestFS(t)
+	results, err := NewBatch(3).Convert(context.Background(), fsys, "Apps/*.app/Info.plist", XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range results {
+		if r.Path == "Apps/Broken.app/Info.plist" {
+			if r.Err == nil || r.Data != nil {
+				t.Errorf("%s: expected an error and no data, got %v and %q", r.Path, r.Err, r.Data)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Path, r.Err)
+			continue
+		}
+
+		var original, converted interface{}
+		Unmarshal(fsys[r.Path].Data, &original)
+		format, err := Unmarshal(r.Data, &converted)
+		if err != nil || format != XMLFormat {
+			t.Errorf("%s: converted document is not XML (%s, %v)", r.Path, FormatNames[format], err)
+		}
+		if !reflect.DeepEqual(original, converted) {
+			t.Errorf("%s: expected %#v, got %#v", r.Path, original, converted)
+		}
+	}
+}
+
+func TestBatchConvertKeepsKeyOrder(t *testing.T) {
+	fsys := fstest.MapFS{
+		"Info.plist": {Data: []byte(`<plist><dict><key>b</key><string>1</string><key>a</key><dict>` +
+			`<key>z</key><true/><key>y</key><false/></dict></dict></plist>`)},
+	}
+	results, err := NewBatch(1).Convert(context.Background(), fsys, "*.plist", OpenStepFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("expected one converted file, got %+v", results)
+	}
+	if r := results[0]; r.Format != XMLFormat || string(r.Data) != `{b=1;a={z=1;y=0;};}` {
+		t.Errorf("expected the keys in their original order, got %q (from %s)", r.Data, FormatNames[r.Format])
+	}
+}
+
+// cancellingFS cancels a context as soon as a file is read from it.
+type cancellingFS struct {
+	fstest.MapFS
+	cancel context.CancelFunc
+}
+
+func (c cancellingFS) ReadFile(name string) ([]byte, error) {
+	c.cancel()
+	return c.MapFS.ReadFile(name)
+}
+
+func TestBatchCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewBatch(1).Decode(ctx, batchTestFS(t), "**"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	results, err := NewBatch(1).Decode(ctx, cancellingFS{batchTestFS(t), cancel}, "**")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// The file in progress when the context was cancelled is finished, and at most one
+	// more can have been handed to the worker before it noticed.
+	canceled := 0
+	for _, r := range results {
+		if errors.Is(r.Err, context.Canceled) {
+			canceled++
+		}
+	}
+	if len(results) != len(batchTestFS(t)) || canceled < len(results)-2 {
+		t.Errorf("expected all but one or two of %d files to be cancelled, got %d: %+v", len(batchTestFS(t)), canceled, results)
+	}
+}
@@ -10,17 +10,28 @@ type bplistTrailer struct {
 	OffsetTableOffset uint64
 }
 
+// Object markers. bplist00 documents written by recent versions of CoreFoundation also use
+// the markers for null, fill bytes, URLs, UUIDs, sets and ordered sets. In bplist00, a URL
+// holds object references (to its base URL, if it has one, and then to its string), where
+// bplist15 holds the objects themselves; a set holds object references like an array.
 const (
 	bpTagNull        uint8 = 0x00
 	bpTagBoolFalse         = 0x08
 	bpTagBoolTrue          = 0x09
+	bpTagURL               = 0x0C
+	bpTagURLWithBase       = 0x0D
+	bpTagUUID              = 0x0E
+	bpTagFill              = 0x0F
 	bpTagInteger           = 0x10
 	bpTagReal              = 0x20
 	bpTagDate              = 0x30
 	bpTagData              = 0x40
 	bpTagASCIIString       = 0x50
 	bpTagUTF16String       = 0x60
+	bpTagUTF8String        = 0x70 // bplist15 and later
 	bpTagUID               = 0x80
 	bpTagArray             = 0xA0
+	bpTagOrderedSet        = 0xB0
+	bpTagSet               = 0xC0
 	bpTagDictionary        = 0xD0
 )
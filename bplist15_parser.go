@@ -0,0 +1,191 @@
+package plist
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Binary property lists, versions 15 and 16
+//
+// Newer versions of CoreFoundation write a variant of the binary format that has no offset
+// table or trailer. The header is followed by the length of the document, as an integer
+// object, and a CRC-32 checksum, as 0x12 and four big-endian bytes (zero if there is none).
+// Then comes the top object. Containers and URLs hold their contents inline, one object after
+// another, where bplist00 would have object references; every other object is encoded
+// as it is in bplist00. The variant also adds UTF-8 strings.
+//
+// bplist17 lays out its containers differently again, and isn't supported.
+
+// bplist15MaxDepth is how deeply containers may be nested. Every level of nesting costs
+// only a byte in the document, but a level of recursion to parse.
+const bplist15MaxDepth = 512
+
+func (p *bplistParser) parseDocument15() cfValue {
+	off := offset(8)
+	if p.bytes15(off, 1)[0]&0xF0 != bpTagInteger {
+		panic(errors.New("missing document length"))
+	}
+	length, _, off := p.parseInteger15(off)
+	if length > uint64(len(p.buffer)) {
+		panic(fmt.Errorf("document is truncated (%d of %d bytes)", len(p.buffer), length))
+	}
+	p.buffer = p.buffer[:length]
+
+	// The checksum isn't verified: it only guards against damage in storage or transit,
+	// which the structure of the document reveals just as well.
+	if p.bytes15(off, 5)[0] != bpTagInteger|2 {
+		panic(errors.New("missing checksum"))
+	}
+	off += 5
+
+	pval, _ := p.parseObject15(off, 0)
+	return pval
+}
+
+// bytes15 returns n bytes of the document, starting at off, or panics if there aren't that many.
+func (p *bplistParser) bytes15(off offset, n uint64) []byte {
+	if uint64(off) > uint64(len(p.buffer)) || n > uint64(len(p.buffer))-uint64(off) {
+		panic(fmt.Errorf("object@0x%x extends beyond the end of the document", off))
+	}
+	return p.buffer[off : off+offset(n)]
+}
+
+// parseInteger15 returns the integer at off as low64, high64, and the offset after it.
+func (p *bplistParser) parseInteger15(off offset) (uint64, uint64, offset) {
+	tag := p.bytes15(off, 1)[0]
+	if tag&0x0F > 4 {
+		panic(fmt.Errorf("illegal integer size at offset 0x%x", off))
+	}
+	nbytes := 1 << (tag & 0x0F)
+	p.bytes15(off+1, uint64(nbytes))
+	return p.parseSizedInteger(off+1, nbytes)
+}
+
+// count15 returns the count for the object at off and the offset of its contents.
+// No object takes less than a byte, so a count can never exceed the size of the document.
+func (p *bplistParser) count15(off offset) (uint64, offset) {
+	cnt, next := uint64(p.bytes15(off, 1)[0]&0x0F), off+1
+	if cnt == 0xF {
+		if p.bytes15(next, 1)[0]&0xF0 != bpTagInteger {
+			panic(fmt.Errorf("object@0x%x has a malformed count", off))
+		}
+		cnt, _, next = p.parseInteger15(next)
+	}
+	if cnt > uint64(len(p.buffer)) {
+		panic(fmt.Errorf("object@0x%x count (%v) is larger than the document", off, cnt))
+	}
+	return cnt, next
+}
+
+// parseObject15 parses the object at off, and returns it along with the offset of the object after it.
+func (p *bplistParser) parseObject15(off offset, depth int) (cfValue, offset) {
+	tag := p.bytes15(off, 1)[0]
+
+	switch tag & 0xF0 {
+	case bpTagNull:
+		switch tag {
+		case bpTagBoolTrue, bpTagBoolFalse:
+			return cfBoolean(tag == bpTagBoolTrue), off + 1
+		case bpTagNull, bpTagFill:
+			return nil, off + 1
+		case bpTagURL, bpTagURLWithBase:
+			return p.parseURL15(off, depth)
+		case bpTagUUID:
+			var uuid cfUUID
+			copy(uuid[:], p.bytes15(off+1, 16))
+			return uuid, off + 17
+		}
+	case bpTagInteger:
+		lo, hi, next := p.parseInteger15(off)
+		return &cfNumber{signed: hi == signedHighBits, value: lo, width: 1 << (tag & 0x0F)}, next
+	case bpTagReal:
+		if tag != bpTagReal|2 && tag != bpTagReal|3 {
+			panic(errors.New("illegal float size"))
+		}
+		nbytes := uint64(1) << (tag & 0x0F)
+		p.bytes15(off+1, nbytes)
+		return p.parseTagAtOffset(off), off + 1 + offset(nbytes)
+	case bpTagDate:
+		if tag != bpTagDate|3 {
+			break
+		}
+		p.bytes15(off+1, 8)
+		return p.parseTagAtOffset(off), off + 9
+	case bpTagData, bpTagASCIIString, bpTagUTF8String:
+		cnt, start := p.count15(off)
+		b := p.bytes15(start, cnt)
+		next := start + offset(cnt)
+		if tag&0xF0 == bpTagData {
+			return cfData(b), next
+		}
+		return cfString(zeroCopy8BitString(b, 0, len(b))), next
+	case bpTagUTF16String:
+		cnt, start := p.count15(off)
+		b := p.bytes15(start, cnt*2)
+		return cfString(decodeUTF16BE(b)), start + offset(cnt*2)
+	case bpTagUID:
+		nbytes := int(tag&0x0F) + 1
+		p.bytes15(off+1, uint64(nbytes))
+		lo, _, next := p.parseSizedInteger(off+1, nbytes)
+		return cfUID(lo), next
+	case bpTagArray:
+		values, next := p.parseObjectList15(off, depth, 1)
+		return &cfArray{values}, next
+	case bpTagDictionary:
+		// as in bplist00, all of the keys come first, then all of the values
+		objects, next := p.parseObjectList15(off, depth, 2)
+		cnt := len(objects) / 2
+		keys := make([]string, cnt)
+		for i := range keys {
+			if str, ok := objects[i].(cfString); ok {
+				keys[i] = string(str)
+			} else {
+				panic(fmt.Errorf("dictionary@0x%x contains non-string key at index %d", off, i))
+			}
+		}
+		return &cfDictionary{keys: keys, values: objects[cnt:]}, next
+	case bpTagOrderedSet, bpTagSet:
+		values, next := p.parseObjectList15(off, depth, 1)
+		return &cfSet{values: values, ordered: tag&0xF0 == bpTagOrderedSet}, next
+	}
+	panic(fmt.Errorf("unexpected atom 0x%2.02x at offset 0x%x", tag, off))
+}
+
+// parseObjectList15 parses the contents of the container at off, which holds per objects for each of its count.
+func (p *bplistParser) parseObjectList15(off offset, depth int, per uint64) ([]cfValue, offset) {
+	if depth >= bplist15MaxDepth {
+		panic(fmt.Errorf("container@0x%x is nested too deeply", off))
+	}
+	cnt, next := p.count15(off)
+	if cnt*per > uint64(len(p.buffer)) {
+		panic(fmt.Errorf("container@0x%x count (%v) is larger than the document", off, cnt))
+	}
+
+	objects := make([]cfValue, cnt*per)
+	for i := range objects {
+		objects[i], next = p.parseObject15(next, depth+1)
+	}
+	return objects, next
+}
+
+// parseURL15 parses the URL at off: its base URL, if it has one, and then its string.
+func (p *bplistParser) parseURL15(off offset, depth int) (cfValue, offset) {
+	if depth >= bplist15MaxDepth {
+		panic(fmt.Errorf("URL@0x%x is nested too deeply", off))
+	}
+	url, next := &cfURL{}, off+1
+	if p.bytes15(off, 1)[0] == bpTagURLWithBase {
+		var base cfValue
+		base, next = p.parseObject15(next, depth+1)
+		if url.base, _ = base.(*cfURL); url.base == nil {
+			panic(fmt.Errorf("URL@0x%x has a base that isn't a URL", off))
+		}
+	}
+	str, next := p.parseObject15(next, depth+1)
+	if s, ok := str.(cfString); ok {
+		url.str = string(s)
+	} else {
+		panic(fmt.Errorf("URL@0x%x has a non-string value", off))
+	}
+	return url, next
+}
@@ -1,15 +1,30 @@
 package plist
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"time"
+	"unicode"
 	"unicode/utf16"
 )
 
-func bplistMinimumIntSize(n uint64) int {
+// bplistMinimumIntSize returns the number of bytes needed to store n: 1, 2, 4 or 8,
+// or, if tight is set, any number from 1 to 8.
+func bplistMinimumIntSize(n uint64, tight bool) int {
+	if tight {
+		size := 1
+		for n > 0xff {
+			n >>= 8
+			size++
+		}
+		return size
+	}
+
 	switch {
 	case n <= uint64(0xff):
 		return 1
@@ -26,26 +41,198 @@ func bplistValueShouldUnique(pval cfValue) bool {
 	switch pval.(type) {
 	case cfString, *cfNumber, *cfReal, cfDate, cfData:
 		return true
+	case *cfDictionary, *cfArray:
+		// Containers are indexed by their own identity: if we've seen one before,
+		// it is shared, and must only be written once. Cycles are rejected as errors
+		// before a value gets this far.
+		return true
+	case *cfDataReader:
+		// A reader can only be read once.
+		return true
+	case cfNull, cfUUID:
+		return true
+	case *cfSet, *cfURL:
+		// Like containers, sets and URLs are indexed by identity.
+		return true
 	}
 	return false
 }
 
 type bplistGenerator struct {
-	writer   *countedWriter
-	objmap   map[interface{}]uint64 // maps pValue.hash()es to object locations
+	writer   *bufio.Writer
+	offset   uint64 // number of bytes written so far
+	scratch  [17]byte
 	objtable []cfValue
+	offtable []uint64
 	trailer  bplistTrailer
+	compact  bool // whether object refs and offsets may be any width, not just 1, 2, 4 or 8 bytes
+	optimize bool // whether to write identical containers once, and refs and offsets compactly
+
+	// Object table indices, by value. Values that are uniqued are looked up here before
+	// being added to the object table; every value is looked up here when referenced.
+	// Each table is keyed by the exact contents of its values, so that two values are
+	// only ever merged if they would be written out identically.
+	strings map[string]uint64
+	numbers map[cfNumber]uint64
+	reals   map[uint64]uint64 // by bits, so that 0 and -0 stay apart and NaN is found again
+	reals32 map[uint32]uint64
+	bools   map[cfBoolean]uint64
+	dates   map[bplistDateKey]uint64
+	data    map[string]uint64
+	uids    map[cfUID]uint64
+	dicts   map[*cfDictionary]uint64
+	arrays  map[*cfArray]uint64
+	readers map[*cfDataReader]uint64
+	nulls   map[cfNull]uint64
+	uuids   map[cfUUID]uint64
+	sets    map[*cfSet]uint64
+	urls    map[*cfURL]uint64
+}
+
+// bplistDateKey identifies an instant in time, regardless of the location (or monotonic
+// clock reading) of the time.Time it came from.
+type bplistDateKey struct {
+	sec  int64
+	nsec int
+}
+
+func newBplistDateKey(t time.Time) bplistDateKey {
+	return bplistDateKey{t.Unix(), t.Nanosecond()}
+}
+
+// objectIndex returns the object table index for pval.
+func (p *bplistGenerator) objectIndex(pval cfValue) (uint64, bool) {
+	var idx uint64
+	var ok bool
+	switch pval := pval.(type) {
+	case cfString:
+		idx, ok = p.strings[string(pval)]
+	case *cfNumber:
+		idx, ok = p.numbers[*pval]
+	case *cfReal:
+		if pval.wide {
+			idx, ok = p.reals[math.Float64bits(pval.value)]
+		} else {
+			idx, ok = p.reals32[math.Float32bits(float32(pval.value))]
+		}
+	case cfBoolean:
+		idx, ok = p.bools[pval]
+	case cfDate:
+		idx, ok = p.dates[newBplistDateKey(time.Time(pval))]
+	case cfData:
+		idx, ok = p.data[string(pval)]
+	case cfUID:
+		idx, ok = p.uids[pval]
+	case *cfDictionary:
+		idx, ok = p.dicts[pval]
+	case *cfArray:
+		idx, ok = p.arrays[pval]
+	case *cfDataReader:
+		idx, ok = p.readers[pval]
+	case cfNull:
+		idx, ok = p.nulls[pval]
+	case cfUUID:
+		idx, ok = p.uuids[pval]
+	case *cfSet:
+		idx, ok = p.sets[pval]
+	case *cfURL:
+		idx, ok = p.urls[pval]
+	}
+	return idx, ok
+}
+
+// setObjectIndex records the object table index for pval. The tables are created
+// as they are needed; most documents only contain a few kinds of value.
+func (p *bplistGenerator) setObjectIndex(pval cfValue, idx uint64) {
+	switch pval := pval.(type) {
+	case cfString:
+		if p.strings == nil {
+			p.strings = make(map[string]uint64)
+		}
+		p.strings[string(pval)] = idx
+	case *cfNumber:
+		if p.numbers == nil {
+			p.numbers = make(map[cfNumber]uint64)
+		}
+		p.numbers[*pval] = idx
+	case *cfReal:
+		if pval.wide {
+			if p.reals == nil {
+				p.reals = make(map[uint64]uint64)
+			}
+			p.reals[math.Float64bits(pval.value)] = idx
+		} else {
+			if p.reals32 == nil {
+				p.reals32 = make(map[uint32]uint64)
+			}
+			p.reals32[math.Float32bits(float32(pval.value))] = idx
+		}
+	case cfBoolean:
+		if p.bools == nil {
+			p.bools = make(map[cfBoolean]uint64)
+		}
+		p.bools[pval] = idx
+	case cfDate:
+		if p.dates == nil {
+			p.dates = make(map[bplistDateKey]uint64)
+		}
+		p.dates[newBplistDateKey(time.Time(pval))] = idx
+	case cfData:
+		if p.data == nil {
+			p.data = make(map[string]uint64)
+		}
+		p.data[string(pval)] = idx
+	case cfUID:
+		if p.uids == nil {
+			p.uids = make(map[cfUID]uint64)
+		}
+		p.uids[pval] = idx
+	case *cfDictionary:
+		if p.dicts == nil {
+			p.dicts = make(map[*cfDictionary]uint64)
+		}
+		p.dicts[pval] = idx
+	case *cfArray:
+		if p.arrays == nil {
+			p.arrays = make(map[*cfArray]uint64)
+		}
+		p.arrays[pval] = idx
+	case *cfDataReader:
+		if p.readers == nil {
+			p.readers = make(map[*cfDataReader]uint64)
+		}
+		p.readers[pval] = idx
+	case cfNull:
+		if p.nulls == nil {
+			p.nulls = make(map[cfNull]uint64)
+		}
+		p.nulls[pval] = idx
+	case cfUUID:
+		if p.uuids == nil {
+			p.uuids = make(map[cfUUID]uint64)
+		}
+		p.uuids[pval] = idx
+	case *cfSet:
+		if p.sets == nil {
+			p.sets = make(map[*cfSet]uint64)
+		}
+		p.sets[pval] = idx
+	case *cfURL:
+		if p.urls == nil {
+			p.urls = make(map[*cfURL]uint64)
+		}
+		p.urls[pval] = idx
+	}
 }
 
 func (p *bplistGenerator) flattenPlistValue(pval cfValue) {
-	key := pval.hash()
 	if bplistValueShouldUnique(pval) {
-		if _, ok := p.objmap[key]; ok {
+		if _, ok := p.objectIndex(pval); ok {
 			return
 		}
 	}
 
-	p.objmap[key] = uint64(len(p.objtable))
+	p.setObjectIndex(pval, uint64(len(p.objtable)))
 	p.objtable = append(p.objtable, pval)
 
 	switch pval := pval.(type) {
@@ -61,39 +248,141 @@ func (p *bplistGenerator) flattenPlistValue(pval cfValue) {
 		for _, v := range pval.values {
 			p.flattenPlistValue(v)
 		}
+	case *cfSet:
+		for _, v := range pval.values {
+			p.flattenPlistValue(v)
+		}
+	case *cfURL:
+		if pval.base != nil {
+			p.flattenPlistValue(pval.base)
+		}
+		p.flattenPlistValue(cfString(pval.str))
 	}
 }
 
-func (p *bplistGenerator) indexForPlistValue(pval cfValue) (uint64, bool) {
-	v, ok := p.objmap[pval.hash()]
-	return v, ok
-}
-
 func (p *bplistGenerator) generateDocument(root cfValue) {
-	p.objtable = make([]cfValue, 0, 16)
-	p.objmap = make(map[interface{}]uint64)
+	if p.optimize {
+		root = optimizeBplistValue(root)
+	}
 	p.flattenPlistValue(root)
 
+	compact := p.compact || p.optimize
 	p.trailer.NumObjects = uint64(len(p.objtable))
-	p.trailer.ObjectRefSize = uint8(bplistMinimumIntSize(p.trailer.NumObjects))
+	p.trailer.ObjectRefSize = uint8(bplistMinimumIntSize(p.trailer.NumObjects, compact))
 
-	p.writer.Write([]byte("bplist00"))
+	p.writeString("bplist00")
 
-	offtable := make([]uint64, p.trailer.NumObjects)
-	for i, pval := range p.objtable {
-		offtable[i] = uint64(p.writer.BytesWritten())
+	if cap(p.offtable) < len(p.objtable) {
+		p.offtable = make([]uint64, 0, len(p.objtable))
+	}
+	for _, pval := range p.objtable {
+		p.offtable = append(p.offtable, p.offset)
 		p.writePlistValue(pval)
 	}
 
-	p.trailer.OffsetIntSize = uint8(bplistMinimumIntSize(uint64(p.writer.BytesWritten())))
-	p.trailer.TopObject = p.objmap[root.hash()]
-	p.trailer.OffsetTableOffset = uint64(p.writer.BytesWritten())
+	p.trailer.OffsetIntSize = uint8(bplistMinimumIntSize(p.offset, compact))
+	p.trailer.TopObject, _ = p.objectIndex(root)
+	p.trailer.OffsetTableOffset = p.offset
 
-	for _, offset := range offtable {
+	for _, offset := range p.offtable {
 		p.writeSizedInt(offset, int(p.trailer.OffsetIntSize))
 	}
 
-	binary.Write(p.writer, binary.BigEndian, p.trailer)
+	p.writeTrailer()
+	p.clearTables()
+	if err := p.writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// clearTables empties the object table and every index, keeping their storage
+// for the next document without holding on to the values of this one.
+func (p *bplistGenerator) clearTables() {
+	for i := range p.objtable {
+		p.objtable[i] = nil
+	}
+	p.objtable = p.objtable[:0]
+	p.offtable = p.offtable[:0]
+
+	for k := range p.strings {
+		delete(p.strings, k)
+	}
+	for k := range p.numbers {
+		delete(p.numbers, k)
+	}
+	for k := range p.reals {
+		delete(p.reals, k)
+	}
+	for k := range p.reals32 {
+		delete(p.reals32, k)
+	}
+	for k := range p.bools {
+		delete(p.bools, k)
+	}
+	for k := range p.dates {
+		delete(p.dates, k)
+	}
+	for k := range p.data {
+		delete(p.data, k)
+	}
+	for k := range p.uids {
+		delete(p.uids, k)
+	}
+	for k := range p.dicts {
+		delete(p.dicts, k)
+	}
+	for k := range p.arrays {
+		delete(p.arrays, k)
+	}
+	for k := range p.readers {
+		delete(p.readers, k)
+	}
+	for k := range p.nulls {
+		delete(p.nulls, k)
+	}
+	for k := range p.uuids {
+		delete(p.uuids, k)
+	}
+	for k := range p.sets {
+		delete(p.sets, k)
+	}
+	for k := range p.urls {
+		delete(p.urls, k)
+	}
+}
+
+func (p *bplistGenerator) reset(w io.Writer) {
+	p.writer.Reset(w)
+	p.offset = 0
+	p.trailer = bplistTrailer{}
+	p.clearTables()
+}
+
+func (p *bplistGenerator) write(b []byte) {
+	p.writer.Write(b)
+	p.offset += uint64(len(b))
+}
+
+func (p *bplistGenerator) writeString(s string) {
+	p.writer.WriteString(s)
+	p.offset += uint64(len(s))
+}
+
+func (p *bplistGenerator) writeByte(c byte) {
+	p.writer.WriteByte(c)
+	p.offset++
+}
+
+func (p *bplistGenerator) writeTrailer() {
+	b := p.scratch[:8]
+	copy(b, p.trailer.Unused[:])
+	b[5] = p.trailer.SortVersion
+	b[6] = p.trailer.OffsetIntSize
+	b[7] = p.trailer.ObjectRefSize
+	p.write(b)
+	p.writeSizedInt(p.trailer.NumObjects, 8)
+	p.writeSizedInt(p.trailer.TopObject, 8)
+	p.writeSizedInt(p.trailer.OffsetTableOffset, 8)
 }
 
 func (p *bplistGenerator) writePlistValue(pval cfValue) {
@@ -109,7 +398,7 @@ func (p *bplistGenerator) writePlistValue(pval cfValue) {
 	case cfString:
 		p.writeStringTag(string(pval))
 	case *cfNumber:
-		p.writeIntTag(pval.signed, pval.value)
+		p.writeNumberTag(pval)
 	case *cfReal:
 		if pval.wide {
 			p.writeRealTag(pval.value, 64)
@@ -120,30 +409,46 @@ func (p *bplistGenerator) writePlistValue(pval cfValue) {
 		p.writeBoolTag(bool(pval))
 	case cfData:
 		p.writeDataTag([]byte(pval))
+	case *cfDataReader:
+		p.writeDataReaderTag(pval.reader)
 	case cfDate:
 		p.writeDateTag(time.Time(pval))
 	case cfUID:
 		p.writeUIDTag(UID(pval))
+	case cfNull:
+		p.writeByte(bpTagNull)
+	case cfUUID:
+		p.writeByte(bpTagUUID)
+		p.write(pval[:])
+	case *cfSet:
+		p.writeSetTag(pval)
+	case *cfURL:
+		p.writeURLTag(pval)
 	default:
 		panic(fmt.Errorf("unknown plist type %t", pval))
 	}
 }
 
 func (p *bplistGenerator) writeSizedInt(n uint64, nbytes int) {
-	var val interface{}
+	b := p.scratch[:nbytes]
 	switch nbytes {
 	case 1:
-		val = uint8(n)
+		b[0] = uint8(n)
 	case 2:
-		val = uint16(n)
+		binary.BigEndian.PutUint16(b, uint16(n))
 	case 4:
-		val = uint32(n)
+		binary.BigEndian.PutUint32(b, uint32(n))
 	case 8:
-		val = n
+		binary.BigEndian.PutUint64(b, n)
+	case 3, 5, 6, 7:
+		for i := nbytes - 1; i >= 0; i-- {
+			b[i] = uint8(n)
+			n >>= 8
+		}
 	default:
 		panic(errors.New("illegal integer size"))
 	}
-	binary.Write(p.writer, binary.BigEndian, val)
+	p.write(b)
 }
 
 func (p *bplistGenerator) writeBoolTag(v bool) {
@@ -151,62 +456,85 @@ func (p *bplistGenerator) writeBoolTag(v bool) {
 	if v {
 		tag = bpTagBoolTrue
 	}
-	binary.Write(p.writer, binary.BigEndian, tag)
+	p.writeByte(tag)
 }
 
 func (p *bplistGenerator) writeIntTag(signed bool, n uint64) {
-	var tag uint8
-	var val interface{}
 	switch {
 	case n <= uint64(0xff):
-		val = uint8(n)
-		tag = bpTagInteger | 0x0
+		p.writeByte(bpTagInteger | 0x0)
+		p.writeSizedInt(n, 1)
 	case n <= uint64(0xffff):
-		val = uint16(n)
-		tag = bpTagInteger | 0x1
+		p.writeByte(bpTagInteger | 0x1)
+		p.writeSizedInt(n, 2)
 	case n <= uint64(0xffffffff):
-		val = uint32(n)
-		tag = bpTagInteger | 0x2
+		p.writeByte(bpTagInteger | 0x2)
+		p.writeSizedInt(n, 4)
 	case n > uint64(0x7fffffffffffffff) && !signed:
 		// 64-bit values are always *signed* in format 00.
 		// Any unsigned value that doesn't intersect with the signed
-		// range must be sign-extended and stored as a SInt128
-		val = n
-		tag = bpTagInteger | 0x4
+		// range must be sign-extended and stored as a SInt128.
+		// In the absence of true 128-bit integers in Go, we'll just
+		// fake the top half: sign extend it with zeroes.
+		p.writeByte(bpTagInteger | 0x4)
+		p.writeSizedInt(0, 8)
+		p.writeSizedInt(n, 8)
 	default:
-		val = n
-		tag = bpTagInteger | 0x3
+		p.writeByte(bpTagInteger | 0x3)
+		p.writeSizedInt(n, 8)
 	}
+}
 
-	binary.Write(p.writer, binary.BigEndian, tag)
-	if tag&0xF == 0x4 {
-		// SInt128; in the absence of true 128-bit integers in Go,
-		// we'll just fake the top half. We only got here because
-		// we had an unsigned 64-bit int that didn't fit,
-		// so sign extend it with zeroes.
-		binary.Write(p.writer, binary.BigEndian, uint64(0))
+// writeNumberTag writes an integer that was read from a binary property list at least as
+// wide as it was stored there.
+func (p *bplistGenerator) writeNumberTag(n *cfNumber) {
+	switch n.width {
+	case 2, 4:
+		if n.value>>(8*n.width) == 0 && !n.signed {
+			if n.width == 2 {
+				p.writeByte(bpTagInteger | 0x1)
+			} else {
+				p.writeByte(bpTagInteger | 0x2)
+			}
+			p.writeSizedInt(n.value, int(n.width))
+			return
+		}
+	case 8:
+		if n.value <= uint64(0x7fffffffffffffff) || n.signed {
+			p.writeByte(bpTagInteger | 0x3)
+			p.writeSizedInt(n.value, 8)
+			return
+		}
+	case 16:
+		var hi uint64
+		if n.signed {
+			hi = signedHighBits
+		}
+		p.writeByte(bpTagInteger | 0x4)
+		p.writeSizedInt(hi, 8)
+		p.writeSizedInt(n.value, 8)
+		return
 	}
-	binary.Write(p.writer, binary.BigEndian, val)
+	p.writeIntTag(n.signed, n.value)
 }
 
 func (p *bplistGenerator) writeUIDTag(u UID) {
-	nbytes := bplistMinimumIntSize(uint64(u))
+	nbytes := bplistMinimumIntSize(uint64(u), false)
 	tag := uint8(bpTagUID | (nbytes - 1))
 
-	binary.Write(p.writer, binary.BigEndian, tag)
+	p.writeByte(tag)
 	p.writeSizedInt(uint64(u), nbytes)
 }
 
 func (p *bplistGenerator) writeRealTag(n float64, bits int) {
-	var tag uint8 = bpTagReal | 0x3
-	var val interface{} = n
 	if bits == 32 {
-		val = float32(n)
-		tag = bpTagReal | 0x2
+		p.writeByte(bpTagReal | 0x2)
+		p.writeSizedInt(uint64(math.Float32bits(float32(n))), 4)
+		return
 	}
 
-	binary.Write(p.writer, binary.BigEndian, tag)
-	binary.Write(p.writer, binary.BigEndian, val)
+	p.writeByte(bpTagReal | 0x3)
+	p.writeSizedInt(math.Float64bits(n), 8)
 }
 
 func (p *bplistGenerator) writeDateTag(t time.Time) {
@@ -214,8 +542,8 @@ func (p *bplistGenerator) writeDateTag(t time.Time) {
 	val := float64(t.In(time.UTC).UnixNano()) / float64(time.Second)
 	val -= 978307200 // Adjust to Apple Epoch
 
-	binary.Write(p.writer, binary.BigEndian, tag)
-	binary.Write(p.writer, binary.BigEndian, val)
+	p.writeByte(tag)
+	p.writeSizedInt(math.Float64bits(val), 8)
 }
 
 func (p *bplistGenerator) writeCountedTag(tag uint8, count uint64) {
@@ -226,7 +554,7 @@ func (p *bplistGenerator) writeCountedTag(tag uint8, count uint64) {
 		marker |= uint8(count)
 	}
 
-	binary.Write(p.writer, binary.BigEndian, marker)
+	p.writeByte(marker)
 
 	if count >= 0xF {
 		p.writeIntTag(false, count)
@@ -235,55 +563,141 @@ func (p *bplistGenerator) writeCountedTag(tag uint8, count uint64) {
 
 func (p *bplistGenerator) writeDataTag(data []byte) {
 	p.writeCountedTag(bpTagData, uint64(len(data)))
-	binary.Write(p.writer, binary.BigEndian, data)
+	p.write(data)
+}
+
+// writeDataReaderTag copies data from r into the document. Its length has to be written
+// first, so a reader that can't report how much data it holds is read into memory.
+func (p *bplistGenerator) writeDataReaderTag(r io.Reader) {
+	n, ok := dataReaderLen(r)
+	if !ok {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		p.writeDataTag(data)
+		return
+	}
+
+	p.writeCountedTag(bpTagData, uint64(n))
+	copied, err := io.CopyN(p.writer, r, n)
+	p.offset += uint64(copied)
+	if err == io.EOF {
+		err = fmt.Errorf("plist: data reader ended after %d of %d bytes", copied, n)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// dataReaderLen returns the number of bytes left in r, if r can tell.
+func dataReaderLen(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Len() int }: // bytes.Buffer, bytes.Reader, strings.Reader
+		return int64(r.Len()), true
+	case io.Seeker:
+		cur, err := r.Seek(0, 1)
+		if err != nil {
+			return 0, false
+		}
+		end, err := r.Seek(0, 2)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := r.Seek(cur, 0); err != nil {
+			panic(err)
+		}
+		return end - cur, true
+	}
+	return 0, false
 }
 
 func (p *bplistGenerator) writeStringTag(str string) {
-	for _, r := range str {
-		if r > 0x7F {
-			utf16Runes := utf16.Encode([]rune(str))
-			p.writeCountedTag(bpTagUTF16String, uint64(len(utf16Runes)))
-			binary.Write(p.writer, binary.BigEndian, utf16Runes)
+	for i := 0; i < len(str); i++ {
+		if str[i] > 0x7F {
+			p.writeUTF16StringTag(str)
 			return
 		}
 	}
 
 	p.writeCountedTag(bpTagASCIIString, uint64(len(str)))
-	binary.Write(p.writer, binary.BigEndian, []byte(str))
+	p.writeString(str)
+}
+
+func (p *bplistGenerator) writeUTF16StringTag(str string) {
+	n := 0
+	for _, r := range str {
+		if r >= 0x10000 && r <= unicode.MaxRune {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	p.writeCountedTag(bpTagUTF16String, uint64(n))
+
+	for _, r := range str {
+		if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar || r2 != unicode.ReplacementChar {
+			p.writeSizedInt(uint64(r1), 2)
+			p.writeSizedInt(uint64(r2), 2)
+			continue
+		}
+		if r >= 0xD800 && r < 0xE000 || r > unicode.MaxRune {
+			r = unicode.ReplacementChar
+		}
+		p.writeSizedInt(uint64(r), 2)
+	}
 }
 
 func (p *bplistGenerator) writeDictionaryTag(dict *cfDictionary) {
 	// assumption: sorted already; flattenPlistValue did this.
 	cnt := len(dict.keys)
 	p.writeCountedTag(bpTagDictionary, uint64(cnt))
-	vals := make([]uint64, cnt*2)
-	for i, k := range dict.keys {
+	for _, k := range dict.keys {
 		// invariant: keys have already been "uniqued" (as PStrings)
-		keyIdx, ok := p.objmap[cfString(k).hash()]
+		keyIdx, ok := p.strings[k]
 		if !ok {
 			panic(errors.New("failed to find key " + k + " in object map during serialization"))
 		}
-		vals[i] = keyIdx
+		p.writeSizedInt(keyIdx, int(p.trailer.ObjectRefSize))
 	}
 
-	for i, v := range dict.values {
+	for _, v := range dict.values {
 		// invariant: values have already been "uniqued"
-		objIdx, ok := p.indexForPlistValue(v)
+		objIdx, ok := p.objectIndex(v)
 		if !ok {
 			panic(errors.New("failed to find value in object map during serialization"))
 		}
-		vals[i+cnt] = objIdx
-	}
-
-	for _, v := range vals {
-		p.writeSizedInt(v, int(p.trailer.ObjectRefSize))
+		p.writeSizedInt(objIdx, int(p.trailer.ObjectRefSize))
 	}
 }
 
 func (p *bplistGenerator) writeArrayTag(arr []cfValue) {
 	p.writeCountedTag(bpTagArray, uint64(len(arr)))
-	for _, v := range arr {
-		objIdx, ok := p.indexForPlistValue(v)
+	p.writeObjectRefs(arr)
+}
+
+func (p *bplistGenerator) writeSetTag(set *cfSet) {
+	tag := uint8(bpTagSet)
+	if set.ordered {
+		tag = bpTagOrderedSet
+	}
+	p.writeCountedTag(tag, uint64(len(set.values)))
+	p.writeObjectRefs(set.values)
+}
+
+func (p *bplistGenerator) writeURLTag(url *cfURL) {
+	if url.base != nil {
+		p.writeByte(bpTagURLWithBase)
+		p.writeObjectRefs([]cfValue{url.base, cfString(url.str)})
+	} else {
+		p.writeByte(bpTagURL)
+		p.writeObjectRefs([]cfValue{cfString(url.str)})
+	}
+}
+
+func (p *bplistGenerator) writeObjectRefs(values []cfValue) {
+	for _, v := range values {
+		objIdx, ok := p.objectIndex(v)
 		if !ok {
 			panic(errors.New("failed to find value in object map during serialization"))
 		}
@@ -298,6 +712,6 @@ func (p *bplistGenerator) Indent(i string) {
 
 func newBplistGenerator(w io.Writer) *bplistGenerator {
 	return &bplistGenerator{
-		writer: &countedWriter{Writer: mustWriter{w}},
+		writer: bufio.NewWriter(w),
 	}
 }
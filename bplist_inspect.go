@@ -0,0 +1,262 @@
+package plist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A BinaryInspection describes the structure of a binary property list, as it is laid out
+// in the document. It can be written out as text with WriteTo, or encoded as JSON.
+type BinaryInspection struct {
+	Version     string         `json:"version"` // from the header, such as "00"
+	Trailer     BinaryTrailer  `json:"trailer"`
+	OffsetTable []uint64       `json:"offsetTable"` // object ID to the offset of the object
+	Objects     []BinaryObject `json:"objects"`     // by object ID
+
+	// Shared holds the IDs of the objects that are referenced more than once,
+	// most referenced first.
+	Shared []uint64 `json:"shared"`
+}
+
+// A BinaryTrailer holds the fields of the trailer at the end of a binary property list.
+type BinaryTrailer struct {
+	SortVersion       uint8  `json:"sortVersion"`
+	OffsetIntSize     uint8  `json:"offsetIntSize"`
+	ObjectRefSize     uint8  `json:"objectRefSize"`
+	NumObjects        uint64 `json:"numObjects"`
+	TopObject         uint64 `json:"topObject"`
+	OffsetTableOffset uint64 `json:"offsetTableOffset"`
+}
+
+// A BinaryObject describes one object in a binary property list.
+type BinaryObject struct {
+	ID     uint64 `json:"id"`
+	Offset uint64 `json:"offset"`
+	Marker uint8  `json:"marker"` // the first byte of the object, which gives its type
+	Type   string `json:"type"`
+
+	// Value is the value of an object that isn't a container, as text.
+	Value string `json:"value,omitempty"`
+
+	// References holds the IDs of the objects a container refers to. For a dictionary,
+	// they are its keys and then its values; for a URL, its base URL (if it has one)
+	// and then its string.
+	References   []uint64 `json:"references,omitempty"`
+	ReferencedBy int      `json:"referencedBy"` // the number of references to the object
+
+	// Error describes why the object couldn't be read, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// bplistInspectDataLimit is the number of bytes of a data object shown in its Value.
+const bplistInspectDataLimit = 32
+
+// InspectBinary describes the structure of the binary property list in data.
+//
+// The trailer must be intact for a document to be inspected, but objects that can't be
+// read are still listed, with an Error. SalvageBinary can decode documents that are more
+// badly damaged. The bplist15 and later formats, which have no offset table, can't be inspected.
+func InspectBinary(data []byte) (*BinaryInspection, error) {
+	p := &bplistParser{readerAt: bytes.NewReader(data), lazyObjects: make(map[uint64]cfValue)}
+	if err := p.openLazily(int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	t := p.trailer
+	in := &BinaryInspection{
+		Version: string(data[6:8]),
+		Trailer: BinaryTrailer{
+			SortVersion:       t.SortVersion,
+			OffsetIntSize:     t.OffsetIntSize,
+			ObjectRefSize:     t.ObjectRefSize,
+			NumObjects:        t.NumObjects,
+			TopObject:         t.TopObject,
+			OffsetTableOffset: t.OffsetTableOffset,
+		},
+		OffsetTable: make([]uint64, t.NumObjects),
+		Objects:     make([]BinaryObject, t.NumObjects),
+		Shared:      []uint64{},
+	}
+
+	for id := range in.Objects {
+		off, _ := p.parseOffsetAtOffset(offset(t.OffsetTableOffset + uint64(id)*uint64(t.OffsetIntSize)))
+		in.OffsetTable[id] = uint64(off)
+		in.Objects[id] = p.inspectObject(uint64(id), off)
+	}
+
+	for _, obj := range in.Objects {
+		for _, ref := range obj.References {
+			if ref < t.NumObjects {
+				in.Objects[ref].ReferencedBy++
+			}
+		}
+	}
+	for _, obj := range in.Objects {
+		if obj.ReferencedBy > 1 {
+			in.Shared = append(in.Shared, obj.ID)
+		}
+	}
+	sort.SliceStable(in.Shared, func(i, j int) bool {
+		return in.Objects[in.Shared[i]].ReferencedBy > in.Objects[in.Shared[j]].ReferencedBy
+	})
+	return in, nil
+}
+
+// inspectObject describes the object with the given ID, which the offset table puts at off.
+func (p *bplistParser) inspectObject(id uint64, off offset) (obj BinaryObject) {
+	obj = BinaryObject{ID: id, Offset: uint64(off)}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			obj.Error = r.(error).Error()
+		}
+	}()
+
+	if off < 8 || off >= offset(p.trailer.OffsetTableOffset) {
+		panic(fmt.Errorf("offset 0x%x is outside the object area", off))
+	}
+	obj.Marker = p.bytesAt(off, 1)[0]
+	obj.Type = bplistMarkerType(obj.Marker)
+
+	if obj.References, _ = p.objectRefsAtOffset(off); obj.References != nil {
+		return obj
+	}
+	obj.Value = bplistInspectValue(p.parseTagAtOffset(off), obj.Marker)
+	return obj
+}
+
+func bplistMarkerType(marker uint8) string {
+	switch marker & 0xF0 {
+	case bpTagNull:
+		switch marker {
+		case bpTagNull:
+			return "null"
+		case bpTagBoolFalse, bpTagBoolTrue:
+			return "boolean"
+		case bpTagURL, bpTagURLWithBase:
+			return "URL"
+		case bpTagUUID:
+			return "UUID"
+		case bpTagFill:
+			return "fill"
+		}
+	case bpTagInteger:
+		return "integer"
+	case bpTagReal:
+		return "real"
+	case bpTagDate:
+		return "date"
+	case bpTagData:
+		return "data"
+	case bpTagASCIIString:
+		return "ASCII string"
+	case bpTagUTF16String:
+		return "UTF-16 string"
+	case bpTagUTF8String:
+		return "UTF-8 string"
+	case bpTagUID:
+		return "UID"
+	case bpTagArray:
+		return "array"
+	case bpTagOrderedSet:
+		return "ordered set"
+	case bpTagSet:
+		return "set"
+	case bpTagDictionary:
+		return "dictionary"
+	}
+	return "unknown"
+}
+
+// bplistInspectValue returns the value of an object that isn't a container as text.
+func bplistInspectValue(pval cfValue, marker uint8) string {
+	switch pval := pval.(type) {
+	case nil:
+		if marker == bpTagFill {
+			return ""
+		}
+		return "null"
+	case cfString:
+		return strconv.Quote(string(pval))
+	case *cfNumber:
+		if pval.signed {
+			return strconv.FormatInt(int64(pval.value), 10)
+		}
+		return strconv.FormatUint(pval.value, 10)
+	case *cfReal:
+		if pval.wide {
+			return strconv.FormatFloat(pval.value, 'g', -1, 64)
+		}
+		return strconv.FormatFloat(pval.value, 'g', -1, 32)
+	case cfBoolean:
+		return strconv.FormatBool(bool(pval))
+	case cfDate:
+		return time.Time(pval).Format(time.RFC3339Nano)
+	case cfData:
+		if len(pval) > bplistInspectDataLimit {
+			return fmt.Sprintf("<%x...> (%d bytes)", []byte(pval[:bplistInspectDataLimit]), len(pval))
+		}
+		return fmt.Sprintf("<%x>", []byte(pval))
+	case cfUID:
+		return fmt.Sprintf("UID(%d)", pval)
+	case cfUUID:
+		return UUID(pval).String()
+	}
+	return fmt.Sprint(pval)
+}
+
+// WriteTo writes a description of the document to w as text.
+func (in *BinaryInspection) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	t := in.Trailer
+	fmt.Fprintf(&b, "bplist%s\n", in.Version)
+	fmt.Fprintf(&b, "trailer:\n")
+	fmt.Fprintf(&b, "  sort version:        %d\n", t.SortVersion)
+	fmt.Fprintf(&b, "  offset int size:     %d\n", t.OffsetIntSize)
+	fmt.Fprintf(&b, "  object ref size:     %d\n", t.ObjectRefSize)
+	fmt.Fprintf(&b, "  number of objects:   %d\n", t.NumObjects)
+	fmt.Fprintf(&b, "  top object:          #%d\n", t.TopObject)
+	fmt.Fprintf(&b, "  offset table offset: 0x%x\n", t.OffsetTableOffset)
+
+	fmt.Fprintf(&b, "offset table:\n")
+	for id, off := range in.OffsetTable {
+		fmt.Fprintf(&b, "  #%d: 0x%x\n", id, off)
+	}
+
+	fmt.Fprintf(&b, "objects:\n")
+	for _, obj := range in.Objects {
+		fmt.Fprintf(&b, "  #%d @0x%x", obj.ID, obj.Offset)
+		if obj.Error != "" {
+			fmt.Fprintf(&b, ": error: %s\n", obj.Error)
+			continue
+		}
+		fmt.Fprintf(&b, " [%02x] %s", obj.Marker, obj.Type)
+		if obj.Value != "" {
+			fmt.Fprintf(&b, " %s", obj.Value)
+		}
+		if obj.References != nil {
+			refs := make([]string, len(obj.References))
+			for i, ref := range obj.References {
+				refs[i] = "#" + strconv.FormatUint(ref, 10)
+			}
+			fmt.Fprintf(&b, " -> [%s]", strings.Join(refs, " "))
+		}
+		b.WriteByte('\n')
+	}
+
+	fmt.Fprintf(&b, "shared objects: %d\n", len(in.Shared))
+	for _, id := range in.Shared {
+		fmt.Fprintf(&b, "  #%d: referenced %d times\n", id, in.Objects[id].ReferencedBy)
+	}
+
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
@@ -0,0 +1,151 @@
+package plist
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// bplistOptimizer rewrites a tree of values so that structurally identical containers
+// are the same object, which the generator then writes only once.
+//
+// Every distinct value is given an ID. A container's ID is found from its kind and the
+// IDs of its contents, so two containers share an ID only if they would be written out
+// identically.
+type bplistOptimizer struct {
+	ids   map[interface{}]uint64      // by the key of a value, or of a container's contents
+	canon map[uint64]cfValue          // the container written for each container ID
+	seen  map[cfValue]bplistOptimized // containers that have been visited, by identity
+}
+
+type bplistOptimized struct {
+	pval cfValue
+	id   uint64
+}
+
+// Keys for values that can't be used as map keys themselves, or whose
+// representation in a map would be ambiguous.
+type (
+	bplistRealKey struct {
+		wide bool
+		bits uint64
+	}
+	bplistDataKey     string
+	bplistContentsKey string
+)
+
+func optimizeBplistValue(root cfValue) cfValue {
+	o := &bplistOptimizer{
+		ids:   make(map[interface{}]uint64),
+		canon: make(map[uint64]cfValue),
+		seen:  make(map[cfValue]bplistOptimized),
+	}
+	root, _ = o.visit(root)
+	return root
+}
+
+// id returns the ID for key, allocating one if there isn't one yet. IDs start at 1;
+// 0 stands for a missing value.
+func (o *bplistOptimizer) id(key interface{}) uint64 {
+	id, ok := o.ids[key]
+	if !ok {
+		id = uint64(len(o.ids)) + 1
+		o.ids[key] = id
+	}
+	return id
+}
+
+func bplistScalarKey(pval cfValue) interface{} {
+	switch pval := pval.(type) {
+	case *cfNumber:
+		return *pval
+	case *cfReal:
+		if pval.wide {
+			return bplistRealKey{true, math.Float64bits(pval.value)}
+		}
+		return bplistRealKey{false, uint64(math.Float32bits(float32(pval.value)))}
+	case cfDate:
+		return newBplistDateKey(time.Time(pval))
+	case cfData:
+		return bplistDataKey(pval)
+	}
+	// Strings, booleans, UIDs, UUIDs and null are keys already; readers are keyed by identity.
+	return pval
+}
+
+// visit returns the value to write in place of pval, and its ID.
+func (o *bplistOptimizer) visit(pval cfValue) (cfValue, uint64) {
+	switch pval.(type) {
+	case nil:
+		return nil, 0
+	case *cfDictionary, *cfArray, *cfSet, *cfURL:
+	default:
+		return pval, o.id(bplistScalarKey(pval))
+	}
+
+	if done, ok := o.seen[pval]; ok {
+		return done.pval, done.id
+	}
+
+	var key []byte
+	appendID := func(id uint64) {
+		key = appendUvarint(key, id)
+	}
+	visitChild := func(child cfValue) cfValue {
+		child, id := o.visit(child)
+		appendID(id)
+		return child
+	}
+
+	switch pval := pval.(type) {
+	case *cfDictionary:
+		pval.sort()
+		key = append(key, 'd')
+		appendID(uint64(len(pval.keys)))
+		for _, k := range pval.keys {
+			appendID(o.id(cfString(k)))
+		}
+		for i, v := range pval.values {
+			pval.values[i] = visitChild(v)
+		}
+	case *cfArray:
+		key = append(key, 'a')
+		appendID(uint64(len(pval.values)))
+		for i, v := range pval.values {
+			pval.values[i] = visitChild(v)
+		}
+	case *cfSet:
+		if pval.ordered {
+			key = append(key, 'o')
+		} else {
+			key = append(key, 's')
+		}
+		appendID(uint64(len(pval.values)))
+		for i, v := range pval.values {
+			pval.values[i] = visitChild(v)
+		}
+	case *cfURL:
+		key = append(key, 'u')
+		if pval.base != nil {
+			pval.base = visitChild(pval.base).(*cfURL)
+		} else {
+			appendID(0)
+		}
+		appendID(o.id(cfString(pval.str)))
+	}
+
+	result := bplistOptimized{pval, 0}
+	if id, ok := o.ids[bplistContentsKey(key)]; ok {
+		result = bplistOptimized{o.canon[id], id}
+	} else {
+		result.id = o.id(bplistContentsKey(key))
+		o.canon[result.id] = pval
+	}
+	o.seen[pval] = result
+	return result.pval, result.id
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], n)]...)
+}
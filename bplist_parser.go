@@ -29,9 +29,32 @@ type bplistParser struct {
 	trailerOffset uint64
 
 	containerStack []offset // slice of object offsets; manipulated during container deserialization
+
+	// When reading lazily from an io.ReaderAt, buffer is unused: the parts of the document
+	// read most recently are kept in windows, and only containers are cached, in lazyObjects.
+	readerAt    io.ReaderAt
+	windows     [bplistReadWindows]bplistWindow
+	nextWindow  int
+	lazyObjects map[uint64]cfValue
+}
+
+// bytesAt returns n bytes of the document, starting at off.
+func (p *bplistParser) bytesAt(off offset, n uint64) []byte {
+	if p.readerAt != nil {
+		return p.lazyBytesAt(off, n)
+	}
+	return p.buffer[off : off+offset(n)]
 }
 
 func (p *bplistParser) validateDocumentTrailer() {
+	if p.trailer.OffsetIntSize < 1 || p.trailer.OffsetIntSize > 8 {
+		panic(fmt.Errorf("illegal offset size (%v bytes)", p.trailer.OffsetIntSize))
+	}
+
+	if p.trailer.ObjectRefSize < 1 || p.trailer.ObjectRefSize > 8 {
+		panic(fmt.Errorf("illegal object ref size (%v bytes)", p.trailer.ObjectRefSize))
+	}
+
 	if p.trailer.OffsetTableOffset >= p.trailerOffset {
 		panic(fmt.Errorf("offset table beyond beginning of trailer (0x%x, trailer@0x%x)", p.trailer.OffsetTableOffset, p.trailerOffset))
 	}
@@ -49,7 +72,7 @@ func (p *bplistParser) validateDocumentTrailer() {
 	}
 
 	maxObjectRef := uint64(1) << (8 * p.trailer.ObjectRefSize)
-	if p.trailer.NumObjects > maxObjectRef {
+	if p.trailer.ObjectRefSize < 8 && p.trailer.NumObjects > maxObjectRef {
 		panic(fmt.Errorf("more objects (%v) than object ref size (%v bytes) can support", p.trailer.NumObjects, p.trailer.ObjectRefSize))
 	}
 
@@ -73,10 +96,12 @@ func (p *bplistParser) parseDocument() (pval cfValue, parseError error) {
 		}
 	}()
 
-	p.buffer, _ = ioutil.ReadAll(p.reader)
+	if p.reader != nil {
+		p.buffer, _ = ioutil.ReadAll(p.reader)
+	}
 
 	l := len(p.buffer)
-	if l < 40 {
+	if l < 8 {
 		panic(errors.New("not enough data"))
 	}
 
@@ -86,10 +111,20 @@ func (p *bplistParser) parseDocument() (pval cfValue, parseError error) {
 
 	p.version = int(((p.buffer[6] - '0') * 10) + (p.buffer[7] - '0'))
 
-	if p.version > 1 {
+	switch p.version {
+	case 0, 1:
+	case 15, 16:
+		return p.parseDocument15(), nil
+	case 17:
+		panic(errors.New("bplist17 documents are not supported"))
+	default:
 		panic(fmt.Errorf("unexpected version %d", p.version))
 	}
 
+	if l < 40 {
+		panic(errors.New("not enough data"))
+	}
+
 	p.trailerOffset = uint64(l - 32)
 	p.trailer = bplistTrailer{
 		SortVersion:       p.buffer[p.trailerOffset+5],
@@ -109,7 +144,11 @@ func (p *bplistParser) parseDocument() (pval cfValue, parseError error) {
 	// - Object IDs are big enough to support the number of objects in this plist
 	// - Top object is in range
 
-	p.objects = make([]cfValue, p.trailer.NumObjects)
+	if uint64(cap(p.objects)) >= p.trailer.NumObjects {
+		p.objects = p.objects[:p.trailer.NumObjects]
+	} else {
+		p.objects = make([]cfValue, p.trailer.NumObjects)
+	}
 
 	pval = p.objectAtIndex(p.trailer.TopObject)
 	return
@@ -123,19 +162,26 @@ func (p *bplistParser) parseSizedInteger(off offset, nbytes int) (lo uint64, hi
 	// negative 1, 2, or 4-byte integers are always emitted as 64-bit.
 	switch nbytes {
 	case 1:
-		lo, hi = uint64(p.buffer[off]), 0
+		lo, hi = uint64(p.bytesAt(off, 1)[0]), 0
 	case 2:
-		lo, hi = uint64(binary.BigEndian.Uint16(p.buffer[off:])), 0
+		lo, hi = uint64(binary.BigEndian.Uint16(p.bytesAt(off, 2))), 0
 	case 4:
-		lo, hi = uint64(binary.BigEndian.Uint32(p.buffer[off:])), 0
+		lo, hi = uint64(binary.BigEndian.Uint32(p.bytesAt(off, 4))), 0
 	case 8:
-		lo = binary.BigEndian.Uint64(p.buffer[off:])
-		if p.buffer[off]&0x80 != 0 {
+		b := p.bytesAt(off, 8)
+		lo = binary.BigEndian.Uint64(b)
+		if b[0]&0x80 != 0 {
 			// sign extend if lo is signed
 			hi = signedHighBits
 		}
 	case 16:
-		lo, hi = binary.BigEndian.Uint64(p.buffer[off+8:]), binary.BigEndian.Uint64(p.buffer[off:])
+		b := p.bytesAt(off, 16)
+		lo, hi = binary.BigEndian.Uint64(b[8:]), binary.BigEndian.Uint64(b)
+	case 3, 5, 6, 7:
+		// Integer objects are never this wide, but object refs, offsets and UIDs can be.
+		for _, c := range p.bytesAt(off, uint64(nbytes)) {
+			lo = lo<<8 | uint64(c)
+		}
 	default:
 		panic(errors.New("illegal integer size"))
 	}
@@ -158,19 +204,34 @@ func (p *bplistParser) objectAtIndex(index uint64) cfValue {
 		panic(fmt.Errorf("invalid object#%d (max %d)", index, p.trailer.NumObjects))
 	}
 
-	if pval := p.objects[index]; pval != nil {
+	if p.readerAt != nil {
+		if pval, ok := p.lazyObjects[index]; ok {
+			return pval
+		}
+	} else if pval := p.objects[index]; pval != nil {
 		return pval
 	}
 
+	pval := p.parseTagAtOffset(p.offsetForObject(index))
+	if p.readerAt != nil {
+		// Leaves are cheap to read again; only containers (which could be
+		// reached many times over through shared references) are kept.
+		switch pval.(type) {
+		case *cfDictionary, *cfArray, *cfSet, *cfURL:
+			p.lazyObjects[index] = pval
+		}
+	} else {
+		p.objects[index] = pval
+	}
+	return pval
+}
+
+func (p *bplistParser) offsetForObject(index uint64) offset {
 	off, _ := p.parseOffsetAtOffset(offset(p.trailer.OffsetTableOffset + (index * uint64(p.trailer.OffsetIntSize))))
 	if off > offset(p.trailer.OffsetTableOffset-1) {
 		panic(fmt.Errorf("object#%d starts beyond beginning of object table (0x%x, table@0x%x)", index, off, p.trailer.OffsetTableOffset))
 	}
-
-	pval := p.parseTagAtOffset(off)
-	p.objects[index] = pval
-	return pval
-
+	return off
 }
 
 func (p *bplistParser) pushNestedObject(off offset) {
@@ -197,33 +258,42 @@ func (p *bplistParser) popNestedObject() {
 }
 
 func (p *bplistParser) parseTagAtOffset(off offset) cfValue {
-	tag := p.buffer[off]
+	tag := p.bytesAt(off, 1)[0]
 
 	switch tag & 0xF0 {
 	case bpTagNull:
 		switch tag & 0x0F {
 		case bpTagBoolTrue, bpTagBoolFalse:
 			return cfBoolean(tag == bpTagBoolTrue)
+		case bpTagNull, bpTagFill:
+			return nil
+		case bpTagURL, bpTagURLWithBase:
+			return p.parseURLAtOffset(off)
+		case bpTagUUID:
+			var uuid cfUUID
+			copy(uuid[:], p.bytesAt(off+1, 16))
+			return uuid
 		}
 	case bpTagInteger:
 		lo, hi, _ := p.parseIntegerAtOffset(off)
 		return &cfNumber{
 			signed: hi == signedHighBits, // a signed integer is stored as a 128-bit integer with the top 64 bits set
 			value:  lo,
+			width:  1 << (tag & 0x0F),
 		}
 	case bpTagReal:
 		nbytes := 1 << (tag & 0x0F)
 		switch nbytes {
 		case 4:
-			bits := binary.BigEndian.Uint32(p.buffer[off+1:])
+			bits := binary.BigEndian.Uint32(p.bytesAt(off+1, 4))
 			return &cfReal{wide: false, value: float64(math.Float32frombits(bits))}
 		case 8:
-			bits := binary.BigEndian.Uint64(p.buffer[off+1:])
+			bits := binary.BigEndian.Uint64(p.bytesAt(off+1, 8))
 			return &cfReal{wide: true, value: math.Float64frombits(bits)}
 		}
 		panic(errors.New("illegal float size"))
 	case bpTagDate:
-		bits := binary.BigEndian.Uint64(p.buffer[off+1:])
+		bits := binary.BigEndian.Uint64(p.bytesAt(off+1, 8))
 		val := math.Float64frombits(bits)
 
 		// Apple Epoch is 20110101000000Z
@@ -249,17 +319,19 @@ func (p *bplistParser) parseTagAtOffset(off offset) cfValue {
 		return p.parseDictionaryAtOffset(off)
 	case bpTagArray:
 		return p.parseArrayAtOffset(off)
+	case bpTagOrderedSet, bpTagSet:
+		return p.parseSetAtOffset(off)
 	}
 	panic(fmt.Errorf("unexpected atom 0x%2.02x at offset 0x%x", tag, off))
 }
 
 func (p *bplistParser) parseIntegerAtOffset(off offset) (uint64, uint64, offset) {
-	tag := p.buffer[off]
+	tag := p.bytesAt(off, 1)[0]
 	return p.parseSizedInteger(off+1, 1<<(tag&0xF))
 }
 
 func (p *bplistParser) countForTagAtOffset(off offset) (uint64, offset) {
-	tag := p.buffer[off]
+	tag := p.bytesAt(off, 1)[0]
 	cnt := uint64(tag & 0x0F)
 	if cnt == 0xF {
 		cnt, _, off = p.parseIntegerAtOffset(off + 1)
@@ -273,7 +345,7 @@ func (p *bplistParser) parseDataAtOffset(off offset) []byte {
 	if start+offset(len) > offset(p.trailer.OffsetTableOffset) {
 		panic(fmt.Errorf("data@0x%x too long (%v bytes, max is %v)", off, len, p.trailer.OffsetTableOffset-uint64(start)))
 	}
-	return p.buffer[start : start+offset(len)]
+	return p.bytesAt(start, len)
 }
 
 func (p *bplistParser) parseASCIIStringAtOffset(off offset) string {
@@ -282,7 +354,7 @@ func (p *bplistParser) parseASCIIStringAtOffset(off offset) string {
 		panic(fmt.Errorf("ascii string@0x%x too long (%v bytes, max is %v)", off, len, p.trailer.OffsetTableOffset-uint64(start)))
 	}
 
-	return zeroCopy8BitString(p.buffer, int(start), int(len))
+	return zeroCopy8BitString(p.bytesAt(start, len), 0, int(len))
 }
 
 func (p *bplistParser) parseUTF16StringAtOffset(off offset) string {
@@ -292,9 +364,14 @@ func (p *bplistParser) parseUTF16StringAtOffset(off offset) string {
 		panic(fmt.Errorf("utf16 string@0x%x too long (%v bytes, max is %v)", off, bytes, p.trailer.OffsetTableOffset-uint64(start)))
 	}
 
-	u16s := make([]uint16, len)
-	for i := offset(0); i < offset(len); i++ {
-		u16s[i] = binary.BigEndian.Uint16(p.buffer[start+(i*2):])
+	return decodeUTF16BE(p.bytesAt(start, bytes))
+}
+
+// decodeUTF16BE decodes a big-endian UTF-16 string.
+func decodeUTF16BE(buf []byte) string {
+	u16s := make([]uint16, len(buf)/2)
+	for i := range u16s {
+		u16s[i] = binary.BigEndian.Uint16(buf[i*2:])
 	}
 	runes := utf16.Decode(u16s)
 	return string(runes)
@@ -316,6 +393,40 @@ func (p *bplistParser) parseObjectListAtOffset(off offset, count uint64) []cfVal
 	return objects
 }
 
+// objectRefsAtOffset returns the object references held by the container at off, and where
+// they start. For a dictionary, they are the references to its keys and then to its values.
+// An object that isn't a container holds none.
+func (p *bplistParser) objectRefsAtOffset(off offset) ([]uint64, offset) {
+	tag := p.bytesAt(off, 1)[0]
+
+	var cnt uint64
+	start := off + 1
+	switch tag & 0xF0 {
+	case bpTagArray, bpTagOrderedSet, bpTagSet:
+		cnt, start = p.countForTagAtOffset(off)
+	case bpTagDictionary:
+		cnt, start = p.countForTagAtOffset(off)
+		cnt *= 2
+	case bpTagNull:
+		if tag != bpTagURL && tag != bpTagURLWithBase {
+			return nil, start
+		}
+		cnt = uint64(tag - bpTagURL + 1)
+	default:
+		return nil, start
+	}
+
+	if start+offset(cnt*uint64(p.trailer.ObjectRefSize)) > offset(p.trailer.OffsetTableOffset) {
+		panic(fmt.Errorf("list@0x%x length (%v) puts its end beyond the offset table at 0x%x", start, cnt, p.trailer.OffsetTableOffset))
+	}
+	refs := make([]uint64, cnt)
+	next := start
+	for i := range refs {
+		refs[i], next = p.parseObjectRefAtOffset(next)
+	}
+	return refs, start
+}
+
 func (p *bplistParser) parseDictionaryAtOffset(off offset) *cfDictionary {
 	p.pushNestedObject(off)
 	defer p.popNestedObject()
@@ -348,6 +459,54 @@ func (p *bplistParser) parseArrayAtOffset(off offset) *cfArray {
 	return &cfArray{p.parseObjectListAtOffset(start, cnt)}
 }
 
+func (p *bplistParser) parseSetAtOffset(off offset) *cfSet {
+	p.pushNestedObject(off)
+	defer p.popNestedObject()
+
+	// a set is an object list, like an array
+	cnt, start := p.countForTagAtOffset(off)
+	return &cfSet{
+		values:  p.parseObjectListAtOffset(start, cnt),
+		ordered: p.bytesAt(off, 1)[0]&0xF0 == bpTagOrderedSet,
+	}
+}
+
+func (p *bplistParser) parseURLAtOffset(off offset) *cfURL {
+	p.pushNestedObject(off)
+	defer p.popNestedObject()
+
+	// a URL is a reference to its string, preceded by a reference to its base URL if it has one
+	objects := p.parseObjectListAtOffset(off+1, uint64(p.bytesAt(off, 1)[0]-bpTagURL+1))
+	url := &cfURL{}
+	if len(objects) == 2 {
+		base, ok := objects[0].(*cfURL)
+		if !ok {
+			panic(fmt.Errorf("URL@0x%x has a base that isn't a URL", off))
+		}
+		url.base = base
+	}
+	str, ok := objects[len(objects)-1].(cfString)
+	if !ok {
+		panic(fmt.Errorf("URL@0x%x has a non-string value", off))
+	}
+	url.str = string(str)
+	return url
+}
+
+// reset prepares the parser to parse the document in buffer, which has already been read,
+// keeping the storage it used for the previous document.
+func (p *bplistParser) reset(buffer []byte) {
+	objects := p.objects[:cap(p.objects)]
+	for i := range objects {
+		objects[i] = nil
+	}
+	*p = bplistParser{
+		buffer:         buffer,
+		objects:        objects[:0],
+		containerStack: p.containerStack[:0],
+	}
+}
+
 func newBplistParser(r io.ReadSeeker) *bplistParser {
 	return &bplistParser{reader: r}
 }
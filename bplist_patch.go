@@ -0,0 +1,393 @@
+package plist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+// A BinaryPatcher changes values in a binary property list without renumbering its objects.
+//
+// Encoding a changed value from scratch gives most objects in the document new IDs. A
+// BinaryPatcher instead keeps the document's objects exactly where they are and appends new
+// objects after them. A container that changes is appended as well, but keeps its object ID: only
+// its entry in the offset table moves to the new copy. Every object that isn't changed keeps its
+// ID, and its bytes. A container that more than one value refers to, as OptimizeSize arranges for
+// containers with the same contents, is not changed in place: the value being changed gets a copy
+// of it with a new ID, and the others keep the original.
+//
+// The objects replaced by a patch are left in the document, unreferenced, so a document grows a
+// little every time it is patched. Encoding it again (with OptimizeSize, for example) reclaims
+// the space, at the cost of renumbering its objects.
+//
+// A BinaryPatcher is not safe for concurrent use.
+type BinaryPatcher struct {
+	doc    []byte
+	parser *bplistParser
+
+	numObjects uint64
+	topObject  uint64
+	objects    map[uint64]bplistPatchObject // new and changed objects, by object ID
+	leaves     map[interface{}]uint64       // new leaves, to write each of them only once
+	refCounts  map[uint64]int               // references to each object, counted on the first Set
+}
+
+// A bplistPatchObject is an object to be appended to a patched document: either a leaf, or
+// a container and the object IDs of its contents (for a dictionary, its keys and then its values).
+type bplistPatchObject struct {
+	leaf cfValue
+	tag  uint8
+	refs []uint64
+}
+
+// NewBinaryPatcher returns a BinaryPatcher for the binary property list in doc.
+// The bplist15 and later formats, which have no offset table, can't be patched.
+func NewBinaryPatcher(doc []byte) (*BinaryPatcher, error) {
+	p := &bplistParser{readerAt: bytes.NewReader(doc), lazyObjects: make(map[uint64]cfValue)}
+	if err := p.openLazily(int64(len(doc))); err != nil {
+		return nil, err
+	}
+	return &BinaryPatcher{
+		doc:        doc,
+		parser:     p,
+		numObjects: p.trailer.NumObjects,
+		topObject:  p.trailer.TopObject,
+		objects:    make(map[uint64]bplistPatchObject),
+		leaves:     make(map[interface{}]uint64),
+	}, nil
+}
+
+// Set replaces the value at keypath with v, encoded as Marshal would encode it.
+//
+// keypath takes the form reported by Node.Keypath, such as /Entries[2]/Name; the empty keypath
+// and "/" both refer to the top-level value. The last step of keypath may add a key to a
+// dictionary, or (as an index one past the end of an array) append an element to an array.
+// Every other step must name a value that is already there.
+func (p *BinaryPatcher) Set(keypath string, v interface{}) (err error) {
+	kp, err := parseKeypath(keypath)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	enc := &Encoder{format: BinaryFormat}
+	pval := enc.marshal(reflect.ValueOf(v))
+	if pval == nil {
+		return errors.New("plist: no value to set")
+	}
+
+	p.countReferences()
+	if len(kp) == 0 {
+		p.refCounts[p.topObject]--
+		p.topObject = p.reference(pval)
+		return nil
+	}
+
+	// Find the container to change, giving every shared container along the way
+	// a copy of its own.
+	id := p.topObject
+	for i, e := range kp[:len(kp)-1] {
+		child, ref, ok := p.lookup(id, e)
+		if !ok {
+			return fmt.Errorf("plist: no value at keypath %s", kp[:i+1])
+		}
+		id = p.unshare(id, ref, child)
+	}
+
+	tag, refs := p.contents(id)
+	refs = append([]uint64(nil), refs...)
+	e := kp[len(kp)-1]
+	switch {
+	case e.index >= 0 && tag == bpTagArray:
+		switch {
+		case e.index < len(refs):
+			p.refCounts[refs[e.index]]--
+			refs[e.index] = p.reference(pval)
+		case e.index == len(refs):
+			refs = append(refs, p.reference(pval))
+		default:
+			return fmt.Errorf("plist: index %d is out of range for the array at keypath %s", e.index, kp[:len(kp)-1])
+		}
+	case e.index < 0 && tag == bpTagDictionary:
+		n := len(refs) / 2
+		if i, ok := p.keyIndex(refs[:n], e.key); ok {
+			p.refCounts[refs[n+i]]--
+			refs[n+i] = p.reference(pval)
+		} else {
+			keys := append(refs[:n:n], p.reference(cfString(e.key)))
+			values := append(refs[n:], p.reference(pval))
+			refs = append(keys, values...)
+		}
+	case e.index >= 0:
+		return fmt.Errorf("plist: the value at keypath %s is not an array", kp[:len(kp)-1])
+	default:
+		return fmt.Errorf("plist: the value at keypath %s is not a dictionary", kp[:len(kp)-1])
+	}
+	p.objects[id] = bplistPatchObject{tag: tag, refs: refs}
+	return nil
+}
+
+// Bytes returns the patched document.
+func (p *BinaryPatcher) Bytes() (doc []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	trailer := p.parser.trailer
+	objects := p.objects
+
+	// Object references only grow wider when there are too many objects for them. Every container
+	// in the document then has to be written again with wider references, though its ID stays the same.
+	refSize := uint8(bplistMinimumIntSize(p.numObjects, false))
+	if refSize > trailer.ObjectRefSize {
+		objects = make(map[uint64]bplistPatchObject, len(p.objects))
+		for id := uint64(0); id < trailer.NumObjects; id++ {
+			if tag, refs := p.contents(id); tag != 0 {
+				objects[id] = bplistPatchObject{tag: tag, refs: refs}
+			}
+		}
+		for id, obj := range p.objects {
+			objects[id] = obj
+		}
+	} else {
+		refSize = trailer.ObjectRefSize
+	}
+
+	offsets := make([]uint64, p.numObjects)
+	for id := uint64(0); id < trailer.NumObjects; id++ {
+		offsets[id] = uint64(p.parser.offsetForObject(id))
+	}
+
+	ids := make([]uint64, 0, len(objects))
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := &bytes.Buffer{}
+	g := newBplistGenerator(buf)
+	g.trailer = trailer
+	g.trailer.ObjectRefSize = refSize
+	g.write(p.doc[:trailer.OffsetTableOffset])
+	for _, id := range ids {
+		offsets[id] = g.offset
+		obj := objects[id]
+		if obj.leaf != nil {
+			g.writePlistValue(obj.leaf)
+			continue
+		}
+
+		switch obj.tag {
+		case bpTagDictionary:
+			g.writeCountedTag(obj.tag, uint64(len(obj.refs)/2))
+		case bpTagURL:
+			g.writeByte(bpTagURL + uint8(len(obj.refs)-1))
+		default:
+			g.writeCountedTag(obj.tag, uint64(len(obj.refs)))
+		}
+		for _, ref := range obj.refs {
+			g.writeSizedInt(ref, int(refSize))
+		}
+	}
+
+	g.trailer.NumObjects = p.numObjects
+	g.trailer.TopObject = p.topObject
+	g.trailer.OffsetTableOffset = g.offset
+	g.trailer.OffsetIntSize = uint8(bplistMinimumIntSize(g.offset, false))
+	for _, off := range offsets {
+		g.writeSizedInt(off, int(g.trailer.OffsetIntSize))
+	}
+	g.writeTrailer()
+	if err := g.writer.Flush(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// countReferences counts the references to every object that can be reached from the top
+// object, the first time it is called.
+func (p *BinaryPatcher) countReferences() {
+	if p.refCounts != nil {
+		return
+	}
+	p.refCounts = map[uint64]int{p.topObject: 1}
+	stack := []uint64{p.topObject}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		_, refs := p.contents(id)
+		for _, ref := range refs {
+			p.refCounts[ref]++
+			if p.refCounts[ref] == 1 {
+				stack = append(stack, ref)
+			}
+		}
+	}
+}
+
+// reference adds pval, and returns the object ID of a new reference to it.
+func (p *BinaryPatcher) reference(pval cfValue) uint64 {
+	id := p.add(pval)
+	p.refCounts[id]++
+	return id
+}
+
+// unshare returns the object ID to use for the container id, which parent refers to as its
+// ref'th object. If anything else refers to the container as well, parent is given a copy of
+// it with a new ID, so that changing it doesn't change the others.
+func (p *BinaryPatcher) unshare(parent uint64, ref int, id uint64) uint64 {
+	tag, refs := p.contents(id)
+	if tag == 0 || p.refCounts[id] <= 1 {
+		return id
+	}
+
+	copied := p.numObjects
+	p.numObjects++
+	p.objects[copied] = bplistPatchObject{tag: tag, refs: append([]uint64(nil), refs...)}
+	for _, r := range refs {
+		p.refCounts[r]++
+	}
+	p.refCounts[id]--
+	p.refCounts[copied] = 1
+
+	ptag, prefs := p.contents(parent)
+	prefs = append([]uint64(nil), prefs...)
+	prefs[ref] = copied
+	p.objects[parent] = bplistPatchObject{tag: ptag, refs: prefs}
+	return copied
+}
+
+// add gives pval, and everything in it, new object IDs.
+func (p *BinaryPatcher) add(pval cfValue) uint64 {
+	var obj bplistPatchObject
+	switch pval := pval.(type) {
+	case *cfDictionary:
+		pval.sort()
+		obj.tag = bpTagDictionary
+		var values []uint64
+		for i, v := range pval.values {
+			if v == nil {
+				continue
+			}
+			obj.refs = append(obj.refs, p.add(cfString(pval.keys[i])))
+			values = append(values, p.add(v))
+		}
+		obj.refs = append(obj.refs, values...)
+	case *cfArray:
+		obj.tag = bpTagArray
+		obj.refs = p.addList(pval.values)
+	case *cfSet:
+		obj.tag = bpTagSet
+		if pval.ordered {
+			obj.tag = bpTagOrderedSet
+		}
+		obj.refs = p.addList(pval.values)
+	case *cfURL:
+		obj.tag = bpTagURL
+		if pval.base != nil {
+			obj.refs = append(obj.refs, p.add(pval.base))
+		}
+		obj.refs = append(obj.refs, p.add(cfString(pval.str)))
+	default:
+		key := bplistScalarKey(pval)
+		if id, ok := p.leaves[key]; ok {
+			return id
+		}
+		obj.leaf = pval
+		p.leaves[key] = p.numObjects
+	}
+
+	for _, ref := range obj.refs {
+		p.refCounts[ref]++
+	}
+	id := p.numObjects
+	p.numObjects++
+	p.objects[id] = obj
+	return id
+}
+
+func (p *BinaryPatcher) addList(values []cfValue) []uint64 {
+	refs := make([]uint64, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			refs = append(refs, p.add(v))
+		}
+	}
+	return refs
+}
+
+// contents returns the marker of the container with the given object ID and the IDs of the
+// objects it refers to, or a zero marker if the object isn't a container.
+func (p *BinaryPatcher) contents(id uint64) (uint8, []uint64) {
+	if obj, ok := p.objects[id]; ok {
+		return obj.tag, obj.refs
+	}
+
+	parser := p.parser
+	if id >= parser.trailer.NumObjects {
+		panic(fmt.Errorf("invalid object#%d (max %d)", id, parser.trailer.NumObjects))
+	}
+	off := parser.offsetForObject(id)
+	switch tag := parser.bytesAt(off, 1)[0]; tag & 0xF0 {
+	case bpTagArray, bpTagOrderedSet, bpTagSet, bpTagDictionary:
+		refs, _ := parser.objectRefsAtOffset(off)
+		return tag & 0xF0, refs
+	case bpTagNull:
+		if tag == bpTagURL || tag == bpTagURLWithBase {
+			refs, _ := parser.objectRefsAtOffset(off)
+			return bpTagURL, refs
+		}
+	}
+	return 0, nil
+}
+
+// lookup returns the object ID of the value that e names in the container with the given object ID,
+// and where the container refers to it.
+func (p *BinaryPatcher) lookup(id uint64, e keypathElement) (uint64, int, bool) {
+	tag, refs := p.contents(id)
+	switch {
+	case e.index >= 0 && tag == bpTagArray:
+		if e.index < len(refs) {
+			return refs[e.index], e.index, true
+		}
+	case e.index < 0 && tag == bpTagDictionary:
+		n := len(refs) / 2
+		if i, ok := p.keyIndex(refs[:n], e.key); ok {
+			return refs[n+i], n + i, true
+		}
+	}
+	return 0, 0, false
+}
+
+// keyIndex returns the index of key among the object IDs of a dictionary's keys. As when
+// decoding, if a key appears more than once the last one wins.
+func (p *BinaryPatcher) keyIndex(keys []uint64, key string) (int, bool) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		var k cfValue
+		if obj, ok := p.objects[keys[i]]; ok {
+			k = obj.leaf
+		} else {
+			k = p.parser.objectAtIndex(keys[i])
+		}
+		if s, ok := k.(cfString); ok && string(s) == key {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,257 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+)
+
+const (
+	// bplistReadWindowSize is the minimum amount read at once from a lazily-read binary property list.
+	bplistReadWindowSize = 4096
+
+	// bplistReadWindows is the number of windows kept. A lookup moves back and forth between
+	// the offset table and at least one object; a few windows keep it from reading the same
+	// parts of the document over and over.
+	bplistReadWindows = 4
+)
+
+// A bplistWindow is a part of a lazily-read binary property list, starting at base.
+type bplistWindow struct {
+	base offset
+	buf  []byte
+}
+
+// A BinaryReader reads individual values out of a binary property list on demand.
+//
+// Where a Decoder reads and parses an entire document, a BinaryReader starts by reading
+// only the document's header, trailer and offset table entries as needed. Each call to Decode
+// then reads just the containers along its keypath and the value it names, so extracting
+// one value from a very large document is fast and needs very little memory.
+//
+// A BinaryReader is not safe for concurrent use.
+type BinaryReader struct {
+	parser *bplistParser
+}
+
+// NewBinaryReader returns a BinaryReader that reads the binary property list of the given
+// size from r. An *os.File is a suitable io.ReaderAt.
+func NewBinaryReader(r io.ReaderAt, size int64) (*BinaryReader, error) {
+	p := &bplistParser{readerAt: r}
+	if err := p.openLazily(size); err != nil {
+		return nil, err
+	}
+	return &BinaryReader{parser: p}, nil
+}
+
+// Decode unmarshals the value at keypath into v, exactly as Unmarshal would have if it had
+// decoded the entire document and then walked to that value.
+//
+// keypath takes the form reported by Node.Keypath: a sequence of /key and [index] steps,
+// such as /Entries[2]/Name. The empty keypath and "/" both refer to the top-level value.
+func (r *BinaryReader) Decode(keypath string, v interface{}) (err error) {
+	kp, err := parseKeypath(keypath)
+	if err != nil {
+		return err
+	}
+
+	// Only keep the containers read for this value.
+	r.parser.lazyObjects = make(map[uint64]cfValue)
+	pval, err := r.parser.parseValueAtKeypath(kp)
+	r.parser.lazyObjects = nil
+	if err != nil {
+		return err
+	}
+	if pval == nil {
+		return fmt.Errorf("plist: no value at keypath %s", kp)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	dec := &Decoder{Format: BinaryFormat, keypath: kp}
+	dec.unmarshal(pval, reflect.ValueOf(v))
+	return
+}
+
+// openLazily reads and validates the header and trailer of a document of the given size.
+func (p *bplistParser) openLazily(size int64) (parseError error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			parseError = plistParseError{"binary", r.(error)}
+		}
+	}()
+
+	if size < 40 {
+		panic(errors.New("not enough data"))
+	}
+
+	p.trailerOffset = uint64(size - 32)
+
+	header := p.bytesAt(0, 8)
+	if !bytes.Equal(header[0:6], []byte{'b', 'p', 'l', 'i', 's', 't'}) {
+		panic(errors.New("incomprehensible magic"))
+	}
+
+	p.version = int(((header[6] - '0') * 10) + (header[7] - '0'))
+
+	switch p.version {
+	case 0, 1:
+	case 15, 16:
+		// These have no offset table to find objects by; they can only be read from start to end.
+		panic(fmt.Errorf("bplist%d documents can't be read lazily", p.version))
+	case 17:
+		panic(errors.New("bplist17 documents are not supported"))
+	default:
+		panic(fmt.Errorf("unexpected version %d", p.version))
+	}
+
+	trailer := p.bytesAt(offset(p.trailerOffset), 32)
+	p.trailer = bplistTrailer{
+		SortVersion:       trailer[5],
+		OffsetIntSize:     trailer[6],
+		ObjectRefSize:     trailer[7],
+		NumObjects:        binary.BigEndian.Uint64(trailer[8:]),
+		TopObject:         binary.BigEndian.Uint64(trailer[16:]),
+		OffsetTableOffset: binary.BigEndian.Uint64(trailer[24:]),
+	}
+
+	p.validateDocumentTrailer()
+	return nil
+}
+
+// lazyBytesAt returns n bytes of the document, starting at off, reading them if they
+// are not in one of the current windows.
+func (p *bplistParser) lazyBytesAt(off offset, n uint64) []byte {
+	for _, w := range p.windows {
+		if i := uint64(off - w.base); off >= w.base && i <= uint64(len(w.buf)) && n <= uint64(len(w.buf))-i {
+			return w.buf[i : i+n]
+		}
+	}
+	return p.readWindow(off, n)
+}
+
+// readWindow reads at least n bytes of the document, starting at off, into a new window
+// that replaces the oldest one. Windows are never reused, as values parsed from them may
+// still refer to them.
+func (p *bplistParser) readWindow(off offset, n uint64) []byte {
+	end := p.trailerOffset + 32
+	if uint64(off) > end || n > end-uint64(off) {
+		panic(fmt.Errorf("read of %d bytes at 0x%x runs past the end of the document", n, off))
+	}
+
+	size := n
+	if size < bplistReadWindowSize {
+		size = bplistReadWindowSize
+		if size > end-uint64(off) {
+			size = end - uint64(off)
+		}
+	}
+
+	buf := make([]byte, size)
+	if read, err := p.readerAt.ReadAt(buf, int64(off)); read < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		panic(err)
+	}
+	p.windows[p.nextWindow] = bplistWindow{off, buf}
+	p.nextWindow = (p.nextWindow + 1) % len(p.windows)
+	return buf[:n]
+}
+
+// parseValueAtKeypath parses the value at kp, reading only the containers along the way.
+// It returns nil if there is no such value.
+func (p *bplistParser) parseValueAtKeypath(kp keypath) (pval cfValue, parseError error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			parseError = plistParseError{"binary", r.(error)}
+		}
+	}()
+
+	index := p.trailer.TopObject
+	for _, e := range kp {
+		var ok bool
+		if e.index >= 0 {
+			index, ok = p.arrayElementIndex(index, e.index)
+		} else {
+			index, ok = p.dictionaryValueIndex(index, e.key)
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	return p.objectAtIndex(index), nil
+}
+
+// arrayElementIndex returns the object ID of element i of the array with the given object ID.
+func (p *bplistParser) arrayElementIndex(index uint64, i int) (uint64, bool) {
+	if index >= p.trailer.NumObjects {
+		panic(fmt.Errorf("invalid object#%d (max %d)", index, p.trailer.NumObjects))
+	}
+
+	off := p.offsetForObject(index)
+	if p.bytesAt(off, 1)[0]&0xF0 != bpTagArray {
+		return 0, false
+	}
+
+	cnt, start := p.countForTagAtOffset(off)
+	if start+offset(cnt*uint64(p.trailer.ObjectRefSize)) > offset(p.trailer.OffsetTableOffset) {
+		panic(fmt.Errorf("list@0x%x length (%v) puts its end beyond the offset table at 0x%x", start, cnt, p.trailer.OffsetTableOffset))
+	}
+	if uint64(i) >= cnt {
+		return 0, false
+	}
+	oid, _ := p.parseObjectRefAtOffset(start + offset(uint64(i)*uint64(p.trailer.ObjectRefSize)))
+	return oid, true
+}
+
+// dictionaryValueIndex returns the object ID of the value stored under key in the dictionary
+// with the given object ID. As when decoding, if a key appears more than once the last value wins.
+func (p *bplistParser) dictionaryValueIndex(index uint64, key string) (uint64, bool) {
+	if index >= p.trailer.NumObjects {
+		panic(fmt.Errorf("invalid object#%d (max %d)", index, p.trailer.NumObjects))
+	}
+
+	off := p.offsetForObject(index)
+	if p.bytesAt(off, 1)[0]&0xF0 != bpTagDictionary {
+		return 0, false
+	}
+
+	cnt, start := p.countForTagAtOffset(off)
+	refSize := uint64(p.trailer.ObjectRefSize)
+	if start+offset(cnt*2*refSize) > offset(p.trailer.OffsetTableOffset) {
+		panic(fmt.Errorf("list@0x%x length (%v) puts its end beyond the offset table at 0x%x", start, cnt*2, p.trailer.OffsetTableOffset))
+	}
+
+	for i := cnt; i > 0; i-- {
+		kid, _ := p.parseObjectRefAtOffset(start + offset((i-1)*refSize))
+		k, ok := p.objectAtIndex(kid).(cfString)
+		if !ok {
+			panic(fmt.Errorf("dictionary@0x%x contains non-string key at index %d", off, i-1))
+		}
+		if string(k) == key {
+			oid, _ := p.parseObjectRefAtOffset(start + offset((cnt+i-1)*refSize))
+			return oid, true
+		}
+	}
+	return 0, false
+}
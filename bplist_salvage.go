@@ -0,0 +1,397 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+// A SalvageDiagnostic describes damage that SalvageBinary found in a binary property list,
+// and what it did about it.
+type SalvageDiagnostic struct {
+	Offset  int64 // where in the document the damage was found
+	Message string
+}
+
+func (d SalvageDiagnostic) String() string {
+	return fmt.Sprintf("0x%x: %s", d.Offset, d.Message)
+}
+
+// SalvageBinary decodes as much of a damaged binary property list as it can into v,
+// for documents that Unmarshal rejects: those that have been truncated, or partly overwritten.
+//
+// If the document's trailer is intact, its offset table is used to find every object; objects
+// that can't be read are left out. Otherwise, SalvageBinary reads objects one after another
+// from the start of the document, as they are laid out when they are written, until it reaches
+// the end of the document or something it can't read; the first object is taken to be the
+// top-level value. Containers that refer to objects that are missing or damaged are decoded
+// without them; a missing value in an array is decoded as nil, as null is.
+//
+// SalvageBinary returns a diagnostic for everything it had to leave out or work around.
+// It returns an error only if no top-level value could be recovered at all, or if the value
+// recovered can't be stored in v.
+func SalvageBinary(data []byte, v interface{}) (diagnostics []SalvageDiagnostic, err error) {
+	s := &bplistSalvager{parser: &bplistParser{buffer: data}}
+	defer func() {
+		diagnostics = s.diagnostics
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	if len(data) < 8 || !bytes.Equal(data[0:6], []byte{'b', 'p', 'l', 'i', 's', 't'}) {
+		return nil, plistParseError{"binary", errors.New("incomprehensible magic")}
+	}
+	if data[6] != '0' || (data[7] != '0' && data[7] != '1') {
+		return nil, plistParseError{"binary", fmt.Errorf("version %s can't be salvaged", data[6:8])}
+	}
+
+	top, ok := s.openTable()
+	if !ok {
+		top = s.scan()
+	}
+	pval := s.value(top, 0)
+	if pval == nil {
+		return nil, plistParseError{"binary", errors.New("no top-level value could be salvaged")}
+	}
+
+	dec := &Decoder{Format: BinaryFormat}
+	dec.unmarshal(pval, reflect.ValueOf(v))
+	return
+}
+
+type bplistSalvager struct {
+	parser      *bplistParser
+	offsets     []offset // object ID to object offset; 0 for objects that can't be read
+	values      []cfValue
+	state       []uint8 // object ID to salvageUnvisited, salvageVisiting or salvageDone
+	diagnostics []SalvageDiagnostic
+}
+
+const (
+	salvageUnvisited = iota
+	salvageVisiting
+	salvageDone
+)
+
+func (s *bplistSalvager) diagnose(off offset, format string, args ...interface{}) {
+	s.diagnostics = append(s.diagnostics, SalvageDiagnostic{int64(off), fmt.Sprintf(format, args...)})
+}
+
+// openTable reads the trailer and offset table, if they are intact, and returns the top object.
+func (s *bplistSalvager) openTable() (top uint64, ok bool) {
+	p := s.parser
+	l := uint64(len(p.buffer))
+	if l < 40 {
+		s.diagnose(offset(l), "document is too short to have a trailer")
+		return 0, false
+	}
+
+	p.trailerOffset = l - 32
+	trailer := p.buffer[p.trailerOffset:]
+	p.trailer = bplistTrailer{
+		SortVersion:       trailer[5],
+		OffsetIntSize:     trailer[6],
+		ObjectRefSize:     trailer[7],
+		NumObjects:        binary.BigEndian.Uint64(trailer[8:]),
+		TopObject:         binary.BigEndian.Uint64(trailer[16:]),
+		OffsetTableOffset: binary.BigEndian.Uint64(trailer[24:]),
+	}
+	if err := s.try(p.validateDocumentTrailer); err != nil {
+		s.diagnose(offset(p.trailerOffset), "unusable trailer (%v)", err)
+		return 0, false
+	}
+
+	end := offset(p.trailer.OffsetTableOffset)
+	s.reset(p.trailer.NumObjects)
+	for id := range s.offsets {
+		entry := end + offset(uint64(id)*uint64(p.trailer.OffsetIntSize))
+		off, _ := p.parseOffsetAtOffset(entry)
+		if off < 8 || off >= end {
+			s.diagnose(entry, "object#%d has an invalid offset (0x%x)", id, off)
+			continue
+		}
+		if _, ok := s.objectLength(off, end); !ok {
+			s.diagnose(off, "object#%d is damaged", id)
+			continue
+		}
+		s.offsets[id] = off
+	}
+	return p.trailer.TopObject, true
+}
+
+// scan finds the objects in a document with no usable offset table by reading them one
+// after another. The width of object references has to be guessed: scan tries every width,
+// and keeps the one that lets the most objects be reached from the first.
+func (s *bplistSalvager) scan() uint64 {
+	p := s.parser
+	p.trailer.OffsetTableOffset = uint64(len(p.buffer))
+
+	var best []offset
+	var bestSize uint8
+	var stop offset
+	bestReached := -1
+	for size := uint8(1); size <= 8; size++ {
+		p.trailer.ObjectRefSize = size
+		offsets, end := s.scanObjects()
+		if reached := s.reachable(offsets); reached > bestReached {
+			best, bestSize, bestReached, stop = offsets, size, reached, end
+		}
+	}
+
+	p.trailer.ObjectRefSize = bestSize
+	s.reset(uint64(len(best)))
+	copy(s.offsets, best)
+	if stop < offset(len(p.buffer)) {
+		s.diagnose(stop, "unreadable object; objects from here on were lost")
+	}
+	s.diagnose(8, "recovered %d objects assuming %d-byte object references", len(best), bestSize)
+	return 0
+}
+
+// scanObjects returns the offsets of the objects from the start of the document to the
+// first one that can't be read, or to the offset table, and where it stopped.
+func (s *bplistSalvager) scanObjects() ([]offset, offset) {
+	end := offset(len(s.parser.buffer))
+	var offsets []offset
+	off := offset(8)
+	for off < end && !s.atOffsetTable(offsets, off) {
+		n, ok := s.objectLength(off, end)
+		if !ok {
+			return offsets, off
+		}
+		if s.parser.buffer[off] != bpTagFill {
+			offsets = append(offsets, off)
+		}
+		off += offset(n)
+	}
+	return offsets, end
+}
+
+// atOffsetTable reports whether the offset table of a document whose objects start at the
+// given offsets appears to begin at off.
+func (s *bplistSalvager) atOffsetTable(offsets []offset, off offset) bool {
+	if len(offsets) < 2 {
+		return false
+	}
+	buf := s.parser.buffer[off:]
+	for size := 1; size <= 8 && 2*size <= len(buf); size++ {
+		first, second := uint64(0), uint64(0)
+		for i := 0; i < size; i++ {
+			first = first<<8 | uint64(buf[i])
+			second = second<<8 | uint64(buf[size+i])
+		}
+		if first == uint64(offsets[0]) && second == uint64(offsets[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable returns the number of objects that can be reached from the first through
+// object references that are in range.
+func (s *bplistSalvager) reachable(offsets []offset) int {
+	if len(offsets) == 0 {
+		return 0
+	}
+	seen := make([]bool, len(offsets))
+	seen[0] = true
+	stack := []int{0}
+	n := 0
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n++
+		refs, _ := s.parser.objectRefsAtOffset(offsets[id])
+		for _, ref := range refs {
+			if ref < uint64(len(offsets)) && !seen[ref] {
+				seen[ref] = true
+				stack = append(stack, int(ref))
+			}
+		}
+	}
+	return n
+}
+
+func (s *bplistSalvager) reset(n uint64) {
+	s.offsets = make([]offset, n)
+	s.values = make([]cfValue, n)
+	s.state = make([]uint8, n)
+}
+
+// objectLength returns the length of the object at off, if all of it comes before end.
+func (s *bplistSalvager) objectLength(off, end offset) (uint64, bool) {
+	buf := s.parser.buffer[off:end]
+	tag := buf[0]
+	ref := uint64(s.parser.trailer.ObjectRefSize)
+
+	var n uint64
+	switch tag & 0xF0 {
+	case bpTagNull:
+		switch tag {
+		case bpTagNull, bpTagBoolFalse, bpTagBoolTrue, bpTagFill:
+			n = 1
+		case bpTagURL, bpTagURLWithBase:
+			n = 1 + uint64(tag-bpTagURL+1)*ref
+		case bpTagUUID:
+			n = 17
+		default:
+			return 0, false
+		}
+	case bpTagInteger:
+		if tag&0x0F > 4 {
+			return 0, false
+		}
+		n = 1 + 1<<(tag&0x0F)
+	case bpTagReal:
+		if tag&0x0F != 2 && tag&0x0F != 3 {
+			return 0, false
+		}
+		n = 1 + 1<<(tag&0x0F)
+	case bpTagDate:
+		if tag != bpTagDate|3 {
+			return 0, false
+		}
+		n = 9
+	case bpTagUID:
+		n = 2 + uint64(tag&0x0F)
+		if tag&0x0F >= 8 {
+			return 0, false
+		}
+	case bpTagData, bpTagASCIIString, bpTagUTF16String, bpTagArray, bpTagOrderedSet, bpTagSet, bpTagDictionary:
+		cnt, header := uint64(tag&0x0F), uint64(1)
+		if cnt == 0xF {
+			if len(buf) < 2 || buf[1]&0xF0 != bpTagInteger || buf[1]&0x0F > 3 {
+				return 0, false
+			}
+			size := uint64(1) << (buf[1] & 0x0F)
+			header = 2 + size
+			if uint64(len(buf)) < header {
+				return 0, false
+			}
+			cnt = 0
+			for _, c := range buf[2:header] {
+				cnt = cnt<<8 | uint64(c)
+			}
+		}
+
+		unit := uint64(1)
+		switch tag & 0xF0 {
+		case bpTagUTF16String:
+			unit = 2
+		case bpTagArray, bpTagOrderedSet, bpTagSet:
+			unit = ref
+		case bpTagDictionary:
+			unit = 2 * ref
+		}
+		if cnt > uint64(len(buf))/unit {
+			return 0, false
+		}
+		n = header + cnt*unit
+	default:
+		return 0, false
+	}
+
+	if n > uint64(len(buf)) {
+		return 0, false
+	}
+	return n, true
+}
+
+// value returns the object with the given ID, reached through a reference at the given offset,
+// or nil if it can't be recovered.
+func (s *bplistSalvager) value(id uint64, from offset) cfValue {
+	if id >= uint64(len(s.offsets)) || s.offsets[id] == 0 {
+		s.diagnose(from, "reference to missing object#%d", id)
+		return nil
+	}
+
+	switch s.state[id] {
+	case salvageDone:
+		return s.values[id]
+	case salvageVisiting:
+		s.diagnose(from, "object#%d refers back to itself", id)
+		return nil
+	}
+
+	s.state[id] = salvageVisiting
+	pval := s.parse(s.offsets[id])
+	s.values[id] = pval
+	s.state[id] = salvageDone
+	return pval
+}
+
+// parse parses the object at off, recovering the contents of containers one at a time.
+func (s *bplistSalvager) parse(off offset) cfValue {
+	refs, start := s.parser.objectRefsAtOffset(off)
+	ref := offset(s.parser.trailer.ObjectRefSize)
+	values := make([]cfValue, len(refs))
+	for i, id := range refs {
+		values[i] = s.value(id, start+offset(i)*ref)
+	}
+
+	switch tag := s.parser.buffer[off]; tag & 0xF0 {
+	case bpTagArray:
+		return &cfArray{values}
+	case bpTagOrderedSet, bpTagSet:
+		return &cfSet{values: values, ordered: tag&0xF0 == bpTagOrderedSet}
+	case bpTagDictionary:
+		n := len(values) / 2
+		dict := &cfDictionary{}
+		for i, k := range values[:n] {
+			str, ok := k.(cfString)
+			if !ok {
+				if k != nil {
+					s.diagnose(start+offset(i)*ref, "dictionary@0x%x has a non-string key; its value was left out", off)
+				}
+				continue
+			}
+			dict.keys = append(dict.keys, string(str))
+			dict.values = append(dict.values, values[n+i])
+		}
+		return dict
+	case bpTagNull:
+		if tag == bpTagURL || tag == bpTagURLWithBase {
+			url := &cfURL{}
+			if len(values) == 2 {
+				if url.base, _ = values[0].(*cfURL); url.base == nil {
+					s.diagnose(off, "URL@0x%x has a base that isn't a URL; it was left out", off)
+				}
+			}
+			str, ok := values[len(values)-1].(cfString)
+			if !ok {
+				s.diagnose(off, "URL@0x%x has a non-string value", off)
+				return nil
+			}
+			url.str = string(str)
+			return url
+		}
+	}
+
+	var pval cfValue
+	if err := s.try(func() { pval = s.parser.parseTagAtOffset(off) }); err != nil {
+		s.diagnose(off, "%v", err)
+		return nil
+	}
+	return pval
+}
+
+// try calls f, and returns the error it panics with, if any.
+func (s *bplistSalvager) try(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+	f()
+	return nil
+}
@@ -0,0 +1,198 @@
+package plist
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// bplistStreamRefSize is the size of every object reference in a streamed binary property
+	// list. The number of objects isn't known until the end, so it has to be large enough for any.
+	bplistStreamRefSize = 4
+
+	// bplistStreamMaxKeys is the number of distinct dictionary keys a streamed binary property
+	// list writes only once. Keys beyond that are written every time they appear.
+	bplistStreamMaxKeys = 4096
+)
+
+// bplistStreamGenerator writes a binary property list for a StreamEncoder.
+//
+// Objects are written as soon as they are complete, each container after its contents,
+// so only the object references of the containers that are still open are kept in memory.
+// The offset of every object is needed for the offset table at the end of the document;
+// those are kept, compactly, in a bplistOffsetBuffer.
+type bplistStreamGenerator struct {
+	*bplistGenerator
+
+	offsets    bplistOffsetBuffer
+	numObjects uint64
+	top        uint64
+
+	containers []bplistStreamContainer // open containers, innermost last
+	keys       map[string]uint64
+}
+
+// bplistStreamContainer holds the references to the contents of an open container.
+type bplistStreamContainer struct {
+	keys   []byte
+	values []byte
+}
+
+func newBplistStreamGenerator(w io.Writer) *bplistStreamGenerator {
+	return &bplistStreamGenerator{bplistGenerator: newBplistGenerator(w)}
+}
+
+func (p *bplistStreamGenerator) startDocument() {
+	p.writeString("bplist00")
+	p.trailer.ObjectRefSize = bplistStreamRefSize
+}
+
+// addObject records that an object was written at off, and returns its object ID.
+func (p *bplistStreamGenerator) addObject(off uint64) uint64 {
+	if p.numObjects >= 1<<(8*bplistStreamRefSize) {
+		panic(errors.New("plist: too many objects for a streamed binary property list"))
+	}
+	p.offsets.add(off)
+	p.numObjects++
+	return p.numObjects - 1
+}
+
+// addReference adds a reference to object id to the innermost open container,
+// or makes it the top object if there isn't one.
+func (p *bplistStreamGenerator) addReference(id uint64) {
+	if len(p.containers) == 0 {
+		p.top = id
+		return
+	}
+	c := &p.containers[len(p.containers)-1]
+	c.values = appendObjectRef(c.values, id)
+}
+
+func appendObjectRef(refs []byte, id uint64) []byte {
+	var b [bplistStreamRefSize]byte
+	binary.BigEndian.PutUint32(b[:], uint32(id))
+	return append(refs, b[:]...)
+}
+
+func (p *bplistStreamGenerator) keyObject(key string) uint64 {
+	if id, ok := p.keys[key]; ok {
+		return id
+	}
+	off := p.offset
+	p.writeStringTag(key)
+	id := p.addObject(off)
+	if p.keys == nil {
+		p.keys = make(map[string]uint64)
+	}
+	if len(p.keys) < bplistStreamMaxKeys {
+		p.keys[key] = id
+	}
+	return id
+}
+
+func (p *bplistStreamGenerator) startDictionary(parent PlistKind) {
+	p.containers = append(p.containers, bplistStreamContainer{})
+}
+
+func (p *bplistStreamGenerator) writeKey(key string) {
+	c := &p.containers[len(p.containers)-1]
+	c.keys = appendObjectRef(c.keys, p.keyObject(key))
+}
+
+func (p *bplistStreamGenerator) startArray(parent PlistKind) {
+	p.containers = append(p.containers, bplistStreamContainer{})
+}
+
+func (p *bplistStreamGenerator) endDictionary(parent PlistKind) {
+	p.endContainer(bpTagDictionary)
+}
+
+func (p *bplistStreamGenerator) endArray(parent PlistKind) {
+	p.endContainer(bpTagArray)
+}
+
+func (p *bplistStreamGenerator) endContainer(tag uint8) {
+	c := p.containers[len(p.containers)-1]
+	p.containers = p.containers[:len(p.containers)-1]
+
+	p.addReference(p.writeContainer(tag, c))
+}
+
+// writeContainer writes a dictionary or array with the given contents, and returns its object ID.
+func (p *bplistStreamGenerator) writeContainer(tag uint8, c bplistStreamContainer) uint64 {
+	off := p.offset
+	p.writeCountedTag(tag, uint64(len(c.values)/bplistStreamRefSize))
+	p.write(c.keys)
+	p.write(c.values)
+	return p.addObject(off)
+}
+
+func (p *bplistStreamGenerator) writeValue(parent PlistKind, pval cfValue) {
+	p.addReference(p.writeObject(pval))
+}
+
+// writeObject writes pval, and everything it contains, and returns its object ID.
+func (p *bplistStreamGenerator) writeObject(pval cfValue) uint64 {
+	switch pval := pval.(type) {
+	case *cfDictionary:
+		pval.sort()
+		var c bplistStreamContainer
+		for i, k := range pval.keys {
+			c.keys = appendObjectRef(c.keys, p.keyObject(k))
+			c.values = appendObjectRef(c.values, p.writeObject(pval.values[i]))
+		}
+		return p.writeContainer(bpTagDictionary, c)
+	case *cfArray:
+		var c bplistStreamContainer
+		for _, v := range pval.values {
+			c.values = appendObjectRef(c.values, p.writeObject(v))
+		}
+		return p.writeContainer(bpTagArray, c)
+	}
+
+	off := p.offset
+	p.writePlistValue(pval)
+	return p.addObject(off)
+}
+
+func (p *bplistStreamGenerator) endDocument() {
+	p.trailer.NumObjects = p.numObjects
+	p.trailer.TopObject = p.top
+	p.trailer.OffsetIntSize = uint8(bplistMinimumIntSize(p.offset, false))
+	p.trailer.OffsetTableOffset = p.offset
+
+	p.offsets.each(func(off uint64) {
+		p.writeSizedInt(off, int(p.trailer.OffsetIntSize))
+	})
+
+	p.writeTrailer()
+	if err := p.writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// bplistOffsetBuffer holds a list of increasing object offsets compactly: each is stored
+// as a varint of its distance from the one before, which for most objects takes one byte.
+type bplistOffsetBuffer struct {
+	buf  []byte
+	last uint64
+}
+
+func (b *bplistOffsetBuffer) add(off uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], off-b.last)
+	b.buf = append(b.buf, tmp[:n]...)
+	b.last = off
+}
+
+// each calls f with every offset, in the order they were added.
+func (b *bplistOffsetBuffer) each(f func(uint64)) {
+	var off uint64
+	for buf := b.buf; len(buf) > 0; {
+		delta, n := binary.Uvarint(buf)
+		off += delta
+		f(off)
+		buf = buf[n:]
+	}
+}
@@ -3,9 +3,16 @@ package plist
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf16"
 )
 
 func BenchmarkBplistGenerate(b *testing.B) {
@@ -139,3 +146,1143 @@ func TestBplistLatin1ToUTF16(t *testing.T) {
 		return
 	}
 }
+
+func TestBplistUTF16Strings(t *testing.T) {
+	strs := []string{
+		"é",
+		"emoji \U0001F600 and é",
+		"invalid \xff\xfe UTF-8 \xc3",
+		"surrogate \xed\xa0\x80 encoded in UTF-8",
+		"\U0010FFFF",
+	}
+
+	for _, str := range strs {
+		var buf bytes.Buffer
+		if err := NewBinaryEncoder(&buf).Encode(str); err != nil {
+			t.Fatal(err)
+		}
+
+		d := newBplistParser(bytes.NewReader(buf.Bytes()))
+		pval, err := d.parseDocument()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := string(utf16.Decode(utf16.Encode([]rune(str))))
+		if got, ok := pval.(cfString); !ok || string(got) != expected {
+			t.Errorf("%q: expected %q, received %#v", str, expected, pval)
+		}
+	}
+}
+
+type failingWriter struct {
+	n int // bytes to accept before failing
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errors.New("write failed")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestBplistGeneratorWriteError(t *testing.T) {
+	var buf bytes.Buffer
+	NewBinaryEncoder(&buf).Encode(plistValueTreeRawData)
+
+	for _, n := range []int{0, 8, buf.Len() - 1} {
+		if err := NewBinaryEncoder(&failingWriter{n}).Encode(plistValueTreeRawData); err == nil {
+			t.Errorf("expected an error writing after %d bytes", n)
+		}
+	}
+}
+
+// Pairs of distinct data values that share a CRC32 checksum.
+var crc32Collisions = [][2]string{
+	{"plumless", "buckeroo"},
+	{"codding", "gnu"},
+	{"2a59d90da5ae", "185f9ddd044d"},
+}
+
+func TestBplistUniquing(t *testing.T) {
+	negativeZero := math.Copysign(0, -1)
+	date := time.Date(2010, time.July, 1, 12, 0, 0, 0, time.UTC)
+
+	type uniquingTest struct {
+		name    string
+		values  []interface{}
+		objects uint64 // including the array itself
+	}
+	uniquingTests := []uniquingTest{
+		{"Equal data", []interface{}{[]byte("a"), []byte("a")}, 2},
+		{"Equal dates in different locations", []interface{}{date, date.In(time.FixedZone("X", 3600))}, 2},
+		{"Unequal dates", []interface{}{date, date.Add(time.Second)}, 3},
+		{"Zero and negative zero", []interface{}{0.0, negativeZero}, 3},
+		{"NaN", []interface{}{math.NaN(), math.NaN()}, 2},
+		{"32-bit reals", []interface{}{float32(1), 1.0, float32(1)}, 3},
+	}
+	for _, c := range crc32Collisions {
+		uniquingTests = append(uniquingTests, uniquingTest{"CRC32 collision " + c[0] + "/" + c[1], []interface{}{[]byte(c[0]), []byte(c[1]), []byte(c[0])}, 3})
+	}
+
+	for _, test := range uniquingTests {
+		subtest(t, test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewBinaryEncoder(&buf).Encode(test.values); err != nil {
+				t.Fatal(err)
+			}
+
+			d := newBplistParser(bytes.NewReader(buf.Bytes()))
+			pval, err := d.parseDocument()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.trailer.NumObjects != test.objects {
+				t.Errorf("expected %d objects, found %d", test.objects, d.trailer.NumObjects)
+			}
+
+			var decoded []interface{}
+			if err := NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&decoded); err != nil {
+				t.Fatal(err)
+			}
+			for i, v := range test.values {
+				got := decoded[i]
+				switch v := v.(type) {
+				case float64:
+					if math.Float64bits(got.(float64)) != math.Float64bits(v) && !(math.IsNaN(v) && math.IsNaN(got.(float64))) {
+						t.Errorf("value %d: expected %v, got %v", i, v, got)
+					}
+				case time.Time:
+					if !got.(time.Time).Equal(v) {
+						t.Errorf("value %d: expected %v, got %v", i, v, got)
+					}
+				default:
+					if !reflect.DeepEqual(got, v) {
+						t.Errorf("value %d: expected %#v, got %#v (%#v)", i, v, got, pval)
+					}
+				}
+			}
+		})
+	}
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r *bytes.Reader
+	n int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += n
+	return n, err
+}
+
+type binaryReaderEntry struct {
+	Name string
+	Size int
+	Blob []byte
+}
+
+func TestBinaryReader(t *testing.T) {
+	entries := make([]binaryReaderEntry, 1000)
+	for i := range entries {
+		entries[i] = binaryReaderEntry{Name: fmt.Sprintf("entry %d", i), Size: i, Blob: bytes.Repeat([]byte{byte(i)}, 4096)}
+	}
+	doc := map[string]interface{}{
+		"Entries": entries,
+		"Version": 3,
+		"Info":    map[string]string{"a": "b"},
+	}
+
+	data, err := Marshal(doc, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := &countingReaderAt{r: bytes.NewReader(data)}
+	r, err := NewBinaryReader(cr, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var name string
+	if err := r.Decode("/Entries[500]/Name", &name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "entry 500" {
+		t.Errorf("expected entry 500, got %q", name)
+	}
+	if cr.n > len(data)/20 {
+		t.Errorf("read %d of %d bytes to decode one string", cr.n, len(data))
+	}
+
+	var entry binaryReaderEntry
+	if err := r.Decode("/Entries[999]", &entry); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry, entries[999]) {
+		t.Errorf("expected %v, got %v", entries[999], entry)
+	}
+
+	var info map[string]interface{}
+	if err := r.Decode("/Info", &info); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, map[string]interface{}{"a": "b"}) {
+		t.Errorf("unexpected /Info %v", info)
+	}
+
+	var everything map[string]interface{}
+	if err := r.Decode("/", &everything); err != nil {
+		t.Fatal(err)
+	}
+	var expected map[string]interface{}
+	if _, err := Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(everything, expected) {
+		t.Error("decoding / did not produce the whole document")
+	}
+
+	for _, kp := range []string{"/Missing", "/Entries[1000]", "/Entries/Name", "/Version/x", "/Version[0]", "/Entries[0]/Name/x"} {
+		var v interface{}
+		if err := r.Decode(kp, &v); err == nil {
+			t.Errorf("%s: expected an error, got %v", kp, v)
+		}
+	}
+
+	for _, kp := range []string{"Entries", "/Entries[", "/Entries[-1]", "/Entries[x]"} {
+		var v interface{}
+		if err := r.Decode(kp, &v); err == nil {
+			t.Errorf("%s: expected an invalid keypath error, got %v", kp, v)
+		}
+	}
+
+}
+
+// shortReaderAt cuts short any read that crosses from, without reporting an error.
+type shortReaderAt struct {
+	r    *bytes.Reader
+	from int64
+}
+
+func (s *shortReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.r.ReadAt(p, off)
+	if off < s.from && off+int64(n) > s.from {
+		return int(s.from - off), nil
+	}
+	return n, err
+}
+
+func TestBinaryReaderShortRead(t *testing.T) {
+	doc := map[string]interface{}{"Blob": bytes.Repeat([]byte{1}, 8192), "Name": "x"}
+	data, err := Marshal(doc, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewBinaryReader(&shortReaderAt{bytes.NewReader(data), int64(len(data) / 2)}, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob []byte
+	if err := r.Decode("/Blob", &blob); err == nil {
+		t.Error("expected an error from a short read")
+	}
+}
+
+func TestKeypathEscaping(t *testing.T) {
+	keys := []string{"a/b", "c[0]", `back\slash`, `\`, "/", "[", "plain"}
+	doc := map[string]interface{}{}
+	for _, k := range keys {
+		doc[k] = map[string]interface{}{k: []interface{}{k}}
+	}
+	data, err := Marshal(doc, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewBinaryReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range keys {
+		var kp keypath
+		kp.pushKey(k)
+		kp.pushKey(k)
+		kp.pushIndex(0)
+		s := kp.String()
+
+		parsed, err := parseKeypath(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if !reflect.DeepEqual(parsed, kp) {
+			t.Errorf("%s: expected %v, got %v", s, kp, parsed)
+		}
+
+		var v string
+		if err := r.Decode(s, &v); err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if v != k {
+			t.Errorf("%s: expected %q, got %q", s, k, v)
+		}
+	}
+
+	if s := (keypath{{key: "a/b", index: -1}, {index: 1}}).String(); s != `/a\/b[1]` {
+		t.Errorf("expected /a\\/b[1], got %s", s)
+	}
+	if _, err := parseKeypath(`/a\`); err == nil {
+		t.Error("expected an error for a keypath ending in a backslash")
+	}
+}
+
+// bplist15Document wraps the encoding of a top object in a bplist15 (or later) header.
+func bplist15Document(version string, top ...byte) []byte {
+	doc := append([]byte("bplist"+version), 0x13, 0, 0, 0, 0, 0, 0, 0, 0, 0x12, 0, 0, 0, 0)
+	doc = append(doc, top...)
+	binary.BigEndian.PutUint64(doc[9:], uint64(len(doc)))
+	return doc
+}
+
+func bplist15Float64(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return b
+}
+
+func bplist15TestTop() []byte {
+	var top []byte
+	add := func(b ...byte) { top = append(top, b...) }
+
+	add(0xD6) // a dictionary of six entries: first its keys...
+	for _, k := range "abcdef" {
+		add(0x51, byte(k))
+	}
+	add(0x10, 42)                                             // a
+	add(0xA4, 0x09, 0x23)                                     // b: [true, 2.5, "hé", <78797a>]
+	add(bplist15Float64(2.5)...)                              //
+	add(0x62, 0x00, 'h', 0x00, 0xE9)                          //
+	add(0x43, 'x', 'y', 'z')                                  //
+	add(0x33)                                                 // c
+	add(bplist15Float64(86400)...)                            //
+	add(0x72, 0xC3, 0xA9)                                     // d: "é", in UTF-8
+	add(0x13, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF) // e: -1
+	add(0x4F, 0x10, 20)                                       // f: 20 bytes of data, with a separate count
+	add(bytes.Repeat([]byte{0xAB}, 20)...)
+	return top
+}
+
+func TestBplist15(t *testing.T) {
+	expected := map[string]interface{}{
+		"a": uint64(42),
+		"b": []interface{}{true, 2.5, "hé", []byte("xyz")},
+		"c": time.Date(2001, 1, 2, 0, 0, 0, 0, time.UTC),
+		"d": "é",
+		"e": int64(-1),
+		"f": bytes.Repeat([]byte{0xAB}, 20),
+	}
+	bplist00, err := Marshal(expected, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want interface{}
+	if _, err := Unmarshal(bplist00, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"15", "16"} {
+		subtest(t, version, func(t *testing.T) {
+			var got interface{}
+			format, err := Unmarshal(bplist15Document(version, bplist15TestTop()...), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != BinaryFormat {
+				t.Errorf("expected the binary format, got %s", FormatNames[format])
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected\n%#v\ngot\n%#v", want, got)
+			}
+		})
+	}
+}
+
+func TestInvalidBplist15(t *testing.T) {
+	truncated := bplist15Document("15", 0x09)
+	truncated[16]++
+
+	checksum := bplist15Document("15", 0x09)
+	checksum[17] = 0x13
+
+	for name, test := range map[string]struct {
+		doc []byte
+		err string
+	}{
+		"bplist17":        {bplist15Document("17", 0x09), "bplist17 documents are not supported"},
+		"short UUID":      {bplist15Document("15", 0x0E, 1, 2, 3), "object@0x17 extends beyond the end of the document"},
+		"URL base":        {bplist15Document("15", 0x0D, 0x51, 'a', 0x51, 'b'), "URL@0x16 has a base that isn't a URL"},
+		"URL string":      {bplist15Document("15", 0x0C, 0x09), "URL@0x16 has a non-string value"},
+		"truncated":       {truncated, "document is truncated (23 of 24 bytes)"},
+		"missing length":  {append([]byte("bplist15"), 0x09), "missing document length"},
+		"missing check":   {checksum, "missing checksum"},
+		"past the end":    {bplist15Document("15", 0xA2, 0x09), "object@0x18 extends beyond the end of the document"},
+		"huge count":      {bplist15Document("15", 0xAF, 0x13, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF), "object@0x16 count (9223372036854775807) is larger than the document"},
+		"non-string key":  {bplist15Document("15", 0xD1, 0x09, 0x09), "dictionary@0x16 contains non-string key at index 0"},
+		"nested too deep": {bplist15Document("15", append(bytes.Repeat([]byte{0xA1}, bplist15MaxDepth+1), 0x09)...), "container@0x216 is nested too deeply"},
+		"unknown atom":    {bplist15Document("15", 0x90), "unexpected atom 0x90 at offset 0x16"},
+	} {
+		subtest(t, name, func(t *testing.T) {
+			var v interface{}
+			_, err := Unmarshal(test.doc, &v)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if expected := "plist: error parsing binary property list: " + test.err; err.Error() != expected {
+				t.Errorf("expected %q, got %q", expected, err)
+			}
+		})
+	}
+
+	// Every prefix of a valid document fails cleanly.
+	doc := bplist15Document("15", bplist15TestTop()...)
+	for i := 8; i < len(doc); i++ {
+		var v interface{}
+		if _, err := Unmarshal(doc[:i], &v); err == nil {
+			t.Errorf("%d bytes: expected an error", i)
+		}
+	}
+}
+
+var extendedTestUUID = UUID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+func extendedTestURL() *url.URL {
+	u, _ := url.Parse("https://example.com/a/b?c=d")
+	return u
+}
+
+func TestBplistExtendedTypes(t *testing.T) {
+	value := map[string]interface{}{
+		"set":   Set{"a", uint64(1), Set{true}},
+		"uuid":  extendedTestUUID,
+		"url":   extendedTestURL(),
+		"nulls": []interface{}{"a", nil, "b"},
+		"null":  nil,
+	}
+
+	subtest(t, "enabled", func(t *testing.T) {
+		var buf bytes.Buffer
+		enc := NewBinaryEncoder(&buf)
+		enc.ExtendedTypes(true)
+		if err := enc.Encode(value); err != nil {
+			t.Fatal(err)
+		}
+
+		var got map[string]interface{}
+		if _, err := Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{
+			"set":   Set{"a", uint64(1), Set{true}},
+			"uuid":  extendedTestUUID,
+			"url":   extendedTestURL(),
+			"nulls": []interface{}{"a", nil, "b"},
+			"null":  nil,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected\n%#v\ngot\n%#v", want, got)
+		}
+	})
+
+	subtest(t, "disabled", func(t *testing.T) {
+		value := map[string]interface{}{
+			"set":  value["set"],
+			"uuid": value["uuid"],
+			"url":  value["url"],
+			"null": nil,
+		}
+		var got map[string]interface{}
+		if _, err := Unmarshal(mustMarshal(t, value, BinaryFormat), &got); err != nil {
+			t.Fatal(err)
+		}
+		urlData, _ := extendedTestURL().MarshalBinary()
+		want := map[string]interface{}{
+			"set":  []interface{}{"a", uint64(1), []interface{}{true}},
+			"uuid": "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			"url":  urlData,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected\n%#v\ngot\n%#v", want, got)
+		}
+	})
+
+	subtest(t, "other formats", func(t *testing.T) {
+		value := map[string]interface{}{
+			"set":  value["set"],
+			"uuid": value["uuid"],
+			"url":  value["url"],
+			"null": nil,
+		}
+		for _, format := range []int{XMLFormat, OpenStepFormat, GNUStepFormat} {
+			var buf bytes.Buffer
+			enc := NewEncoderForFormat(&buf, format)
+			enc.ExtendedTypes(true)
+			if err := enc.Encode(value); err != nil {
+				t.Fatal(err)
+			}
+			if expected := mustMarshal(t, value, format); !bytes.Equal(buf.Bytes(), expected) {
+				t.Errorf("%s: expected\n%s\ngot\n%s", FormatNames[format], expected, buf.Bytes())
+			}
+		}
+	})
+}
+
+func mustMarshal(t *testing.T, v interface{}, format int) []byte {
+	b, err := Marshal(v, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBplistExtendedTypesDecode(t *testing.T) {
+	var buf bytes.Buffer
+	base := &cfURL{str: "https://example.com/a/"}
+	newBplistGenerator(&buf).generateDocument(&cfDictionary{
+		keys: []string{"base", "url", "ordered", "uuid", "uuidString", "urlString"},
+		values: []cfValue{
+			base,
+			&cfURL{base: base, str: "b/../c?d"},
+			&cfSet{values: []cfValue{cfString("x"), cfString("y")}, ordered: true},
+			cfUUID(extendedTestUUID),
+			cfUUID(extendedTestUUID),
+			&cfURL{base: base, str: "e"},
+		},
+	})
+
+	var got struct {
+		Base       url.URL  `plist:"base"`
+		URL        *url.URL `plist:"url"`
+		Ordered    []string `plist:"ordered"`
+		UUID       *UUID    `plist:"uuid"`
+		UUIDString string   `plist:"uuidString"`
+		URLString  string   `plist:"urlString"`
+	}
+	if _, err := Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if s := got.Base.String(); s != "https://example.com/a/" {
+		t.Errorf("base: got %s", s)
+	}
+	if s := got.URL.String(); s != "https://example.com/a/c?d" {
+		t.Errorf("url: got %s", s)
+	}
+	if !reflect.DeepEqual(got.Ordered, []string{"x", "y"}) {
+		t.Errorf("ordered: got %v", got.Ordered)
+	}
+	if got.UUID == nil || *got.UUID != extendedTestUUID {
+		t.Errorf("uuid: got %v", got.UUID)
+	}
+	if got.UUIDString != "6ba7b810-9dad-11d1-80b4-00c04fd430c8" {
+		t.Errorf("uuidString: got %s", got.UUIDString)
+	}
+	if got.URLString != "https://example.com/a/e" {
+		t.Errorf("urlString: got %s", got.URLString)
+	}
+
+	var mismatch struct {
+		UUID int `plist:"uuid"`
+	}
+	if _, err := Unmarshal(buf.Bytes(), &mismatch); err == nil {
+		t.Error("expected an error decoding a UUID into an int")
+	}
+}
+
+func TestBplist15ExtendedTypes(t *testing.T) {
+	top := []byte{0xA6, 0x00, 0x0F} // [null, fill, ...
+	top = append(top, 0x0E)
+	top = append(top, extendedTestUUID[:]...)
+	top = append(top, 0x0D, 0x0C, 0x59) // <http://h/> + x
+	top = append(top, "http://h/"...)
+	top = append(top, 0x51, 'x')
+	top = append(top, 0xC2, 0x51, 'a', 0x09) // {(a, true)}
+	top = append(top, 0xB1, 0x10, 0x07)      // {(7)}, ordered
+
+	var got []interface{}
+	if _, err := Unmarshal(bplist15Document("15", top...), &got); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := got[3].(*url.URL); !ok || u.String() != "http://h/x" {
+		t.Errorf("expected http://h/x, got %v", got[3])
+	}
+	got[3] = nil
+	want := []interface{}{nil, nil, extendedTestUUID, nil, Set{"a", true}, Set{uint64(7)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%#v\ngot\n%#v", want, got)
+	}
+}
+
+func TestUUIDText(t *testing.T) {
+	const s = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	if got := extendedTestUUID.String(); got != s {
+		t.Errorf("expected %s, got %s", s, got)
+	}
+
+	var u UUID
+	if err := u.UnmarshalText([]byte("6BA7B810-9DAD-11D1-80B4-00C04FD430C8")); err != nil || u != extendedTestUUID {
+		t.Errorf("expected %s, got %s (%v)", s, u, err)
+	}
+	for _, bad := range []string{"", s[1:], "6ba7b810x9dad-11d1-80b4-00c04fd430c8", "6ba7b810-9dad-11d1-80b4-00c04fd430cg"} {
+		if err := u.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+// bplistWithWidths encodes ["a", "b"] with object refs and offsets of the given widths.
+func bplistWithWidths(refSize, offSize int) []byte {
+	put := func(b []byte, n uint64, size int) []byte {
+		for i := size - 1; i >= 0; i-- {
+			b = append(b, byte(n>>(8*uint(i))))
+		}
+		return b
+	}
+
+	doc := []byte("bplist00")
+	offsets := []uint64{uint64(len(doc))}
+	doc = append(doc, 0xA2)
+	doc = put(doc, 1, refSize)
+	doc = put(doc, 2, refSize)
+	offsets = append(offsets, uint64(len(doc)))
+	doc = append(doc, 0x51, 'a')
+	offsets = append(offsets, uint64(len(doc)))
+	doc = append(doc, 0x51, 'b')
+
+	table := uint64(len(doc))
+	for _, off := range offsets {
+		doc = put(doc, off, offSize)
+	}
+	doc = append(doc, 0, 0, 0, 0, 0, 0, byte(offSize), byte(refSize))
+	doc = put(doc, uint64(len(offsets)), 8)
+	doc = put(doc, 0, 8)
+	doc = put(doc, table, 8)
+	return doc
+}
+
+func TestBplistTrailerWidths(t *testing.T) {
+	for refSize := 1; refSize <= 8; refSize++ {
+		for offSize := 1; offSize <= 8; offSize++ {
+			var got []interface{}
+			if _, err := Unmarshal(bplistWithWidths(refSize, offSize), &got); err != nil {
+				t.Errorf("refs %d, offsets %d: %v", refSize, offSize, err)
+			} else if !reflect.DeepEqual(got, []interface{}{"a", "b"}) {
+				t.Errorf("refs %d, offsets %d: got %v", refSize, offSize, got)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		doc []byte
+		err string
+	}{
+		{bplistWithWidths(0, 1), "illegal object ref size (0 bytes)"},
+		{bplistWithWidths(9, 1), "illegal object ref size (9 bytes)"},
+		{bplistWithWidths(1, 0), "illegal offset size (0 bytes)"},
+		{bplistWithWidths(1, 9), "illegal offset size (9 bytes)"},
+	} {
+		var v interface{}
+		_, err := Unmarshal(test.doc, &v)
+		if expected := "plist: error parsing binary property list: " + test.err; err == nil || err.Error() != expected {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+
+	// UIDs can be any width, too.
+	uid := []byte("bplist00\x82\x01\x02\x03\x08\x00\x00\x00\x00\x00\x00\x01\x01")
+	uid = append(uid, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 12)
+	var got interface{}
+	if _, err := Unmarshal(uid, &got); err != nil || got != UID(0x010203) {
+		t.Errorf("expected UID 0x010203, got %v (%v)", got, err)
+	}
+}
+
+func TestBplistCompactReferences(t *testing.T) {
+	value := make([]int, 70000)
+	for i := range value {
+		value[i] = i
+	}
+
+	for _, compact := range []bool{false, true} {
+		var buf bytes.Buffer
+		enc := NewBinaryEncoder(&buf)
+		enc.CompactReferences(compact)
+		if err := enc.Encode(value); err != nil {
+			t.Fatal(err)
+		}
+
+		doc := buf.Bytes()
+		trailer := doc[len(doc)-32:]
+		expected := byte(4)
+		if compact {
+			expected = 3
+		}
+		if trailer[6] != expected || trailer[7] != expected {
+			t.Errorf("compact=%v: expected %d-byte offsets and refs, got %d and %d", compact, expected, trailer[6], trailer[7])
+		}
+
+		var got []int
+		if _, err := Unmarshal(doc, &got); err != nil {
+			t.Fatalf("compact=%v: %v", compact, err)
+		}
+		if !reflect.DeepEqual(got, value) {
+			t.Errorf("compact=%v: the document did not decode to the original value", compact)
+		}
+	}
+}
+
+func encodeOptimized(t *testing.T, v interface{}, share bool) []byte {
+	var buf bytes.Buffer
+	enc := NewBinaryEncoder(&buf)
+	enc.OptimizeSize(true)
+	enc.ShareObjects(share)
+	if err := enc.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type optimizeTestNode struct {
+	Name     string
+	Children []*optimizeTestNode
+}
+
+func TestBplistOptimizeSize(t *testing.T) {
+	value := []interface{}{
+		map[string]interface{}{"a": 1, "b": []interface{}{1, 2}},
+		map[string]interface{}{"a": 1, "b": []interface{}{1, 2}},
+		[]interface{}{1, 2},
+		[]interface{}{2, 1},
+		map[string]interface{}{"a": 1, "b": []interface{}{1, 2.0}},
+	}
+
+	plain, err := Marshal(value, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized := encodeOptimized(t, value, false)
+	if len(optimized) >= len(plain) {
+		t.Errorf("optimizing did not make the document smaller (%d bytes, was %d)", len(optimized), len(plain))
+	}
+
+	// root, {a, b}, "a", "b", 1, [1, 2], 2, [2, 1], {a, b'}, [1, 2.0], 2.0
+	if n := binary.BigEndian.Uint64(optimized[len(optimized)-24:]); n != 11 {
+		t.Errorf("expected 11 objects, got %d", n)
+	}
+
+	var want, got interface{}
+	if _, err := Unmarshal(plain, &want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(optimized, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%#v\ngot\n%#v", want, got)
+	}
+
+	// The whole test corpus decodes as it does without optimization.
+	for _, test := range tests {
+		if test.SkipEncode[BinaryFormat] || test.SkipDecode[BinaryFormat] || test.Documents[BinaryFormat] == nil {
+			continue
+		}
+		var want, got interface{}
+		if _, err := Unmarshal(test.Documents[BinaryFormat], &want); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Unmarshal(encodeOptimized(t, test.Value, false), &got); err != nil {
+			t.Errorf("%s: %v", test.Name, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected\n%#v\ngot\n%#v", test.Name, want, got)
+		}
+	}
+}
+
+// bplistObjectOffsets returns the offset of every object in a binary property list.
+func bplistObjectOffsets(t *testing.T, doc []byte) []offset {
+	p := &bplistParser{readerAt: bytes.NewReader(doc)}
+	if err := p.openLazily(int64(len(doc))); err != nil {
+		t.Fatal(err)
+	}
+	offsets := make([]offset, p.trailer.NumObjects)
+	for i := range offsets {
+		offsets[i] = p.offsetForObject(uint64(i))
+	}
+	return offsets
+}
+
+func TestBinaryPatcher(t *testing.T) {
+	archive := map[string]interface{}{
+		"$archiver": "NSKeyedArchiver",
+		"$objects":  []interface{}{"$null", map[string]interface{}{"name": UID(2), "age": UID(3)}, "Alice", 30},
+		"$top":      map[string]interface{}{"root": UID(1)},
+	}
+	data, err := Marshal(archive, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewBinaryPatcher(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []struct {
+		keypath string
+		value   interface{}
+	}{
+		{"/$objects[2]", "Bob"},
+		{"/$objects[4]", []string{"x", "y"}},
+		{"/$version", 100000},
+	} {
+		if err := p.Set(set.keypath, set.value); err != nil {
+			t.Fatalf("%s: %v", set.keypath, err)
+		}
+	}
+	patched, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if _, err := Unmarshal(patched, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"$archiver": "NSKeyedArchiver",
+		"$objects":  []interface{}{"$null", map[string]interface{}{"name": UID(2), "age": UID(3)}, "Bob", uint64(30), []interface{}{"x", "y"}},
+		"$top":      map[string]interface{}{"root": UID(1)},
+		"$version":  uint64(100000),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	before, after := bplistObjectOffsets(t, data), bplistObjectOffsets(t, patched)
+	tableOffset := binary.BigEndian.Uint64(data[len(data)-8:])
+	if !bytes.Equal(patched[:tableOffset], data[:tableOffset]) {
+		t.Error("the original objects were not kept as they were")
+	}
+	// Only the top-level dictionary and $objects have moved.
+	moved := 0
+	for i := range before {
+		if after[i] != before[i] {
+			moved++
+		}
+	}
+	if moved != 2 {
+		t.Errorf("expected 2 objects to move, but %d did", moved)
+	}
+	if len(after) <= len(before) {
+		t.Errorf("expected new objects after the original %d, got %d objects", len(before), len(after))
+	}
+
+	subtest(t, "top object", func(t *testing.T) {
+		p, _ := NewBinaryPatcher(data)
+		if err := p.Set("/", []int{1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		patched, err := p.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		if _, err := Unmarshal(patched, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, []int{1, 2}) {
+			t.Errorf("expected [1 2], got %v", got)
+		}
+	})
+
+	subtest(t, "wider references", func(t *testing.T) {
+		values := make([]int, 250)
+		for i := range values {
+			values[i] = i
+		}
+		data, err := Marshal(values, BinaryFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[len(data)-25] != 1 {
+			t.Fatalf("expected 1-byte object references, got %d", data[len(data)-25])
+		}
+
+		p, _ := NewBinaryPatcher(data)
+		for i := 250; i < 260; i++ {
+			if err := p.Set(fmt.Sprintf("[%d]", i), i); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, i)
+		}
+		patched, err := p.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patched[len(patched)-25] != 2 {
+			t.Errorf("expected 2-byte object references, got %d", patched[len(patched)-25])
+		}
+		var got []int
+		if _, err := Unmarshal(patched, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("expected %v, got %v", values, got)
+		}
+	})
+
+	subtest(t, "errors", func(t *testing.T) {
+		p, _ := NewBinaryPatcher(data)
+		for _, kp := range []string{"/Missing/x", "/$objects[6]", "/$top/root/x", "/$objects/x", "/$top[0]", "Entries"} {
+			if err := p.Set(kp, 1); err == nil {
+				t.Errorf("%s: expected an error", kp)
+			}
+		}
+		if err := p.Set("/x", nil); err == nil {
+			t.Error("expected an error setting nil")
+		}
+		if _, err := NewBinaryPatcher(bplist15Document("15", 0x09)); err == nil {
+			t.Error("expected an error patching a bplist15 document")
+		}
+	})
+}
+
+func TestBinaryPatcherSharedContainers(t *testing.T) {
+	inner := func() map[string]interface{} { return map[string]interface{}{"x": 1} }
+	doc := map[string]interface{}{
+		"a":    inner(),
+		"b":    inner(),
+		"deep": []interface{}{map[string]interface{}{"y": inner()}, map[string]interface{}{"y": inner()}},
+	}
+	data := encodeOptimized(t, doc, false)
+	// Four containers hold {x=1}, and two {y={x=1}}; each is written once.
+	if n := len(bplistObjectOffsets(t, data)); n != 10 {
+		t.Fatalf("expected the equal containers to be shared, got %d objects", n)
+	}
+
+	p, err := NewBinaryPatcher(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []struct {
+		keypath string
+		value   interface{}
+	}{
+		{"/a/x", 2},
+		{"/a/z", 3},
+		{"/deep[1]/y/x", 4},
+		{"/deep[1]/y/x", 5},
+	} {
+		if err := p.Set(set.keypath, set.value); err != nil {
+			t.Fatalf("%s: %v", set.keypath, err)
+		}
+	}
+	patched, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if _, err := Unmarshal(patched, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a": map[string]interface{}{"x": uint64(2), "z": uint64(3)},
+		"b": map[string]interface{}{"x": uint64(1)},
+		"deep": []interface{}{
+			map[string]interface{}{"y": map[string]interface{}{"x": uint64(1)}},
+			map[string]interface{}{"y": map[string]interface{}{"x": uint64(5)}},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestSalvageBinary(t *testing.T) {
+	names := make([]string, 300)
+	for i := range names {
+		names[i] = fmt.Sprintf("name %d", i)
+	}
+	doc := map[string]interface{}{
+		"Names":   names,
+		"Version": "3",
+	}
+	data, err := Marshal(doc, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableOffset := binary.BigEndian.Uint64(data[len(data)-8:])
+
+	subtest(t, "intact", func(t *testing.T) {
+		var got map[string]interface{}
+		diagnostics, err := SalvageBinary(data, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diagnostics) != 0 {
+			t.Errorf("expected no diagnostics, got %v", diagnostics)
+		}
+		if len(got["Names"].([]interface{})) != len(names) || got["Version"] != "3" {
+			t.Errorf("unexpected value %v", got)
+		}
+	})
+
+	subtest(t, "no trailer", func(t *testing.T) {
+		// The offset table is partly there, but the trailer is gone.
+		truncated := data[:tableOffset+10]
+		if _, err := Unmarshal(truncated, new(interface{})); err == nil {
+			t.Fatal("expected the truncated document to be rejected")
+		}
+
+		var got struct {
+			Names   []string
+			Version string
+		}
+		diagnostics, err := SalvageBinary(truncated, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Names, names) || got.Version != "3" {
+			t.Errorf("expected the whole document, got %v", got)
+		}
+		if len(diagnostics) == 0 || diagnostics[0].Offset != int64(len(truncated)-32) {
+			t.Errorf("expected a diagnostic for the missing trailer, got %v", diagnostics)
+		}
+	})
+
+	subtest(t, "truncated objects", func(t *testing.T) {
+		var got map[string]interface{}
+		diagnostics, err := SalvageBinary(data[:tableOffset/2], &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		salvaged, _ := got["Names"].([]interface{})
+		if len(salvaged) != len(names) {
+			t.Fatalf("expected %d names, got %v", len(names), got)
+		}
+		recovered := 0
+		for i, name := range salvaged {
+			if name == nil {
+				continue
+			}
+			recovered++
+			if name != names[i] {
+				t.Errorf("expected %q at index %d, got %q", names[i], i, name)
+			}
+		}
+		if recovered == 0 || recovered == len(names) {
+			t.Errorf("expected some of the names to be recovered, got %d", recovered)
+		}
+		if len(diagnostics) < len(names)-recovered {
+			t.Errorf("expected a diagnostic for every missing name, got %d", len(diagnostics))
+		}
+	})
+
+	subtest(t, "overwritten object", func(t *testing.T) {
+		damaged := append([]byte(nil), data...)
+		i := bytes.Index(damaged, []byte("name 7"))
+		damaged[i-1] = 0xFF
+
+		var got map[string]interface{}
+		diagnostics, err := SalvageBinary(damaged, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		salvaged := got["Names"].([]interface{})
+		if salvaged[7] != nil || salvaged[8] != "name 8" || got["Version"] != "3" {
+			t.Errorf("expected only name 7 to be lost, got %v", salvaged[:10])
+		}
+		found := false
+		for _, d := range diagnostics {
+			if d.Offset == int64(i-1) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected a diagnostic at 0x%x, got %v", i-1, diagnostics)
+		}
+	})
+
+	subtest(t, "unsalvageable", func(t *testing.T) {
+		for _, data := range [][]byte{[]byte("bplist"), []byte("<plist></plist>"), bplist15Document("15", 0x09), []byte("bplist00\xff\xff\xff")} {
+			var v interface{}
+			if _, err := SalvageBinary(data, &v); err == nil {
+				t.Errorf("%q: expected an error, got %v", data, v)
+			}
+		}
+	})
+}
+
+func TestInspectBinary(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": []interface{}{"x", "x", 1},
+		"b": "x",
+		"c": []byte{1, 2},
+	}
+	data, err := Marshal(doc, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := InspectBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Version != "00" || in.Trailer.NumObjects != uint64(len(in.Objects)) || in.Trailer.OffsetTableOffset != binary.BigEndian.Uint64(data[len(data)-8:]) {
+		t.Errorf("unexpected header or trailer %+v", in)
+	}
+
+	top := in.Objects[in.Trailer.TopObject]
+	if top.Type != "dictionary" || top.Marker != bpTagDictionary|3 || len(top.References) != 6 {
+		t.Errorf("unexpected top object %+v", top)
+	}
+	for id, obj := range in.Objects {
+		if obj.Offset != in.OffsetTable[id] || obj.Error != "" {
+			t.Errorf("unexpected object %+v", obj)
+		}
+	}
+
+	if len(in.Shared) != 1 {
+		t.Fatalf("expected one shared object, got %v", in.Shared)
+	}
+	shared := in.Objects[in.Shared[0]]
+	if shared.Value != `"x"` || shared.ReferencedBy != 3 {
+		t.Errorf("expected \"x\" to be referenced 3 times, got %+v", shared)
+	}
+
+	var text bytes.Buffer
+	if _, err := in.WriteTo(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"object ref size:     1", "[d3] dictionary -> [", `data <0102>`, fmt.Sprintf("#%d: referenced 3 times", shared.ID)} {
+		if !strings.Contains(text.String(), s) {
+			t.Errorf("expected %q in\n%s", s, text.String())
+		}
+	}
+
+	// An offset table entry that points past the objects.
+	damaged := append([]byte(nil), data...)
+	damaged[in.Trailer.OffsetTableOffset+1] = 0xFF
+	in, err = InspectBinary(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Objects[1].Error == "" {
+		t.Errorf("expected an error for object #1, got %+v", in.Objects[1])
+	}
+
+	if _, err := InspectBinary(bplist15Document("15", 0x09)); err == nil {
+		t.Error("expected an error inspecting a bplist15 document")
+	}
+}
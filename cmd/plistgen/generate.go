@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	plistPackage    = "howett.net/plist"
+	generatedMarker = "// Code generated by plistgen; DO NOT EDIT."
+)
+
+// loadPackage parses and type-checks the package in dir. The importer it returns
+// shares its packages with the ones the package was checked against.
+func loadPackage(dir string) (*types.Package, types.Importer, error) {
+	bpkg, err := build.Default.ImportDir(dir, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range bpkg.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isGenerated(f) {
+			// Methods from an earlier run may no longer match the types they were
+			// generated for; leave them out so that they are replaced, not checked.
+			continue
+		}
+		files = append(files, f)
+	}
+
+	imp := importer.ForCompiler(fset, "source", nil)
+	conf := types.Config{
+		Importer: imp,
+		Error:    func(error) {}, // tolerate references to the methods we're about to generate
+	}
+	pkg, _ := conf.Check(bpkg.ImportPath, fset, files, nil)
+	if pkg == nil {
+		return nil, nil, fmt.Errorf("could not type-check %s", dir)
+	}
+	return pkg, imp, nil
+}
+
+func isGenerated(f *ast.File) bool {
+	for _, c := range f.Comments {
+		if c.Pos() >= f.Package {
+			break
+		}
+		for _, l := range c.List {
+			if l.Text == generatedMarker {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fieldInfo mirrors the plist package's fieldInfo: one dictionary key of a struct,
+// and the chain of (possibly embedded) fields that leads to it.
+type fieldInfo struct {
+	path      []*types.Var
+	name      string
+	omitEmpty bool
+}
+
+// typeFields computes the fields of a struct the same way the plist package's
+// getTypeInfo does.
+func typeFields(st *types.Struct) []fieldInfo {
+	var fields []fieldInfo
+	for i := 0; i < st.NumFields(); i++ {
+		f := st.Field(i)
+		tag := reflect.StructTag(st.Tag(i)).Get("plist")
+		if !f.Exported() || tag == "-" {
+			continue // Private field
+		}
+
+		// For embedded structs, embed its fields.
+		if f.Anonymous() {
+			t := f.Type()
+			if ptr, ok := t.(*types.Pointer); ok {
+				t = ptr.Elem()
+			}
+			if inner, ok := t.Underlying().(*types.Struct); ok {
+				for _, finfo := range typeFields(inner) {
+					finfo.path = append([]*types.Var{f}, finfo.path...)
+					fields = addFieldInfo(fields, finfo)
+				}
+				continue
+			}
+		}
+
+		finfo := fieldInfo{path: []*types.Var{f}, name: f.Name()}
+		tokens := strings.Split(tag, ",")
+		if tokens[0] != "" {
+			finfo.name = tokens[0]
+		}
+		for _, flag := range tokens[1:] {
+			if flag == "omitempty" {
+				finfo.omitEmpty = true
+			}
+		}
+		fields = addFieldInfo(fields, finfo)
+	}
+	return fields
+}
+
+// addFieldInfo resolves conflicting names by embedding depth, as the plist package does.
+func addFieldInfo(fields []fieldInfo, newf fieldInfo) []fieldInfo {
+	var conflicts []int
+	for i := range fields {
+		if fields[i].name == newf.name {
+			conflicts = append(conflicts, i)
+		}
+	}
+
+	for _, i := range conflicts {
+		if len(fields[i].path) < len(newf.path) {
+			return fields
+		}
+	}
+
+	for c := len(conflicts) - 1; c >= 0; c-- {
+		i := conflicts[c]
+		fields = append(fields[:i], fields[i+1:]...)
+	}
+	return append(fields, newf)
+}
+
+// dispatchInterfaces holds the interfaces and types that the plist package
+// treats specially.
+type dispatchInterfaces struct {
+	marshalers   []*types.Interface
+	unmarshalers []*types.Interface
+	uid          types.Type
+	time         types.Type
+}
+
+type generator struct {
+	pkg     *types.Package
+	ifaces  dispatchInterfaces
+	imports map[string]string
+	buf     bytes.Buffer
+}
+
+func newGenerator(pkg *types.Package, imp types.Importer) *generator {
+	g := &generator{
+		pkg:     pkg,
+		imports: map[string]string{plistPackage: "plist"},
+	}
+
+	lookup := func(path, name string) types.Type {
+		if p, err := imp.Import(path); err == nil {
+			if obj := p.Scope().Lookup(name); obj != nil {
+				return obj.Type()
+			}
+		}
+		return nil
+	}
+	iface := func(path, name string) *types.Interface {
+		if t := lookup(path, name); t != nil {
+			return t.Underlying().(*types.Interface)
+		}
+		return nil
+	}
+
+	for _, i := range []*types.Interface{
+		iface(plistPackage, "Marshaler"),
+		iface("encoding", "TextMarshaler"),
+		iface("encoding", "BinaryMarshaler"),
+	} {
+		if i != nil {
+			g.ifaces.marshalers = append(g.ifaces.marshalers, i)
+		}
+	}
+	for _, i := range []*types.Interface{
+		iface(plistPackage, "NodeUnmarshaler"),
+		iface(plistPackage, "Unmarshaler"),
+		iface("encoding", "TextUnmarshaler"),
+		iface("encoding", "BinaryUnmarshaler"),
+	} {
+		if i != nil {
+			g.ifaces.unmarshalers = append(g.ifaces.unmarshalers, i)
+		}
+	}
+	g.ifaces.uid = lookup(plistPackage, "UID")
+	g.ifaces.time = lookup("time", "Time")
+	return g
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// typeString renders t as it must be spelled in the generated file.
+func (g *generator) typeString(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		if p == g.pkg {
+			return ""
+		}
+		g.imports[p.Path()] = p.Name()
+		return p.Name()
+	})
+}
+
+func (g *generator) source() []byte {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s\n\npackage %s\n\nimport (\n", generatedMarker, g.pkg.Name())
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(&out, "\t%s\n", strconv.Quote(path))
+	}
+	out.WriteString(")\n")
+	out.Write(g.buf.Bytes())
+	return out.Bytes()
+}
+
+func (g *generator) generateType(name string) error {
+	obj := g.pkg.Scope().Lookup(name)
+	if obj == nil {
+		return fmt.Errorf("type %s not found in package %s", name, g.pkg.Name())
+	}
+	named, ok := obj.Type().(*types.Named)
+	if !ok {
+		return fmt.Errorf("%s is not a named type", name)
+	}
+	st, ok := named.Underlying().(*types.Struct)
+	if !ok {
+		return fmt.Errorf("%s is not a struct type", name)
+	}
+	fields := typeFields(st)
+	g.generateMarshal(name, fields)
+	g.generateUnmarshal(name, fields)
+	return nil
+}
+
+// isType reports whether t is the (possibly unresolved) type target.
+func isType(t, target types.Type) bool {
+	return target != nil && types.Identical(t, target)
+}
+
+// implementsAny reports whether t or *t implements any of ifaces.
+func implementsAny(t types.Type, ifaces []*types.Interface) bool {
+	for _, i := range ifaces {
+		if types.Implements(t, i) || types.Implements(types.NewPointer(t), i) {
+			return true
+		}
+	}
+	return false
+}
+
+// selector returns the expression for a field.
+func selector(recv string, f fieldInfo) string {
+	expr := recv
+	for _, v := range f.path {
+		expr += "." + v.Name()
+	}
+	return expr
+}
+
+// allocateEmbedded allocates the embedded struct pointers that fields pass through,
+// as the Encoder and Decoder do, whether or not any of their fields are used.
+func (g *generator) allocateEmbedded(fields []fieldInfo) {
+	allocated := map[string]bool{}
+	for _, f := range fields {
+		expr := "v"
+		for _, p := range f.path[:len(f.path)-1] {
+			expr += "." + p.Name()
+			if ptr, ok := p.Type().(*types.Pointer); ok && !allocated[expr] {
+				allocated[expr] = true
+				g.printf("if %s == nil {\n%s = new(%s)\n}\n", expr, expr, g.typeString(ptr.Elem()))
+			}
+		}
+	}
+}
+
+// nonEmptyCheck returns the condition under which omitempty keeps a value,
+// mirroring the plist package's isEmptyValue, or "" if it is never empty.
+func nonEmptyCheck(expr string, t types.Type) string {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsString != 0:
+			return "len(" + expr + ") != 0"
+		case u.Info()&types.IsBoolean != 0:
+			return expr
+		case u.Info()&(types.IsInteger|types.IsFloat) != 0:
+			return expr + " != 0"
+		}
+	case *types.Slice, *types.Map:
+		return "len(" + expr + ") != 0"
+	case *types.Array:
+		if u.Len() == 0 {
+			return "false"
+		}
+	case *types.Pointer, *types.Interface:
+		return expr + " != nil"
+	}
+	return ""
+}
+
+func (g *generator) generateMarshal(name string, fields []fieldInfo) {
+	g.printf("\n// MarshalPlist implements plist.Marshaler.\n")
+	g.printf("func (v *%s) MarshalPlist() (interface{}, error) {\n", name)
+	g.allocateEmbedded(fields)
+	g.printf("m := make(map[string]interface{}, %d)\n", len(fields))
+	for _, f := range fields {
+		expr := selector("v", f)
+		t := f.path[len(f.path)-1].Type()
+		check := ""
+		if f.omitEmpty {
+			check = nonEmptyCheck(expr, t)
+		}
+
+		if check != "" {
+			g.printf("if %s {\n", check)
+		}
+		g.printf("m[%s] = %s\n", strconv.Quote(f.name), g.marshalExpr(expr, t))
+		if check != "" {
+			g.printf("}\n")
+		}
+	}
+	g.printf("return m, nil\n}\n")
+}
+
+// marshalExpr converts a field to a value the Encoder can handle without reflection,
+// where that does not change how it is encoded.
+func (g *generator) marshalExpr(expr string, t types.Type) string {
+	if implementsAny(t, g.ifaces.marshalers) {
+		if !typeImplements(t, g.ifaces.marshalers) {
+			// Only the pointer has the method; a copy of the field would lose it.
+			return "&" + expr
+		}
+		return expr
+	}
+	if isType(t, g.ifaces.time) || isType(t, g.ifaces.uid) {
+		return expr
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		if u.Info()&(types.IsString|types.IsBoolean|types.IsInteger|types.IsFloat) != 0 {
+			if t == u {
+				return expr
+			}
+			return u.Name() + "(" + expr + ")"
+		}
+	case *types.Slice:
+		if b, ok := u.Elem().(*types.Basic); ok && b.Kind() == types.Uint8 && t != u {
+			return "[]byte(" + expr + ")"
+		}
+	}
+	return expr
+}
+
+func typeImplements(t types.Type, ifaces []*types.Interface) bool {
+	for _, i := range ifaces {
+		if types.Implements(t, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *generator) generateUnmarshal(name string, fields []fieldInfo) {
+	g.printf("\n// UnmarshalPlistNode implements plist.NodeUnmarshaler.\n")
+	g.printf("func (v *%s) UnmarshalPlistNode(n *plist.Node) error {\n", name)
+	g.printf("if n.Kind() != plist.DictionaryKind {\nreturn n.TypeMismatch(v)\n}\n")
+	g.allocateEmbedded(fields)
+	for _, f := range fields {
+		expr := selector("v", f)
+		t := f.path[len(f.path)-1].Type()
+		g.printf("if c, ok := n.Lookup(%s); ok {\n", strconv.Quote(f.name))
+		g.unmarshalField(expr, t)
+		g.printf("}\n")
+	}
+	g.printf("return nil\n}\n")
+}
+
+func (g *generator) unmarshalField(expr string, t types.Type) {
+	accessor, conversion := g.accessor(t)
+	if accessor == "" {
+		g.printf("if err := c.Decode(&%s); err != nil {\nreturn err\n}\n", expr)
+		return
+	}
+
+	// Anything the accessor can't read directly, such as a mismatched type or a
+	// lax text value, goes through Node.Decode so that it is converted, or
+	// reported, exactly as the Decoder would.
+	g.printf("if x, err := c.%s(); err == nil {\n", accessor)
+	switch {
+	case accessor == "DataValue":
+		g.printf("%s = append(%s{}, x...)\n", expr, g.typeString(t))
+	case conversion != "":
+		g.printf("%s = %s(x)\n", expr, conversion)
+	default:
+		g.printf("%s = x\n", expr)
+	}
+	g.printf("} else if err := c.Decode(&%s); err != nil {\nreturn err\n}\n", expr)
+}
+
+// accessor returns the Node method that reads a value of type t and the
+// conversion its result needs, or "" if the field must go through Node.Decode.
+func (g *generator) accessor(t types.Type) (string, string) {
+	if isType(t, g.ifaces.time) {
+		return "DateValue", ""
+	}
+	if isType(t, g.ifaces.uid) || implementsAny(t, g.ifaces.unmarshalers) {
+		return "", ""
+	}
+
+	conversion := ""
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		var accessor, natural string
+		switch {
+		case u.Info()&types.IsString != 0:
+			accessor, natural = "StringValue", "string"
+		case u.Info()&types.IsBoolean != 0:
+			accessor, natural = "BoolValue", "bool"
+		case u.Info()&types.IsUnsigned != 0:
+			accessor, natural = "UintValue", "uint64"
+		case u.Info()&types.IsInteger != 0:
+			accessor, natural = "IntValue", "int64"
+		case u.Info()&types.IsFloat != 0:
+			accessor, natural = "FloatValue", "float64"
+		default:
+			return "", ""
+		}
+		if s := g.typeString(t); s != natural {
+			conversion = s
+		}
+		return accessor, conversion
+	case *types.Slice:
+		if b, ok := u.Elem().(*types.Basic); ok && b.Kind() == types.Uint8 {
+			return "DataValue", ""
+		}
+	}
+	return "", ""
+}
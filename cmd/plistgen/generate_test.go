@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"howett.net/plist"
+	"howett.net/plist/cmd/plistgen/internal/example"
+)
+
+// reflectRecord has Record's fields but none of its generated methods,
+// so the plist package encodes and decodes it by reflection.
+type reflectRecord example.Record
+
+var formats = []int{plist.XMLFormat, plist.BinaryFormat, plist.OpenStepFormat, plist.GNUStepFormat}
+
+func TestGenerateGolden(t *testing.T) {
+	dir := filepath.Join("internal", "example")
+	tmp, err := ioutil.TempDir("", "plistgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	output := filepath.Join(tmp, "record_plist.go")
+	if err := run(dir, []string{"Record"}, output); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join(dir, "record_plist.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("generated code differs from %s; run go generate there if the change is intended:\n%s",
+			filepath.Join(dir, "record_plist.go"), actual)
+	}
+}
+
+func TestGeneratedMarshalMatchesReflection(t *testing.T) {
+	n := 42
+	tests := []struct {
+		Name   string
+		Record func() example.Record
+	}{
+		{"Zero", func() example.Record { return example.Record{} }},
+		{"Full", func() example.Record {
+			return example.Record{
+				Base:     &example.Base{Version: 3, Origin: "here", ID: "hidden"},
+				Inner:    example.Inner{Depth: 2, Label: "inner"},
+				Name:     "record",
+				Alias:    "alias",
+				Count:    -1 << 40,
+				Small:    -8,
+				Unsigned: 65535,
+				Ratio:    1.5,
+				Wide:     1e100,
+				OK:       true,
+				Level:    7,
+				Data:     []byte{1, 2, 3},
+				Blob:     example.Blob{4, 5},
+				When:     time.Date(2013, 11, 27, 0, 34, 0, 0, time.UTC),
+				ID:       9,
+				Any:      map[string]interface{}{"a": []interface{}{"b", 1}},
+				Ptr:      &n,
+				List:     []string{"x", "y"},
+				Dict:     map[string]int{"one": 1, "two": 2},
+				Child:    &example.Inner{Depth: 1},
+				Skipped:  "skipped",
+			}
+		}},
+		{"NilInterface", func() example.Record { return example.Record{Name: "any", Any: nil} }},
+		{"NilEmbeddedPointer", func() example.Record { return example.Record{Base: nil, Name: "base"} }},
+	}
+
+	for _, test := range tests {
+		for _, format := range formats {
+			t.Run(test.Name+"/"+plist.FormatNames[format], func(t *testing.T) {
+				generated := test.Record()
+				expected, err := plist.Marshal((*reflectRecord)(&generated), format)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				generated = test.Record()
+				actual, err := plist.Marshal(&generated, format)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(expected, actual) {
+					t.Errorf("expected %q, got %q", expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestGeneratedUnmarshalMatchesReflection(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Document string
+	}{
+		{"Empty", `{}`},
+		{"Fields", `{Version = 3; origin = here; Depth = 2; Name = record; Count = -5; Small = 300; Unsigned = 12;` +
+			` Ratio = 1.25; Wide = 2.5; OK = YES; Level = 7; Data = <010203>; Blob = <>;` +
+			` When = "2013-11-27 00:34:00 +0000"; List = (x, y); Dict = {one = 1;}; Child = {Depth = 1;};` +
+			` Skipped = no;}`},
+		{"XML", `<plist><dict><key>Ratio</key><real>0.5</real><key>Small</key><integer>-3</integer>` +
+			`<key>Data</key><data>AQI=</data><key>When</key><date>2013-11-27T00:34:00Z</date></dict></plist>`},
+		{"MismatchedReal", `<plist><dict><key>Ratio</key><string>fast</string></dict></plist>`},
+		{"MismatchedInteger", `<plist><dict><key>Small</key><array/></dict></plist>`},
+		{"MismatchedString", `<plist><dict><key>Name</key><integer>1</integer></dict></plist>`},
+		{"MismatchedData", `<plist><dict><key>Blob</key><true/></dict></plist>`},
+		{"InvalidLaxValue", `{Count = many;}`},
+		{"NotDictionary", `(1, 2)`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var expected reflectRecord
+			_, expectedErr := plist.Unmarshal([]byte(test.Document), &expected)
+
+			var actual example.Record
+			_, actualErr := plist.Unmarshal([]byte(test.Document), &actual)
+
+			if expectedErr != nil {
+				// The only difference allowed is the name of the type.
+				expected := strings.Replace(expectedErr.Error(), "main.reflectRecord", "example.Record", -1)
+				if actualErr == nil || actualErr.Error() != expected {
+					t.Errorf("expected error %s, got %v", expected, actualErr)
+				}
+				return
+			}
+			if actualErr != nil {
+				t.Fatal(actualErr)
+			}
+			if !reflect.DeepEqual(example.Record(expected), actual) {
+				t.Errorf("expected %#v, got %#v", example.Record(expected), actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Package example holds the types that plistgen's tests generate methods for.
+// record_plist.go is the generator's expected output for them.
+package example
+
+import (
+	"time"
+
+	"howett.net/plist"
+)
+
+//go:generate go run howett.net/plist/cmd/plistgen -t Record
+
+type Level int
+
+type Blob []byte
+
+type Base struct {
+	Version int
+	Origin  string `plist:"origin,omitempty"`
+	ID      string // hidden by Record.ID
+}
+
+type Inner struct {
+	Depth int
+	Label string `plist:",omitempty"`
+}
+
+type Record struct {
+	*Base
+	Inner
+
+	Name     string
+	Alias    string `plist:"alias,omitempty"`
+	Count    int64
+	Small    int8
+	Unsigned uint16
+	Ratio    float32
+	Wide     float64
+	OK       bool
+	Level    Level
+	Data     []byte
+	Blob     Blob
+	When     time.Time
+	ID       plist.UID
+	Any      interface{}
+	Ptr      *int
+	List     []string
+	Dict     map[string]int
+	Child    *Inner
+	Skipped  string `plist:"-"`
+
+	private int
+}
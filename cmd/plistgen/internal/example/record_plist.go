@@ -0,0 +1,197 @@
+// Code generated by plistgen; DO NOT EDIT.
+
+package example
+
+import (
+	"howett.net/plist"
+)
+
+// MarshalPlist implements plist.Marshaler.
+func (v *Record) MarshalPlist() (interface{}, error) {
+	if v.Base == nil {
+		v.Base = new(Base)
+	}
+	m := make(map[string]interface{}, 22)
+	m["Version"] = v.Base.Version
+	if len(v.Base.Origin) != 0 {
+		m["origin"] = v.Base.Origin
+	}
+	m["Depth"] = v.Inner.Depth
+	if len(v.Inner.Label) != 0 {
+		m["Label"] = v.Inner.Label
+	}
+	m["Name"] = v.Name
+	if len(v.Alias) != 0 {
+		m["alias"] = v.Alias
+	}
+	m["Count"] = v.Count
+	m["Small"] = v.Small
+	m["Unsigned"] = v.Unsigned
+	m["Ratio"] = v.Ratio
+	m["Wide"] = v.Wide
+	m["OK"] = v.OK
+	m["Level"] = int(v.Level)
+	m["Data"] = v.Data
+	m["Blob"] = []byte(v.Blob)
+	m["When"] = v.When
+	m["ID"] = v.ID
+	m["Any"] = v.Any
+	m["Ptr"] = v.Ptr
+	m["List"] = v.List
+	m["Dict"] = v.Dict
+	m["Child"] = v.Child
+	return m, nil
+}
+
+// UnmarshalPlistNode implements plist.NodeUnmarshaler.
+func (v *Record) UnmarshalPlistNode(n *plist.Node) error {
+	if n.Kind() != plist.DictionaryKind {
+		return n.TypeMismatch(v)
+	}
+	if v.Base == nil {
+		v.Base = new(Base)
+	}
+	if c, ok := n.Lookup("Version"); ok {
+		if x, err := c.IntValue(); err == nil {
+			v.Base.Version = int(x)
+		} else if err := c.Decode(&v.Base.Version); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("origin"); ok {
+		if x, err := c.StringValue(); err == nil {
+			v.Base.Origin = x
+		} else if err := c.Decode(&v.Base.Origin); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Depth"); ok {
+		if x, err := c.IntValue(); err == nil {
+			v.Inner.Depth = int(x)
+		} else if err := c.Decode(&v.Inner.Depth); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Label"); ok {
+		if x, err := c.StringValue(); err == nil {
+			v.Inner.Label = x
+		} else if err := c.Decode(&v.Inner.Label); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Name"); ok {
+		if x, err := c.StringValue(); err == nil {
+			v.Name = x
+		} else if err := c.Decode(&v.Name); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("alias"); ok {
+		if x, err := c.StringValue(); err == nil {
+			v.Alias = x
+		} else if err := c.Decode(&v.Alias); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Count"); ok {
+		if x, err := c.IntValue(); err == nil {
+			v.Count = x
+		} else if err := c.Decode(&v.Count); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Small"); ok {
+		if x, err := c.IntValue(); err == nil {
+			v.Small = int8(x)
+		} else if err := c.Decode(&v.Small); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Unsigned"); ok {
+		if x, err := c.UintValue(); err == nil {
+			v.Unsigned = uint16(x)
+		} else if err := c.Decode(&v.Unsigned); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Ratio"); ok {
+		if x, err := c.FloatValue(); err == nil {
+			v.Ratio = float32(x)
+		} else if err := c.Decode(&v.Ratio); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Wide"); ok {
+		if x, err := c.FloatValue(); err == nil {
+			v.Wide = x
+		} else if err := c.Decode(&v.Wide); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("OK"); ok {
+		if x, err := c.BoolValue(); err == nil {
+			v.OK = x
+		} else if err := c.Decode(&v.OK); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Level"); ok {
+		if x, err := c.IntValue(); err == nil {
+			v.Level = Level(x)
+		} else if err := c.Decode(&v.Level); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Data"); ok {
+		if x, err := c.DataValue(); err == nil {
+			v.Data = append([]byte{}, x...)
+		} else if err := c.Decode(&v.Data); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Blob"); ok {
+		if x, err := c.DataValue(); err == nil {
+			v.Blob = append(Blob{}, x...)
+		} else if err := c.Decode(&v.Blob); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("When"); ok {
+		if x, err := c.DateValue(); err == nil {
+			v.When = x
+		} else if err := c.Decode(&v.When); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("ID"); ok {
+		if err := c.Decode(&v.ID); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Any"); ok {
+		if err := c.Decode(&v.Any); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Ptr"); ok {
+		if err := c.Decode(&v.Ptr); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("List"); ok {
+		if err := c.Decode(&v.List); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Dict"); ok {
+		if err := c.Decode(&v.Dict); err != nil {
+			return err
+		}
+	}
+	if c, ok := n.Lookup("Child"); ok {
+		if err := c.Decode(&v.Child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Plistgen generates reflection-free property list encoding and decoding methods
+// for struct types.
+//
+// Given the name of one or more struct types in a package, plistgen writes a file
+// containing a MarshalPlist method (implementing plist.Marshaler) and an
+// UnmarshalPlistNode method (implementing plist.NodeUnmarshaler) for each of them.
+// Encoder and Decoder pick these methods up like any others, so the generated
+// code needs no registration.
+//
+// The generated methods produce and accept the same property lists as the
+// reflection-based encoder and decoder, following the same rules for `plist`
+// struct tags, omitempty and embedded structs. Fields of basic types, []byte and
+// time.Time are handled directly; any other field is handed back to the Encoder
+// or Decoder, and so still benefits from generated methods on its own type.
+// Decode hooks see the generated type as a whole, but not its basic fields.
+//
+// Typical use is from a go:generate directive:
+//
+//	//go:generate plistgen -t Config,Entry
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+var opts struct {
+	Types  string `short:"t" long:"type" description:"comma-separated list of struct type names" required:"true" value-name:"<types>"`
+	Output string `short:"o" long:"out" description:"output filename (default <type>_plist.go)" default:"" value-name:"<filename>"`
+}
+
+func main() {
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = "[OPTIONS] [directory]"
+	args, err := parser.Parse()
+	if err != nil {
+		// flags.Default implies flags.PrintError; there's no reason to print it here
+		os.Exit(2)
+	}
+
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	if err := run(dir, strings.Split(opts.Types, ","), opts.Output); err != nil {
+		fmt.Fprintln(os.Stderr, "plistgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, typeNames []string, output string) error {
+	pkg, imp, err := loadPackage(dir)
+	if err != nil {
+		return err
+	}
+
+	g := newGenerator(pkg, imp)
+	for _, name := range typeNames {
+		if err := g.generateType(strings.TrimSpace(name)); err != nil {
+			return err
+		}
+	}
+
+	if output == "" {
+		output = strings.ToLower(strings.TrimSpace(typeNames[0])) + "_plist.go"
+	}
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(dir, output)
+	}
+
+	src := g.source()
+	formatted, err := format.Source(src)
+	if err != nil {
+		// Write the unformatted source out anyway; it's easier to debug.
+		ioutil.WriteFile(output, src, 0644)
+		return fmt.Errorf("internal error: invalid Go generated: %v", err)
+	}
+	return ioutil.WriteFile(output, formatted, 0644)
+}
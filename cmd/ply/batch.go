@@ -0,0 +1,86 @@
+//go:build go1.16
+// +build go1.16
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// runBatch converts every file under dir whose path matches pattern to the format given by -c.
+// Each converted file replaces the original, or is written to the same relative path under
+// the directory given by -o. It returns the number of files that could not be converted.
+func runBatch(dir, pattern string) (int, error) {
+	convert := strings.ToLower(opts.Convert)
+	format, ok := nameFormatMap[convert]
+	if !ok {
+		return 0, fmt.Errorf("unknown output format %s", convert)
+	}
+	if format >= PrettyFormat {
+		return 0, errors.New("batch mode can only convert to a property list format (xml, binary, openstep, gnustep)")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	batch := plist.NewBatch(opts.Jobs)
+	if opts.Indent {
+		batch.Indent("\t")
+	}
+	results, err := batch.Convert(ctx, os.DirFS(dir), pattern, format)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return 0, err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err == nil {
+			r.Err = writeBatchResult(dir, r)
+		}
+		if r.Err != nil {
+			if !errors.Is(r.Err, context.Canceled) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Join(dir, filepath.FromSlash(r.Path)), r.Err)
+			}
+			failed++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "converted %d of %d files\n", len(results)-failed, len(results))
+	return failed, err
+}
+
+// writeBatchResult writes a converted file with the permissions of the file it was converted from.
+func writeBatchResult(dir string, r plist.BatchResult) error {
+	name := filepath.FromSlash(r.Path)
+	info, err := os.Stat(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	perm := info.Mode().Perm()
+	if opts.Output == "" {
+		return writeFileMode(filepath.Join(dir, name), r.Data, perm)
+	}
+
+	output := filepath.Join(opts.Output, name)
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	return writeFileMode(output, r.Data, perm)
+}
+
+// writeFileMode writes data to filename, and gives it the permissions perm whether or not
+// it existed already.
+func writeFileMode(filename string, data []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(filename, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(filename, perm)
+}
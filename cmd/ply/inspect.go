@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"howett.net/plist"
+)
+
+// inspectCommand dumps the structure of a binary property list.
+type inspectCommand struct {
+	JSON bool `long:"json" description:"describe the structure as JSON"`
+}
+
+func (c *inspectCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return errors.New("inspect takes exactly one file")
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	in, err := plist.InspectBinary(data)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.Output != "" && opts.Output != "-" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if c.JSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(in)
+	}
+	_, err = in.WriteTo(w)
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !go1.16
+// +build !go1.16
+
+package main
+
+import "errors"
+
+// runBatch reports that batch conversion isn't available: it is built on io/fs, which
+// arrived in Go 1.16.
+func runBatch(dir, pattern string) (int, error) {
+	return 0, errors.New("batch mode requires ply to be built with Go 1.16 or later")
+}
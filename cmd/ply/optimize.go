@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"howett.net/plist"
+)
+
+// optimizeCommand rewrites property lists as the smallest binary property lists the library can write.
+type optimizeCommand struct{}
+
+func (c *optimizeCommand) Execute(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no files to optimize")
+	}
+	if opts.Output != "" && len(args) > 1 {
+		return errors.New("-o can only be used when optimizing a single file")
+	}
+
+	failed := 0
+	for _, filename := range args {
+		if err := optimizeFile(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be optimized", failed, len(args))
+	}
+	return nil
+}
+
+// optimizeFile optimizes one file, replacing it unless -o was given, and reports the bytes saved.
+// A binary property list that can't be made any smaller is left as it is. Other formats are
+// only optimized into a new file, so that a document isn't turned into binary by accident.
+func optimizeFile(filename string) error {
+	before, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// Converting keeps the order of the keys and the width of the numbers as they were.
+	buf := &bytes.Buffer{}
+	enc := plist.NewBinaryEncoder(buf)
+	enc.OptimizeSize(true)
+	format, err := enc.Convert(bytes.NewReader(before))
+	if err != nil {
+		return err
+	}
+	if format != plist.BinaryFormat && opts.Output == "" {
+		return fmt.Errorf("not a binary property list (%s); use -o to write an optimized binary copy", plist.FormatNames[format])
+	}
+	after := buf.Bytes()
+
+	if format == plist.BinaryFormat && len(after) >= len(before) {
+		after = before
+	}
+
+	switch opts.Output {
+	case "":
+		if !bytes.Equal(after, before) {
+			err = ioutil.WriteFile(filename, after, 0644)
+		}
+	case "-":
+		_, err = os.Stdout.Write(after)
+	default:
+		err = ioutil.WriteFile(opts.Output, after, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := len(before) - len(after)
+	fmt.Fprintf(os.Stderr, "%s: %d -> %d bytes (saved %d bytes, %.1f%%)\n",
+		filename, len(before), len(after), saved, 100*float64(saved)/float64(len(before)))
+	return nil
+}
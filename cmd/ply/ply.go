@@ -55,13 +55,29 @@ var opts struct {
 	Keypath string `short:"k" long:"key" description:"A keypath!" default:"/" value-name:"<keypath>"`
 	Output  string `short:"o" long:"out" description:"output filename" default:"" value-name:"<filename>"`
 	Indent  bool   `short:"I" long:"indent" description:"indent indentable output formats (xml, openstep, gnustep, json)"`
+	Batch   string `short:"B" long:"batch" description:"convert every file under the given directory whose path matches a glob (** matches any number of directories)" value-name:"<glob>"`
+	Jobs    int    `short:"j" long:"jobs" description:"number of files to convert at once in batch mode (default: number of CPUs)" value-name:"<n>"`
 }
 
 func main() {
 	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("optimize", "shrink binary property lists",
+		"Rewrites each file as the smallest binary property list ply can write, and reports the bytes saved.", &optimizeCommand{})
+	parser.AddCommand("inspect", "dump the structure of a binary property list",
+		"Describes the header, trailer, offset table and every object of a binary property list, and which objects are shared.", &inspectCommand{})
+	parser.AddCommand("stats", "report which values make a property list big",
+		"Measures how many bytes every value in a property list takes when it is encoded, and lists the heaviest keypaths and the bytes taken by each type of value.", &statsCommand{})
 	args, err := parser.Parse()
 	if err != nil {
 		// flags.Default implies flags.PrintError; there's no reason to print it here
+		if _, ok := err.(*flags.Error); !ok {
+			// a command failed
+			os.Exit(1)
+		}
+		return
+	}
+	if parser.Active != nil {
 		return
 	}
 
@@ -78,6 +94,21 @@ func main() {
 		return
 	}
 
+	if opts.Batch != "" {
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		failed, err := runBatch(dir, opts.Batch)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		if err != nil || failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(args) < 1 {
 		parser.WriteHelp(os.Stderr)
 		return
@@ -101,13 +132,18 @@ func main() {
 	}
 
 	var val interface{}
+	buf := &bytes.Buffer{}
+	isPlist := false
 	switch strings.ToLower(filepath.Ext(filename)) {
 	case ".json", ".yaml", ".yml":
-		buf := &bytes.Buffer{}
 		io.Copy(buf, file)
 		err = yaml.Unmarshal(buf.Bytes(), &val)
 	default:
-		dec := plist.NewDecoder(file)
+		// Keep the document around: it may be converted from directly, after the
+		// output file (which may be the same file) has been created.
+		isPlist = true
+		io.Copy(buf, file)
+		dec := plist.NewDecoder(bytes.NewReader(buf.Bytes()))
 		err = dec.Decode(&val)
 	}
 
@@ -163,7 +199,14 @@ func main() {
 		if opts.Indent {
 			enc.Indent("\t")
 		}
-		err := enc.Encode(val)
+		var err error
+		if isPlist && (keypath == "" || keypath == "/") {
+			// Converting a whole property list keeps what decoding it would lose,
+			// such as the order of its dictionaries' keys.
+			_, err = enc.Convert(bytes.NewReader(buf.Bytes()))
+		} else {
+			err = enc.Encode(val)
+		}
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net/url"
 	"reflect"
 	"sort"
 	"time"
@@ -45,6 +46,20 @@ func printMap(w io.Writer, tv reflect.Value, depth string) {
 	fmt.Fprintf(w, "%s}\n", depth)
 }
 
+func printList(w io.Writer, tv []interface{}, open, close, depth string) {
+	fmt.Fprintf(w, "%s\n", open)
+	for i, v := range tv {
+		id := fmt.Sprintf("[%d]", i)
+		nd := depth + "  "
+		for i := 0; i < len(id)+2; i++ {
+			nd += " "
+		}
+		fmt.Fprintf(w, "  %s%s: ", depth, id)
+		printValue(w, v, nd)
+	}
+	fmt.Fprintf(w, "%s%s\n", depth, close)
+}
+
 func printValue(w io.Writer, val interface{}, depth string) {
 	switch tv := val.(type) {
 	case map[interface{}]interface{}:
@@ -52,19 +67,13 @@ func printValue(w io.Writer, val interface{}, depth string) {
 	case map[string]interface{}:
 		printMap(w, reflect.ValueOf(tv), depth)
 	case []interface{}:
-		fmt.Fprintf(w, "(\n")
-		for i, v := range tv {
-			id := fmt.Sprintf("[%d]", i)
-			nd := depth + "  "
-			for i := 0; i < len(id)+2; i++ {
-				nd += " "
-			}
-			fmt.Fprintf(w, "  %s%s: ", depth, id)
-			printValue(w, v, nd)
-		}
-		fmt.Fprintf(w, "%s)\n", depth)
+		printList(w, tv, "(", ")", depth)
+	case plist.Set:
+		printList(w, tv, "{(", ")}", depth)
 	case plist.UID:
 		fmt.Fprintf(w, "#%d\n", uint64(tv))
+	case plist.UUID, *url.URL:
+		fmt.Fprintf(w, "<%s>\n", tv)
 	case int64, uint64, string, float32, float64, bool, time.Time:
 		fmt.Fprintf(w, "%+v\n", tv)
 	case uint8:
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"howett.net/plist"
+)
+
+// statsCommand reports which values take up the most space in a property list.
+type statsCommand struct {
+	Top    int    `short:"n" long:"top" description:"number of keypaths to list" default:"20" value-name:"<n>"`
+	Format string `short:"f" long:"format" description:"measure the property list in this format (default: its own format)" value-name:"<format>"`
+}
+
+func (c *statsCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return errors.New("stats takes exactly one file")
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	format := plist.InvalidFormat
+	if c.Format != "" {
+		f, ok := nameFormatMap[c.Format]
+		if !ok || f >= PrettyFormat {
+			return fmt.Errorf("unknown property list format %s", c.Format)
+		}
+		format = f
+
+		// Only a document in another format has to be encoded again.
+		buf := &bytes.Buffer{}
+		if _, err := plist.NewEncoderForFormat(buf, format).Convert(bytes.NewReader(data)); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	report, err := plist.MeasureDocument(data)
+	if err != nil {
+		return err
+	}
+	if format == plist.InvalidFormat {
+		// Otherwise, keep the name asked for: GNUStep with nothing but strings reads back as OpenStep.
+		format = report.Format
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.Output != "" && opts.Output != "-" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	percent := func(n int64) float64 {
+		return 100 * float64(n) / float64(report.Total)
+	}
+	fmt.Fprintf(w, "%s: %d bytes as %s, %d bytes of overhead\n", args[0], report.Total, plist.FormatNames[format], report.Overhead)
+
+	fmt.Fprintf(w, "\nheaviest keypaths:\n")
+	for _, v := range report.Heaviest(c.Top) {
+		fmt.Fprintf(w, "%10d %5.1f%%  %s (%s)\n", v.Size, percent(v.Size), v.Keypath, v.Type)
+	}
+
+	types := make([]string, 0, len(report.Types))
+	for t := range report.Types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if report.Types[types[i]] != report.Types[types[j]] {
+			return report.Types[types[i]] > report.Types[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	fmt.Fprintf(w, "\nby type:\n")
+	for _, t := range types {
+		fmt.Fprintf(w, "%10d %5.1f%%  %s\n", report.Types[t], percent(report.Types[t]), t)
+	}
+	return nil
+}
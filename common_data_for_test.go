@@ -2,6 +2,7 @@ package plist
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"reflect"
 	"time"
@@ -78,6 +79,36 @@ func (b *TextMarshalingBoolViaPointer) UnmarshalText(text []byte) error {
 	return nil
 }
 
+type BinaryMarshalingID struct {
+	hi, lo uint16
+}
+
+func (id BinaryMarshalingID) MarshalBinary() ([]byte, error) {
+	return []byte{byte(id.hi >> 8), byte(id.hi), byte(id.lo >> 8), byte(id.lo)}, nil
+}
+
+func (id *BinaryMarshalingID) UnmarshalBinary(data []byte) error {
+	if len(data) != 4 {
+		return errors.New("wrong length for binary-marshaled ID")
+	}
+	id.hi = uint16(data[0])<<8 | uint16(data[1])
+	id.lo = uint16(data[2])<<8 | uint16(data[3])
+	return nil
+}
+
+type TextAndBinaryMarshalingID struct {
+	BinaryMarshalingID
+}
+
+func (id TextAndBinaryMarshalingID) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%04x-%04x", id.hi, id.lo)), nil
+}
+
+func (id *TextAndBinaryMarshalingID) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "%04x-%04x", &id.hi, &id.lo)
+	return err
+}
+
 type ArrayThatSerializesAsOneObject struct {
 	values []uint64
 }
@@ -698,6 +729,34 @@ var tests = []TestData{
 		},
 		DecodeValue: &BothUnmarshaler{int64(0)},
 	},
+	{
+		Name:  "BinaryMarshaler/BinaryUnmarshaler",
+		Value: BinaryMarshalingID{0x0102, 0x0304},
+		Documents: map[int][]byte{
+			OpenStepFormat: []byte(`<01020304>`),
+			GNUStepFormat:  []byte(`<01020304>`),
+			XMLFormat:      []byte(xmlPreamble + `<plist version="1.0"><data>AQIDBA==</data></plist>`),
+			BinaryFormat:   []byte{0x62, 0x70, 0x6c, 0x69, 0x73, 0x74, 0x30, 0x30, 0x44, 0x01, 0x02, 0x03, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0d},
+		},
+	},
+	{
+		Name:  "Type implementing both Text and Binary Marshaler",
+		Value: TextAndBinaryMarshalingID{BinaryMarshalingID{0x0102, 0x0304}},
+		Documents: map[int][]byte{
+			OpenStepFormat: []byte(`"0102-0304"`),
+			GNUStepFormat:  []byte(`0102-0304`),
+			XMLFormat:      []byte(xmlPreamble + `<plist version="1.0"><string>0102-0304</string></plist>`),
+			BinaryFormat:   []byte{0x62, 0x70, 0x6c, 0x69, 0x73, 0x74, 0x30, 0x30, 0x59, 0x30, 0x31, 0x30, 0x32, 0x2d, 0x30, 0x33, 0x30, 0x34, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x12},
+		},
+	},
+	{
+		Name:        "Type implementing both Text and Binary Unmarshaler, from data",
+		Value:       []byte{0x01, 0x02, 0x03, 0x04},
+		DecodeValue: TextAndBinaryMarshalingID{BinaryMarshalingID{0x0102, 0x0304}},
+		Documents: map[int][]byte{
+			XMLFormat: []byte(xmlPreamble + `<plist version="1.0"><data>AQIDBA==</data></plist>`),
+		},
+	},
 	{
 		Name: "Comments",
 		Value: struct {
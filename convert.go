@@ -0,0 +1,124 @@
+package plist
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+)
+
+// Convert reads a property list in any format from r and writes it to w in the given format,
+// and returns the format it was read in. See Encoder.Convert.
+func Convert(r io.ReadSeeker, w io.Writer, format int) (int, error) {
+	return NewEncoderForFormat(w, format).Convert(r)
+}
+
+// Convert reads a property list in any format from r and writes it in the Encoder's format,
+// and returns the format it was read in.
+//
+// Unlike decoding a document into an interface{} and encoding the result, Convert writes
+// the values it reads as they are, and so keeps everything about them that the Encoder's
+// format can represent: the order of the keys in each dictionary, the width of integers
+// and reals in binary property lists, and the sets, null, URLs and UUIDs that they may hold.
+// For the other formats, sets are written as arrays, URLs and UUIDs as strings, and null
+// is left out of the arrays and dictionaries that contain it.
+func (p *Encoder) Convert(r io.ReadSeeker) (format int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	dec := NewDecoder(r)
+	doc, err := dec.readDocument()
+	if err != nil {
+		return InvalidFormat, err
+	}
+	pval, err := dec.parseDocument(doc, reflect.Value{})
+	if err != nil {
+		return InvalidFormat, err
+	}
+
+	pval = p.convertValue(pval, make(map[cfValue]cfValue))
+	if pval == nil {
+		panic(errors.New("plist: no root element to encode"))
+	}
+	p.generate(pval)
+	return dec.Format, nil
+}
+
+// convertValue returns pval, ready to be written in the Encoder's format. Containers are
+// converted in place, and only once, so that those that are shared stay shared.
+func (p *Encoder) convertValue(pval cfValue, done map[cfValue]cfValue) cfValue {
+	binary := p.format == BinaryFormat || p.format == AutomaticFormat
+	switch pval.(type) {
+	case *cfDictionary, *cfArray, *cfSet, *cfURL:
+		if converted, ok := done[pval]; ok {
+			return converted
+		}
+	}
+
+	var converted cfValue
+	switch pval := pval.(type) {
+	case nil:
+		if binary {
+			return cfNull{}
+		}
+		return nil
+	case *cfDictionary:
+		pval.keepOrder = true
+		done[pval] = pval
+		keys, values := pval.keys[:0], pval.values[:0]
+		for i, v := range pval.values {
+			if v = p.convertValue(v, done); v != nil {
+				keys = append(keys, pval.keys[i])
+				values = append(values, v)
+			}
+		}
+		pval.keys, pval.values = keys, values
+		return pval
+	case *cfArray:
+		done[pval] = pval
+		pval.values = p.convertValues(pval.values, done)
+		return pval
+	case *cfSet:
+		if binary {
+			done[pval] = pval
+			pval.values = p.convertValues(pval.values, done)
+			return pval
+		}
+		converted = &cfArray{p.convertValues(pval.values, done)}
+	case *cfURL:
+		if binary {
+			done[pval] = pval
+			return pval
+		}
+		if u, err := pval.resolve(); err == nil {
+			converted = cfString(u.String())
+		} else {
+			converted = cfString(pval.str)
+		}
+	case cfUUID:
+		if binary {
+			return pval
+		}
+		return cfString(UUID(pval).String())
+	default:
+		return pval
+	}
+	done[pval] = converted
+	return converted
+}
+
+func (p *Encoder) convertValues(values []cfValue, done map[cfValue]cfValue) []cfValue {
+	converted := values[:0]
+	for _, v := range values {
+		if v = p.convertValue(v, done); v != nil {
+			converted = append(converted, v)
+		}
+	}
+	return converted
+}
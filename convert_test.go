@@ -0,0 +1,133 @@
+package plist
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// convertTestDocument is a binary property list holding the dictionary {b = 5; a = 1.5;},
+// with its keys out of order, 5 stored in 8 bytes and 1.5 as a 32-bit real.
+var convertTestDocument = []byte{
+	'b', 'p', 'l', 'i', 's', 't', '0', '0',
+	0xD2, 0x01, 0x02, 0x03, 0x04, // {#1 = #3; #2 = #4}
+	0x51, 'b',
+	0x51, 'a',
+	0x13, 0, 0, 0, 0, 0, 0, 0, 5,
+	0x22, 0x3F, 0xC0, 0x00, 0x00,
+	0x08, 0x0D, 0x0F, 0x11, 0x1A, // offset table
+	0, 0, 0, 0, 0, 0, 1, 1,
+	0, 0, 0, 0, 0, 0, 0, 5,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 31,
+}
+
+func convertTo(t *testing.T, doc []byte, format int) []byte {
+	var buf bytes.Buffer
+	if _, err := Convert(bytes.NewReader(doc), &buf, format); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvert(t *testing.T) {
+	subtest(t, "binary", func(t *testing.T) {
+		var buf bytes.Buffer
+		format, err := Convert(bytes.NewReader(convertTestDocument), &buf, BinaryFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != BinaryFormat {
+			t.Errorf("expected the input to be binary, got %s", FormatNames[format])
+		}
+
+		p := &bplistParser{}
+		p.reset(buf.Bytes())
+		pval, err := p.parseDocument()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict := pval.(*cfDictionary)
+		if !reflect.DeepEqual([]string(dict.keys), []string{"b", "a"}) {
+			t.Errorf("expected the keys to stay in order, got %v", dict.keys)
+		}
+		if n := dict.values[0].(*cfNumber); n.value != 5 || n.width != 8 {
+			t.Errorf("expected 5 in 8 bytes, got %d in %d", n.value, n.width)
+		}
+		if r := dict.values[1].(*cfReal); r.value != 1.5 || r.wide {
+			t.Errorf("expected a 32-bit 1.5, got %v (wide %v)", r.value, r.wide)
+		}
+	})
+
+	inOrder := func(t *testing.T, doc []byte, format int) {
+		b, a := "b=", "a="
+		if format == XMLFormat {
+			b, a = "<key>b</key>", "<key>a</key>"
+		}
+		out := string(doc)
+		if i, j := strings.Index(out, b), strings.Index(out, a); i < 0 || j < 0 || i > j {
+			t.Errorf("expected b before a, got %s", out)
+		}
+	}
+	for _, format := range []int{XMLFormat, OpenStepFormat, GNUStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			out := convertTo(t, convertTestDocument, format)
+			inOrder(t, out, format)
+
+			// Converting to binary and back again keeps the order too.
+			inOrder(t, convertTo(t, convertTo(t, out, BinaryFormat), format), format)
+		})
+	}
+
+	subtest(t, "extended types", func(t *testing.T) {
+		var buf bytes.Buffer
+		enc := NewBinaryEncoder(&buf)
+		enc.ExtendedTypes(true)
+		if err := enc.Encode(map[string]interface{}{
+			"set":  Set{"x"},
+			"uuid": extendedTestUUID,
+			"url":  extendedTestURL(),
+			"list": []interface{}{"a", nil, "b"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		doc := buf.Bytes()
+
+		var got map[string]interface{}
+		if _, err := Unmarshal(convertTo(t, doc, BinaryFormat), &got); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"set":  Set{"x"},
+			"uuid": extendedTestUUID,
+			"url":  extendedTestURL(),
+			"list": []interface{}{"a", nil, "b"},
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+
+		got = nil
+		if _, err := Unmarshal(convertTo(t, doc, XMLFormat), &got); err != nil {
+			t.Fatal(err)
+		}
+		expected = map[string]interface{}{
+			"set":  []interface{}{"x"},
+			"uuid": extendedTestUUID.String(),
+			"url":  extendedTestURL().String(),
+			"list": []interface{}{"a", "b"},
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+	})
+
+	subtest(t, "errors", func(t *testing.T) {
+		for _, doc := range []string{"bplist00", "<plist><dict>", "<plist/>"} {
+			if _, err := Convert(strings.NewReader(doc), &bytes.Buffer{}, XMLFormat); err == nil {
+				t.Errorf("%q: expected an error", doc)
+			}
+		}
+	})
+}
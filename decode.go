@@ -3,14 +3,12 @@ package plist
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"runtime"
+	"sync"
 )
 
-type parser interface {
-	parseDocument() (cfValue, error)
-}
-
 // A Decoder reads a property list from an input stream.
 type Decoder struct {
 	// the format of the most-recently-decoded property list
@@ -18,8 +16,32 @@ type Decoder struct {
 
 	reader io.ReadSeeker
 	lax    bool
+
+	shareObjects bool
+	shared       map[sharedKey]reflect.Value
+
+	hooks      []DecodeHookFunc
+	hookValues map[cfValue]interface{} // containers as passed to hooks, for the current document
+	keypath    keypath
+
+	// parsers kept between documents so that their buffers can be reused
+	bplistParser *bplistParser
+	xmlParser    *xmlPlistParser
+	textParser   *textPlistParser
 }
 
+// A DecodeHookFunc can transform a property list value before it is stored in a Go value.
+//
+// keypath is the location of the value in the document, in the form reported by Node.Keypath.
+// from is the kind of the property list value, and to is the type it is being decoded into.
+// value holds the property list value as Unmarshal would decode it into an interface{}
+// (or the result of the previous hook in the chain).
+//
+// The hook returns the value to decode in its place. Returning value unchanged continues
+// decoding as normal; returning a value assignable to to stores it directly; any other
+// value is decoded into to as if it had appeared in the document. A non-nil error aborts decoding.
+type DecodeHookFunc func(keypath string, from PlistKind, to reflect.Type, value interface{}) (interface{}, error)
+
 // Decode works like Unmarshal, except it reads the decoder stream to find property list elements.
 //
 // After Decoding, the Decoder's Format field will be set to one of the plist format constants.
@@ -33,48 +55,166 @@ func (p *Decoder) Decode(v interface{}) (err error) {
 		}
 	}()
 
-	header := make([]byte, 6)
-	p.reader.Read(header)
-	p.reader.Seek(0, 0)
+	doc, err := p.readDocument()
+	if err != nil {
+		return err
+	}
 
-	var parser parser
-	var pval cfValue
-	if bytes.Equal(header, []byte("bplist")) {
-		parser = newBplistParser(p.reader)
-		pval, err = parser.parseDocument()
+	p.lax = false
+	p.keypath = p.keypath[:0]
+	p.shared = nil
+	p.hookValues = nil
+	if p.shareObjects {
+		p.shared = make(map[sharedKey]reflect.Value)
+	}
+
+	val := reflect.ValueOf(v)
+
+	// The XML and text formats can be decoded as they are parsed, unless a hook
+	// needs to see every value as a whole.
+	var into reflect.Value
+	if val.IsValid() && len(p.hooks) == 0 {
+		into = val
+	}
+
+	pval, err := p.parseDocument(doc, into)
+	if err != nil {
+		return err
+	}
+	p.unmarshal(pval, val)
+	p.hookValues = nil
+	return
+}
+
+// parseDocument parses doc, in whichever format it is in, and sets Format. If into is valid,
+// XML and text documents are decoded straight into it as they are parsed, and no value is returned.
+func (p *Decoder) parseDocument(doc []byte, into reflect.Value) (cfValue, error) {
+	if bytes.HasPrefix(doc, []byte("bplist")) {
+		if p.bplistParser == nil {
+			p.bplistParser = &bplistParser{}
+		}
+		p.bplistParser.reset(doc)
+		pval, err := p.bplistParser.parseDocument()
 		if err != nil {
 			// Had a bplist header, but still got an error: we have to die here.
-			return err
+			return nil, err
 		}
 		p.Format = BinaryFormat
+		return pval, nil
+	}
+
+	singlePass := into.IsValid()
+
+	var pval cfValue
+	var err error
+	if p.xmlParser == nil {
+		p.xmlParser = &xmlPlistParser{}
+	}
+	xp := p.xmlParser
+	xp.reset(doc)
+	if singlePass {
+		err = xp.decodeDocument(p, into)
 	} else {
-		parser = newXMLPlistParser(p.reader)
-		pval, err = parser.parseDocument()
-		if _, ok := err.(invalidPlistError); ok {
-			// Rewind: the XML parser might have exhausted the file.
-			p.reader.Seek(0, 0)
-			// We don't use parser here because we want the textPlistParser type
-			tp := newTextPlistParser(p.reader)
-			pval, err = tp.parseDocument()
-			if err != nil {
-				return err
-			}
-			p.Format = tp.format
-			if p.Format == OpenStepFormat {
-				// OpenStep property lists can only store strings,
-				// so we have to turn on lax mode here for the unmarshal step later.
-				p.lax = true
-			}
+		pval, err = xp.parseDocument()
+	}
+	if _, ok := err.(invalidPlistError); ok {
+		// Not XML. Single-pass decoding only finds that out before it stores anything,
+		// so into is as it was.
+		if p.textParser == nil {
+			p.textParser = &textPlistParser{}
+		}
+		tp := p.textParser
+		tp.reset(doc)
+		if singlePass {
+			err = tp.decodeDocument(p, into)
 		} else {
-			if err != nil {
-				return err
-			}
-			p.Format = XMLFormat
+			pval, err = tp.parseDocument()
 		}
+		if err != nil {
+			return nil, err
+		}
+		p.Format = tp.format
+		if p.Format == OpenStepFormat {
+			// OpenStep property lists can only store strings,
+			// so we have to turn on lax mode here for the unmarshal step later.
+			p.lax = true
+		}
+	} else {
+		if err != nil {
+			return nil, err
+		}
+		p.Format = XMLFormat
 	}
+	return pval, nil
+}
 
-	p.unmarshal(pval, reflect.ValueOf(v))
-	return
+// readDocument reads the entire document from the start of the stream.
+// Values parsed from a document may refer to its bytes, so each document is read
+// into a new buffer; when the stream's size is known, that is its only allocation.
+func (p *Decoder) readDocument() ([]byte, error) {
+	if size, err := p.reader.Seek(0, 2); err == nil {
+		if _, err := p.reader.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		doc := make([]byte, size)
+		n, err := io.ReadFull(p.reader, doc)
+		if err == nil {
+			return doc, nil
+		} else if err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		// The stream was shorter than it claimed; take what there is.
+		return doc[:n], nil
+	}
+
+	if _, err := p.reader.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(p.reader)
+}
+
+// Reset discards the Decoder's input stream and directs it to read from r instead.
+// Hooks and the sharing setting are kept, as are the buffers used to decode previous
+// documents, so a Decoder that is reused for many documents allocates far less than
+// a new Decoder for each. Values decoded earlier remain valid.
+func (p *Decoder) Reset(r io.ReadSeeker) {
+	p.Format = InvalidFormat
+	p.reader = r
+	p.lax = false
+	p.keypath = p.keypath[:0]
+	p.shared = nil
+	p.hookValues = nil
+	if p.bplistParser != nil {
+		p.bplistParser.reset(nil)
+	}
+	if p.xmlParser != nil {
+		p.xmlParser.reset(nil)
+	}
+	if p.textParser != nil {
+		p.textParser.reset(nil)
+	}
+}
+
+// ShareObjects controls how containers referenced more than once in a property list are decoded.
+//
+// Binary property lists can refer to a single array or dictionary from several places.
+// By default, each reference is decoded into an independent copy.
+// When sharing is enabled, every reference to the same container that is decoded into
+// a pointer, map or slice of the same type receives the same Go value, as does every
+// reference decoded into an interface{}. Encoding the result with Encoder.ShareObjects
+// preserves the shape of the original object graph.
+//
+// Other property list formats have no way to express references, so they are unaffected.
+func (p *Decoder) ShareObjects(share bool) {
+	p.shareObjects = share
+}
+
+// AddDecodeHook appends hook to the chain of hooks run on every value the Decoder stores.
+// Hooks run in the order they were added, after pointers have been allocated and before
+// Unmarshaler and encoding.TextUnmarshaler are consulted. Values decoded into an interface{}
+// are passed to the hooks once, as a whole.
+func (p *Decoder) AddDecodeHook(hook DecodeHookFunc) {
+	p.hooks = append(p.hooks, hook)
 }
 
 // NewDecoder returns a Decoder that reads property list elements from a stream reader, r.
@@ -97,6 +237,21 @@ func NewDecoder(r io.ReadSeeker) *Decoder {
 //     []byte, for plist data
 //     []interface{}, for plist arrays
 //     map[string]interface{}, for plist dictionaries
+//     plist.Set, for sets and ordered sets in binary property lists
+//     plist.UUID and *url.URL, for UUIDs and URLs in binary property lists
+//
+// Binary property list null values are treated as missing, and leave the value they would be decoded into unchanged.
+// Sets decode into slices and arrays as arrays do. UUIDs and URLs decode into their own types, and also into strings
+// and values implementing encoding.TextUnmarshaler.
+//
+// Unmarshal calls UnmarshalPlistNode on values implementing NodeUnmarshaler, and UnmarshalPlist on values
+// implementing Unmarshaler. Otherwise, property list data is passed to
+// UnmarshalBinary for values implementing encoding.BinaryUnmarshaler, and property list strings are passed to
+// UnmarshalText for values implementing encoding.TextUnmarshaler. A type implementing both accepts either.
+//
+// Property list data can also be decoded into an io.Reader. When Unmarshal can, it returns a reader that
+// decodes the data's base64 or hex text as it is read, instead of decoding the data up front; such a reader
+// refers to the document, and reports any error in the data when it reaches it.
 //
 // If a property list value is not appropriate for a given value type, Unmarshal aborts immediately and returns an error.
 //
@@ -111,9 +266,19 @@ func NewDecoder(r io.ReadSeeker) *Decoder {
 //
 // Unmarshal returns the detected property list format and an error, if any.
 func Unmarshal(data []byte, v interface{}) (format int, err error) {
-	r := bytes.NewReader(data)
-	dec := NewDecoder(r)
+	dec := decoderPool.Get().(*Decoder)
+	defer decoderPool.Put(dec)
+
+	dec.reader.(*bytes.Reader).Reset(data)
 	err = dec.Decode(v)
 	format = dec.Format
+
+	dec.reader.(*bytes.Reader).Reset(nil)
+	dec.Reset(dec.reader)
 	return
 }
+
+// decoderPool holds Decoders for Unmarshal, each reading from its own bytes.Reader.
+var decoderPool = sync.Pool{
+	New: func() interface{} { return NewDecoder(bytes.NewReader(nil)) },
+}
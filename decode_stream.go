@@ -0,0 +1,264 @@
+package plist
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// Single-pass decoding
+//
+// The XML and text parsers can fill in structs, maps, slices and arrays as they
+// read a document, instead of building a complete cfValue tree for Decoder.unmarshal
+// to walk afterwards. Dictionary entries that have nowhere to go are skipped without
+// being parsed into values at all.
+//
+// Anything that needs the complete value before it can be decoded (interfaces, custom
+// unmarshalers, scalars) is parsed into a cfValue subtree and handed to Decoder.unmarshal,
+// so both paths share one set of conversion rules.
+
+// streamDecodeError marks an error raised while storing a value during single-pass decoding,
+// so that the parser does not mistake it for a syntax error and wrap it.
+type streamDecodeError struct {
+	err error
+}
+
+func (e streamDecodeError) Error() string {
+	return e.err.Error()
+}
+
+// unmarshalStreamed decodes a parsed subtree into val during single-pass decoding.
+func (p *Decoder) unmarshalStreamed(pval cfValue, val reflect.Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			panic(streamDecodeError{r.(error)})
+		}
+	}()
+	p.unmarshal(pval, val)
+}
+
+// unwrapStreamError converts a value recovered during single-pass decoding into the error
+// the equivalent two-pass decode would have returned.
+func unwrapStreamError(r interface{}, format string) error {
+	switch err := r.(type) {
+	case streamDecodeError:
+		return err.err
+	case invalidPlistError:
+		return err
+	}
+	return plistParseError{format, r.(error)}
+}
+
+var streamableTypes sync.Map // map[reflect.Type]PlistKind
+
+// streamableKind returns the kind of property list container that can be decoded into
+// typ in a single pass, or InvalidKind if values of typ must be decoded from a parsed subtree.
+func streamableKind(typ reflect.Type) PlistKind {
+	if kind, ok := streamableTypes.Load(typ); ok {
+		return kind.(PlistKind)
+	}
+
+	kind := InvalidKind
+	switch typ.Kind() {
+	case reflect.Struct:
+		if typ != timeType {
+			kind = DictionaryKind
+		}
+	case reflect.Map:
+		if typ.Key().Kind() == reflect.String {
+			kind = DictionaryKind
+		}
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() != reflect.Uint8 {
+			kind = ArrayKind
+		}
+	}
+
+	ptr := reflect.PtrTo(typ)
+	for _, iface := range []reflect.Type{nodeUnmarshalerType, plistUnmarshalerType, textUnmarshalerType, binUnmarshalerType} {
+		if typ.Implements(iface) || ptr.Implements(iface) {
+			kind = InvalidKind
+		}
+	}
+
+	streamableTypes.Store(typ, kind)
+	return kind
+}
+
+// streamTarget prepares val to receive a container of the given kind in a single pass,
+// allocating it if it is a nil pointer. It returns false if val must instead be decoded
+// from a parsed subtree.
+func (p *Decoder) streamTarget(val reflect.Value, kind PlistKind) (reflect.Value, bool) {
+	if !val.IsValid() {
+		return val, false
+	}
+
+	// The pointer passed to Decode can't be set, but what it points to can.
+	if val.Kind() == reflect.Ptr {
+		if streamableKind(val.Type().Elem()) != kind {
+			return val, false
+		}
+		if val.IsNil() {
+			if !val.CanSet() {
+				return val, false
+			}
+			val.Set(reflect.New(val.Type().Elem()))
+		}
+		return val.Elem(), true
+	}
+	return val, val.CanSet() && streamableKind(val.Type()) == kind
+}
+
+// readerTarget prepares val to receive a data value as an io.Reader over the document
+// text, allocating it if it is a nil pointer. It returns false if val is not an io.Reader.
+func (p *Decoder) readerTarget(val reflect.Value) (reflect.Value, bool) {
+	if !val.IsValid() {
+		return val, false
+	}
+
+	if val.Kind() == reflect.Ptr && val.Type().Elem() == readerType {
+		if val.IsNil() {
+			if !val.CanSet() {
+				return val, false
+			}
+			val.Set(reflect.New(readerType))
+		}
+		val = val.Elem()
+	}
+	return val, val.CanSet() && val.Type() == readerType
+}
+
+// streamDictionary stores dictionary entries into a struct or map as they are parsed.
+type streamDictionary struct {
+	dec   *Decoder
+	val   reflect.Value
+	tinfo *typeInfo
+	seen  []bool
+
+	// the entry currently being decoded
+	pushed    bool
+	key, elem reflect.Value
+}
+
+func newStreamDictionary(dec *Decoder, val reflect.Value) *streamDictionary {
+	d := &streamDictionary{dec: dec, val: val}
+	switch val.Kind() {
+	case reflect.Struct:
+		tinfo, err := getTypeInfo(val.Type())
+		if err != nil {
+			panic(streamDecodeError{err})
+		}
+		d.tinfo = tinfo
+		d.seen = make([]bool, len(tinfo.fields))
+	case reflect.Map:
+		if val.IsNil() {
+			val.Set(reflect.MakeMap(val.Type()))
+		}
+	}
+	return d
+}
+
+// entry returns the value that the entry for key should be decoded into, or false if
+// the entry is not wanted and should be skipped.
+func (d *streamDictionary) entry(key string) (reflect.Value, bool) {
+	if d.tinfo == nil {
+		typ := d.val.Type()
+		d.key = reflect.ValueOf(key).Convert(typ.Key())
+		d.elem = reflect.New(typ.Elem()).Elem()
+		d.dec.keypath.pushKey(key)
+		d.pushed = true
+		return d.elem, true
+	}
+
+	for i := range d.tinfo.fields {
+		finfo := &d.tinfo.fields[i]
+		if finfo.name != key {
+			continue
+		}
+		field := finfo.value(d.val)
+		if d.seen[i] {
+			// When a key appears more than once, only the last value counts.
+			field.Set(reflect.Zero(field.Type()))
+		}
+		d.seen[i] = true
+		d.dec.keypath.pushKey(key)
+		d.pushed = true
+		return field, true
+	}
+	return reflect.Value{}, false
+}
+
+// store completes the entry most recently returned by entry.
+func (d *streamDictionary) store() {
+	if d.pushed {
+		d.dec.keypath.pop()
+		d.pushed = false
+	}
+	if d.elem.IsValid() {
+		d.val.SetMapIndex(d.key, d.elem)
+		d.key, d.elem = reflect.Value{}, reflect.Value{}
+	}
+}
+
+// finish is called at the end of the dictionary.
+func (d *streamDictionary) finish() {
+	if d.tinfo == nil {
+		return
+	}
+	// Decoding a parsed dictionary visits every field, allocating embedded struct
+	// pointers along the way. Do the same for the fields that weren't present.
+	for i := range d.tinfo.fields {
+		if !d.seen[i] {
+			d.tinfo.fields[i].value(d.val)
+		}
+	}
+}
+
+// streamArray stores array elements into a slice or array as they are parsed.
+type streamArray struct {
+	dec *Decoder
+	val reflect.Value
+	n   int // elements seen so far
+}
+
+func newStreamArray(dec *Decoder, val reflect.Value) *streamArray {
+	if val.Kind() == reflect.Slice && val.IsNil() {
+		// Decoding a parsed array always leaves a slice, even an empty one.
+		val.Set(reflect.MakeSlice(val.Type(), 0, 0))
+	}
+	return &streamArray{dec: dec, val: val}
+}
+
+// next returns the value that the next element should be decoded into, or false if
+// the element doesn't fit and should be skipped. Every element that is decoded must
+// be followed by a call to store.
+func (a *streamArray) next() (reflect.Value, bool) {
+	a.n++
+	if a.val.Kind() == reflect.Slice {
+		a.val.Set(reflect.Append(a.val, reflect.Zero(a.val.Type().Elem())))
+		a.dec.keypath.pushIndex(a.n - 1)
+		return a.val.Index(a.val.Len() - 1), true
+	}
+
+	if a.n > a.val.Len() {
+		return reflect.Value{}, false
+	}
+	a.dec.keypath.pushIndex(a.n - 1)
+	return a.val.Index(a.n - 1), true
+}
+
+// store completes the element most recently returned by next.
+func (a *streamArray) store() {
+	a.dec.keypath.pop()
+}
+
+// finish is called at the end of the array.
+func (a *streamArray) finish() {
+	if a.val.Kind() == reflect.Array && a.n > a.val.Len() {
+		panic(streamDecodeError{fmt.Errorf("plist: attempted to unmarshal %d values into an array of size %d", a.n, a.val.Len())})
+	}
+}
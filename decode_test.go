@@ -3,18 +3,48 @@ package plist
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func BenchmarkXMLDecode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var bval EverythingTestData
+		buf := bytes.NewReader([]byte(plistValueTreeAsXML))
+		b.StartTimer()
+		decoder := NewDecoder(buf)
+		decoder.Decode(&bval)
+		b.StopTimer()
+	}
+}
+
+func BenchmarkXMLDecodeInterface(b *testing.B) {
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
 		var bval interface{}
 		buf := bytes.NewReader([]byte(plistValueTreeAsXML))
 		b.StartTimer()
 		decoder := NewDecoder(buf)
-		decoder.Decode(bval)
+		decoder.Decode(&bval)
+		b.StopTimer()
+	}
+}
+
+func BenchmarkOpenStepDecode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var bval EverythingTestData
+		buf := bytes.NewReader([]byte(plistValueTreeAsOpenStep))
+		b.StartTimer()
+		decoder := NewDecoder(buf)
+		decoder.Decode(&bval)
 		b.StopTimer()
 	}
 }
@@ -31,6 +61,98 @@ func BenchmarkBplistDecode(b *testing.B) {
 	}
 }
 
+func benchmarkSmallDecode(b *testing.B, format int, reset bool) {
+	doc, err := Marshal(smallInfoPlistValue, format)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	r := bytes.NewReader(doc)
+	dec := NewDecoder(r)
+	for i := 0; i < b.N; i++ {
+		r.Reset(doc)
+		if reset {
+			dec.Reset(r)
+		} else {
+			dec = NewDecoder(r)
+		}
+		var v smallInfoPlist
+		if err := dec.Decode(&v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSmallXMLDecode(b *testing.B)         { benchmarkSmallDecode(b, XMLFormat, false) }
+func BenchmarkSmallXMLDecodeReset(b *testing.B)    { benchmarkSmallDecode(b, XMLFormat, true) }
+func BenchmarkSmallBplistDecode(b *testing.B)      { benchmarkSmallDecode(b, BinaryFormat, false) }
+func BenchmarkSmallBplistDecodeReset(b *testing.B) { benchmarkSmallDecode(b, BinaryFormat, true) }
+
+func BenchmarkSmallUnmarshal(b *testing.B) {
+	doc, err := Marshal(smallInfoPlistValue, BinaryFormat)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var v smallInfoPlist
+		if _, err := Unmarshal(doc, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+	type decoded struct {
+		name   string
+		format int
+		value  interface{}
+		fresh  interface{}
+	}
+
+	var results []decoded
+	dec := NewDecoder(bytes.NewReader(nil))
+	for _, test := range tests {
+		for format, doc := range test.Documents {
+			if test.SkipDecode[format] {
+				continue
+			}
+
+			var fresh interface{}
+			freshDec := NewDecoder(bytes.NewReader(doc))
+			if err := freshDec.Decode(&fresh); err != nil {
+				continue
+			}
+
+			// The reused decoder gets its own copy of the document, which is then overwritten:
+			// nothing it decoded may refer to it.
+			input := append([]byte(nil), doc...)
+			var value interface{}
+			dec.Reset(bytes.NewReader(input))
+			if err := dec.Decode(&value); err != nil {
+				t.Errorf("%s/%s: %v", test.Name, FormatNames[format], err)
+				continue
+			}
+			for i := range input {
+				input[i] = 'x'
+			}
+			if dec.Format != freshDec.Format {
+				t.Errorf("%s/%s: reused decoder detected format %s", test.Name, FormatNames[format], FormatNames[dec.Format])
+			}
+			results = append(results, decoded{test.Name, format, value, fresh})
+		}
+	}
+
+	// Values decoded earlier must survive every decode after them.
+	for _, r := range results {
+		if !reflect.DeepEqual(r.value, r.fresh) {
+			t.Errorf("%s/%s: reused decoder produced\n%#v\nexpected\n%#v", r.name, FormatNames[r.format], r.value, r.fresh)
+		}
+	}
+}
+
 func TestLaxDecode(t *testing.T) {
 	var laxTestDataStringsOnlyAsXML = `{B=1;D="2013-11-27 00:34:00 +0000";I64=1;F64="3.0";U64=2;}`
 	d := LaxTestData{}
@@ -237,3 +359,446 @@ func ExampleDecoder_Decode() {
 
 	// Output: {6.0 8388608 1 com.apple.diskimage.sparsebundle 4398046511104}
 }
+
+func TestDecodeSharedObjects(t *testing.T) {
+	type node struct {
+		Name     string
+		Children []*node         `plist:",omitempty"`
+		Tags     map[string]bool `plist:",omitempty"`
+	}
+
+	shared := &node{Name: "shared", Tags: map[string]bool{"x": true}}
+	root := &node{Name: "root", Children: []*node{shared, shared}}
+
+	buf := &bytes.Buffer{}
+	enc := NewBinaryEncoder(buf)
+	enc.ShareObjects(true)
+	if err := enc.Encode(root); err != nil {
+		t.Fatal(err)
+	}
+	doc := buf.Bytes()
+
+	var unshared node
+	if _, err := Unmarshal(doc, &unshared); err != nil {
+		t.Fatal(err)
+	}
+	if unshared.Children[0] == unshared.Children[1] {
+		t.Error("expected independent copies without ShareObjects")
+	}
+
+	var decoded node
+	dec := NewDecoder(bytes.NewReader(doc))
+	dec.ShareObjects(true)
+	if err := dec.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Children[0] != decoded.Children[1] {
+		t.Error("expected shared containers to decode into the same pointer")
+	}
+
+	var generic interface{}
+	dec = NewDecoder(bytes.NewReader(doc))
+	dec.ShareObjects(true)
+	if err := dec.Decode(&generic); err != nil {
+		t.Fatal(err)
+	}
+	children := generic.(map[string]interface{})["Children"].([]interface{})
+	if reflect.ValueOf(children[0]).Pointer() != reflect.ValueOf(children[1]).Pointer() {
+		t.Error("expected shared containers to decode into the same map")
+	}
+
+	// Re-encoding the shared graph must produce the same document.
+	buf.Reset()
+	enc = NewBinaryEncoder(buf)
+	enc.ShareObjects(true)
+	if err := enc.Encode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(doc, buf.Bytes()) {
+		t.Errorf("round trip changed the document:\n%x\n%x", doc, buf.Bytes())
+	}
+}
+
+type hookTestID uint32
+
+func TestDecodeHooks(t *testing.T) {
+	type config struct {
+		Timeout  time.Duration
+		Retries  []time.Duration
+		Owner    hookTestID
+		Name     string
+		Settings map[string]interface{}
+	}
+
+	doc := `<plist><dict>
+		<key>Timeout</key><string>1m30s</string>
+		<key>Retries</key><array><string>1s</string><string>2s</string></array>
+		<key>Owner</key><integer>42</integer>
+		<key>Name</key><string>example</string>
+		<key>Settings</key><dict><key>a</key><string>b</string></dict>
+	</dict></plist>`
+
+	durationType := reflect.TypeOf(time.Duration(0))
+	idType := reflect.TypeOf(hookTestID(0))
+
+	var keypaths []string
+	dec := NewDecoder(bytes.NewReader([]byte(doc)))
+	dec.AddDecodeHook(func(keypath string, from PlistKind, to reflect.Type, value interface{}) (interface{}, error) {
+		keypaths = append(keypaths, keypath+" "+from.String())
+		if from == StringKind && to == durationType {
+			return time.ParseDuration(value.(string))
+		}
+		return value, nil
+	})
+	dec.AddDecodeHook(func(keypath string, from PlistKind, to reflect.Type, value interface{}) (interface{}, error) {
+		if from == IntegerKind && to == idType {
+			// Not assignable; this is decoded as if the document contained it.
+			return value.(uint64) + 1000, nil
+		}
+		return value, nil
+	})
+
+	var c config
+	if err := dec.Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := config{
+		Timeout:  90 * time.Second,
+		Retries:  []time.Duration{time.Second, 2 * time.Second},
+		Owner:    1042,
+		Name:     "example",
+		Settings: map[string]interface{}{"a": "b"},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected: %#v\nReceived: %#v", expected, c)
+	}
+
+	expectedKeypaths := []string{
+		"/ dictionary",
+		"/Timeout string",
+		"/Retries array",
+		"/Retries[0] string",
+		"/Retries[1] string",
+		"/Owner integer",
+		"/Name string",
+		"/Settings dictionary",
+		"/Settings/a string",
+	}
+	if !reflect.DeepEqual(keypaths, expectedKeypaths) {
+		t.Errorf("Expected hooks to see: %q\nReceived: %q", expectedKeypaths, keypaths)
+	}
+}
+
+type hookTestNested struct {
+	Next *hookTestNested `plist:",omitempty"`
+}
+
+func TestDecodeHooksDeepDocument(t *testing.T) {
+	nested := func(depth int) []byte {
+		var v *hookTestNested
+		for i := 0; i < depth; i++ {
+			v = &hookTestNested{Next: v}
+		}
+		doc, err := Marshal(v, XMLFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+
+	allocs := func(doc []byte) float64 {
+		return testing.AllocsPerRun(5, func() {
+			dec := NewDecoder(bytes.NewReader(doc))
+			dec.AddDecodeHook(func(_ string, _ PlistKind, _ reflect.Type, value interface{}) (interface{}, error) {
+				return value, nil
+			})
+			var v hookTestNested
+			if err := dec.Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// Each value is converted for the hooks once, not again for every dictionary above it.
+	shallow, deep := allocs(nested(100)), allocs(nested(400))
+	if deep > 6*shallow {
+		t.Errorf("Expected decoding with hooks to grow linearly with depth: %v allocations at depth 100, %v at depth 400", shallow, deep)
+	}
+}
+
+func TestDecodeHookError(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader([]byte(`<plist><array><string>a</string><string>b</string></array></plist>`)))
+	dec.AddDecodeHook(func(keypath string, from PlistKind, to reflect.Type, value interface{}) (interface{}, error) {
+		if keypath == "[1]" {
+			return nil, fmt.Errorf("rejected %v at %s", value, keypath)
+		}
+		return value, nil
+	})
+
+	var s []string
+	err := dec.Decode(&s)
+	if err == nil || err.Error() != "rejected b at [1]" {
+		t.Errorf("expected hook error, got %v", err)
+	}
+}
+
+func ExampleDecoder_AddDecodeHook() {
+	type job struct {
+		Interval time.Duration `plist:"interval"`
+	}
+
+	buf := bytes.NewReader([]byte(`{interval = "5m";}`))
+
+	durationType := reflect.TypeOf(time.Duration(0))
+	decoder := NewDecoder(buf)
+	decoder.AddDecodeHook(func(keypath string, from PlistKind, to reflect.Type, value interface{}) (interface{}, error) {
+		if from == StringKind && to == durationType {
+			return time.ParseDuration(value.(string))
+		}
+		return value, nil
+	})
+
+	var j job
+	if err := decoder.Decode(&j); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(j.Interval)
+
+	// Output: 5m0s
+}
+
+func wantSelfEqual(v interface{}) bool {
+	e := reflect.ValueOf(v).Elem().Interface()
+	return reflect.DeepEqual(e, e)
+}
+
+// decodeTwoPass decodes doc into v the way Decode did before single-pass decoding:
+// a pass-through hook forces the complete document to be parsed first.
+func decodeTwoPass(doc []byte, v interface{}) error {
+	decoder := NewDecoder(bytes.NewReader(doc))
+	decoder.AddDecodeHook(func(_ string, _ PlistKind, _ reflect.Type, value interface{}) (interface{}, error) {
+		return value, nil
+	})
+	return decoder.Decode(v)
+}
+
+func TestSinglePassDecode(t *testing.T) {
+	type doc struct {
+		name  string
+		data  []byte
+		value interface{}
+	}
+	var docs []doc
+	for _, test := range tests {
+		val := test.DecodeValue
+		if val == nil {
+			val = test.Value
+		}
+		if val == nil {
+			continue
+		}
+		typ := reflect.TypeOf(val)
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		for _, format := range []int{XMLFormat, OpenStepFormat, GNUStepFormat} {
+			if data, ok := test.Documents[format]; ok {
+				docs = append(docs, doc{test.Name + "/" + FormatNames[format], data, reflect.New(typ).Interface()})
+			}
+		}
+	}
+
+	type Inner struct {
+		N int `plist:"n"`
+	}
+	type Outer struct {
+		Name   string           `plist:"name"`
+		Inner  *Inner           `plist:"inner"`
+		Values []Inner          `plist:"values"`
+		Fixed  [2]int           `plist:"fixed"`
+		Extra  map[string]Inner `plist:"extra"`
+	}
+	for _, s := range []string{
+		`<plist><dict><key>skipped</key><array><dict><key>n</key><integer>1</integer></dict></array><key>name</key><string>x</string></dict></plist>`,
+		`<plist><dict><key>inner</key><dict><key>n</key><integer>1</integer></dict><key>values</key><array><dict><key>n</key><integer>2</integer></dict></array></dict></plist>`,
+		`<plist><dict><key>values</key><array><dict><key>n</key><integer>1</integer></dict></array><key>values</key><array/></dict></plist>`,
+		`<plist><dict><key>extra</key><dict><key>a</key><dict><key>n</key><integer>3</integer></dict></dict></dict></plist>`,
+		`<plist><dict><key>inner</key><dict><key>n</key><string>not a number</string></dict></dict></plist>`,
+		`<plist><dict><key>fixed</key><array><integer>1</integer><integer>2</integer><integer>3</integer></array></dict></plist>`,
+		`<plist><dict><key>inner</key><dict><key>n</key><integer>1</integer></dict>`,
+		`<plist><dict><key>name</key></dict></plist>`,
+		`{skipped = {a = (1, <*I2>, "x;y"); b = c;}; /* comment */ name = x; inner = {n = 4;};}`,
+		`{values = ({n = 1;}, "", {n = 2;},); extra = {a = {n = 5;};};}`,
+		`{name = "x"; inner = {n = 1;}} garbage`,
+		`{inner = {n = z;};}`,
+		`{fixed = (1, 2, 3);}`,
+		`{inner; name;}`,
+		`{inner = {n = 2;}; extra = {a = {n = <*I5>;};};}`,
+		`{inner = {n = 2;}; name = "<*I5>";}`,
+	} {
+		docs = append(docs, doc{s, []byte(s), &Outer{}})
+	}
+
+	for _, d := range docs {
+		subtest(t, d.name, func(t *testing.T) {
+			want := reflect.New(reflect.TypeOf(d.value).Elem()).Interface()
+			wantErr := decodeTwoPass(d.data, want)
+
+			got := reflect.New(reflect.TypeOf(d.value).Elem()).Interface()
+			_, gotErr := Unmarshal(d.data, got)
+
+			if (wantErr == nil) != (gotErr == nil) || (wantErr != nil && wantErr.Error() != gotErr.Error()) {
+				t.Errorf("Expected error %v, received %v", wantErr, gotErr)
+			}
+			if wantErr == nil && wantSelfEqual(want) && !reflect.DeepEqual(want, got) {
+				// (NaN is never equal to itself, so those values can't be compared.)
+				t.Logf("Expected: %#v", want)
+				t.Logf("Received: %#v", got)
+				t.Fail()
+			}
+		})
+	}
+}
+
+// parsedNameDocument is decoded from a parsed document, like any NodeUnmarshaler.
+type parsedNameDocument struct {
+	Name string
+}
+
+func (d *parsedNameDocument) UnmarshalPlistNode(node *Node) error {
+	if name, ok := node.Lookup("name"); ok {
+		return name.Decode(&d.Name)
+	}
+	return nil
+}
+
+func TestSinglePassDecodeSkipsUnwantedValues(t *testing.T) {
+	type Doc struct {
+		Name string `plist:"name"`
+	}
+	values := make([]int, 1000)
+	for i := range values {
+		values[i] = i
+	}
+	for _, format := range []int{XMLFormat, OpenStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			data, err := Marshal(map[string]interface{}{"name": "x", "skipped": values}, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var v Doc
+			singlePass := testing.AllocsPerRun(10, func() {
+				if _, err := Unmarshal(data, &v); err != nil {
+					t.Fatal(err)
+				}
+			})
+			var parsed parsedNameDocument
+			twoPass := testing.AllocsPerRun(10, func() {
+				if _, err := Unmarshal(data, &parsed); err != nil {
+					t.Fatal(err)
+				}
+			})
+			// Parsing the skipped array into values takes at least one allocation per element.
+			if twoPass-singlePass < float64(len(values)) {
+				t.Errorf("Expected single-pass decoding to skip the unwanted array: %v allocations, against %v for two passes", singlePass, twoPass)
+			}
+			if v.Name != "x" || parsed.Name != "x" {
+				t.Errorf("Expected name x, received %q and %q", v.Name, parsed.Name)
+			}
+		})
+	}
+}
+
+type dataReaderTarget struct {
+	Data    io.Reader
+	Pointer *io.Reader
+	Bytes   []byte
+}
+
+func TestDecodeDataReader(t *testing.T) {
+	data := dataReaderTestBytes
+	for _, format := range []int{XMLFormat, BinaryFormat, OpenStepFormat, GNUStepFormat} {
+		for _, indent := range []string{"", "\t"} {
+			doc, err := MarshalIndent(map[string][]byte{"Data": data, "Pointer": data[:5], "Bytes": {}}, format, indent)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, decode := range map[string]func([]byte, interface{}) error{
+				"single-pass": func(doc []byte, v interface{}) error { _, err := Unmarshal(doc, v); return err },
+				"two-pass":    decodeTwoPass,
+			} {
+				subtest(t, fmt.Sprintf("%s/%q/%s", FormatNames[format], indent, name), func(t *testing.T) {
+					var v dataReaderTarget
+					if err := decode(doc, &v); err != nil {
+						t.Fatal(err)
+					}
+					if v.Pointer == nil {
+						t.Fatal("expected Pointer to be allocated")
+					}
+					for _, r := range []struct {
+						name     string
+						reader   io.Reader
+						expected []byte
+					}{{"Data", v.Data, data}, {"Pointer", *v.Pointer, data[:5]}} {
+						got, err := ioutil.ReadAll(r.reader)
+						if err != nil {
+							t.Fatalf("%s: %v", r.name, err)
+						}
+						if !bytes.Equal(got, r.expected) {
+							t.Errorf("%s: expected %d bytes, got %d: %q", r.name, len(r.expected), len(got), got)
+						}
+					}
+					if v.Bytes == nil || len(v.Bytes) != 0 {
+						t.Errorf("expected empty Bytes, got %#v", v.Bytes)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestDecodeDataReaderText(t *testing.T) {
+	for name, test := range map[string]struct {
+		doc      string
+		expected string
+		err      bool // reading the data fails
+	}{
+		"XML whitespace":    {"<plist><dict><key>Data</key><data>\n\tSGVs\r\n bG8=\n</data></dict></plist>", "Hello", false},
+		"XML empty":         {"<plist><dict><key>Data</key><data/></dict></plist>", "", false},
+		"XML invalid":       {"<plist><dict><key>Data</key><data>SGV*</data></dict></plist>", "", true},
+		"OpenStep spaces":   {"{Data = < 48 65\n6C6c 6f>;}", "Hello", false},
+		"OpenStep unicode":  {"{Data = <4865 6c6c6f>;}", "Hello", false},
+		"OpenStep empty":    {"{Data = <>;}", "", false},
+		"GNUStep in a dict": {"{Data = <48656c6c6f>; N = <*I5>;}", "Hello", false},
+	} {
+		subtest(t, name, func(t *testing.T) {
+			var v struct{ Data io.Reader }
+			if _, err := Unmarshal([]byte(test.doc), &v); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(v.Data)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error reading the data, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+
+	for _, doc := range []string{"{Data = <486>;}", "{Data = <48x6>;}", "{Data = <4865", "{Data = <*I5>;}", "<plist><dict><key>Data</key><string>a</string></dict></plist>"} {
+		var v struct{ Data io.Reader }
+		if _, err := Unmarshal([]byte(doc), &v); err == nil {
+			t.Errorf("%q: expected an error", doc)
+		}
+	}
+}
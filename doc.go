@@ -1,5 +1,7 @@
 // Package plist implements encoding and decoding of Apple's "property list" format.
 // Property lists come in three sorts: plain text (GNUStep and OpenStep), XML and binary.
 // plist supports all of them.
+// The bplist15 and bplist16 variants of the binary format, written by newer versions of CoreFoundation, can be decoded but not encoded.
+// bplist17 is not supported, and documents in it fail to decode with an error that says so.
 // The mapping between property list and Go objects is described in the documentation for the Marshal and Unmarshal functions.
 package plist
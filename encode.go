@@ -6,11 +6,13 @@ import (
 	"io"
 	"reflect"
 	"runtime"
+	"sync"
 )
 
 type generator interface {
 	generateDocument(cfValue)
 	Indent(string)
+	reset(io.Writer)
 }
 
 // An Encoder writes a property list to an output stream.
@@ -18,7 +20,18 @@ type Encoder struct {
 	writer io.Writer
 	format int
 
-	indent string
+	indent            string
+	shareObjects      bool
+	extendedTypes     bool
+	compactReferences bool
+	optimizeSize      bool
+
+	keypath    keypath
+	references []referenceKey // values currently being marshaled, innermost last
+	shared     map[referenceKey]sharedObject
+
+	generator       generator // kept between documents so that its buffers can be reused
+	generatorFormat int
 }
 
 // Encode writes the property list encoding of v to the stream.
@@ -32,23 +45,57 @@ func (p *Encoder) Encode(v interface{}) (err error) {
 		}
 	}()
 
+	p.keypath = p.keypath[:0]
+	p.references = p.references[:0]
+	p.shared = nil
+	if p.shareObjects && (p.format == BinaryFormat || p.format == AutomaticFormat) {
+		p.shared = make(map[referenceKey]sharedObject)
+	}
+
 	pval := p.marshal(reflect.ValueOf(v))
 	if pval == nil {
 		panic(errors.New("plist: no root element to encode"))
 	}
+	p.generate(pval)
+	return
+}
 
-	var g generator
-	switch p.format {
-	case XMLFormat:
-		g = newXMLPlistGenerator(p.writer)
-	case BinaryFormat, AutomaticFormat:
-		g = newBplistGenerator(p.writer)
-	case OpenStepFormat, GNUStepFormat:
-		g = newTextPlistGenerator(p.writer, p.format)
+// generate writes the document with root at its top level in the Encoder's format.
+func (p *Encoder) generate(root cfValue) {
+	g := p.generator
+	if g != nil && p.generatorFormat == p.format {
+		g.reset(p.writer)
+	} else {
+		switch p.format {
+		case XMLFormat:
+			g = newXMLPlistGenerator(p.writer)
+		case BinaryFormat, AutomaticFormat:
+			g = newBplistGenerator(p.writer)
+		case OpenStepFormat, GNUStepFormat:
+			g = newTextPlistGenerator(p.writer, p.format)
+		}
+		p.generator, p.generatorFormat = g, p.format
 	}
 	g.Indent(p.indent)
-	g.generateDocument(pval)
-	return
+	if bg, ok := g.(*bplistGenerator); ok {
+		bg.compact = p.compactReferences
+		bg.optimize = p.optimizeSize
+	}
+	g.generateDocument(root)
+}
+
+// Reset discards the Encoder's output stream and directs it to write to w instead.
+// The format, indentation and sharing settings are kept, as are the buffers used to
+// encode previous documents, so an Encoder that is reused for many documents
+// allocates far less than a new Encoder for each.
+func (p *Encoder) Reset(w io.Writer) {
+	p.writer = w
+	p.keypath = p.keypath[:0]
+	p.references = p.references[:0]
+	p.shared = nil
+	if p.generator != nil {
+		p.generator.reset(w)
+	}
 }
 
 // Indent turns on pretty-printing for the XML and Text property list formats.
@@ -57,6 +104,57 @@ func (p *Encoder) Indent(indent string) {
 	p.indent = indent
 }
 
+// ShareObjects controls how values reachable through more than one pointer, map or slice are encoded.
+//
+// By default, every path to such a value produces its own copy in the output,
+// and a value that contains itself causes Encode to return an error.
+// When sharing is enabled and the Encoder is writing a binary property list,
+// each such value is written once and referenced from everywhere it appears.
+// A value that contains itself is still an error: no property list can hold a cycle.
+// Other formats have no way to express references, so they are unaffected.
+func (p *Encoder) ShareObjects(share bool) {
+	p.shareObjects = share
+}
+
+// ExtendedTypes controls whether binary property lists are written with the object types
+// that recent versions of CoreFoundation added to the format: sets, null, URLs and UUIDs.
+//
+// When enabled and the Encoder is writing a binary property list, Set values are written
+// as sets, *url.URL and url.URL values as URLs, and UUID values as UUIDs. Nil values are
+// written as null, instead of being left out of the arrays and dictionaries that contain them.
+// Older readers, including older versions of CoreFoundation, can't read such documents.
+// Other formats have no way to express these types, so they are unaffected.
+func (p *Encoder) ExtendedTypes(enabled bool) {
+	p.extendedTypes = enabled
+}
+
+// extended reports whether the types enabled by ExtendedTypes may be written.
+func (p *Encoder) extended() bool {
+	return p.extendedTypes && (p.format == BinaryFormat || p.format == AutomaticFormat)
+}
+
+// CompactReferences controls the width of the object references and offsets in binary property lists.
+//
+// By default, each is 1, 2, 4 or 8 bytes wide, whichever is the narrowest that fits.
+// When enabled, they can be any width from 1 to 8 bytes, which saves space in documents
+// with more than 65535 objects or bytes. CoreFoundation reads either, but some other
+// readers only accept the default widths.
+func (p *Encoder) CompactReferences(compact bool) {
+	p.compactReferences = compact
+}
+
+// OptimizeSize makes binary property lists as small as this package can write them.
+//
+// Strings, numbers, dates and data that appear more than once are always written once.
+// When size optimization is enabled, so are arrays, dictionaries and sets that have the same
+// contents, wherever they came from, and object references and offsets are written compactly,
+// as CompactReferences does. This takes more time and memory. The document decodes to the
+// same values as before, but a Decoder with ShareObjects enabled will share the merged containers.
+// Other formats are unaffected.
+func (p *Encoder) OptimizeSize(enabled bool) {
+	p.optimizeSize = enabled
+}
+
 // NewEncoder returns an Encoder that writes an XML property list to w.
 func NewEncoder(w io.Writer) *Encoder {
 	return NewEncoderForFormat(w, XMLFormat)
@@ -107,6 +205,21 @@ func NewBinaryEncoder(w io.Writer) *Encoder {
 // Anonymous struct fields are encoded as if their exported fields were exposed via the outer struct.
 //
 // Pointer values encode as the value pointed to.
+// Marshal returns an error if a pointer, map or slice refers back to a value that contains it;
+// see Encoder.ShareObjects for a way to encode such values in binary property lists.
+//
+// Values implementing Marshaler are encoded as the value returned by MarshalPlist.
+// Otherwise, values implementing encoding.TextMarshaler are encoded as strings, and values implementing
+// encoding.BinaryMarshaler are encoded as data. A type implementing both TextMarshaler and BinaryMarshaler
+// is encoded as a string. time.Time is always encoded as a date.
+//
+// Set values are encoded as arrays, and UUID values as strings; see Encoder.ExtendedTypes for a way to
+// encode them, along with URLs and nil values, as such in binary property lists.
+//
+// Values implementing io.Reader, such as *os.File or an io.Reader interface value, are encoded as data.
+// The reader is read to its end as the document is written: the data is base64- or hex-encoded on the
+// fly for XML and text property lists. Binary property lists begin each data value with its length, which
+// is taken from a Len method or by seeking; a reader that offers neither is read into memory first.
 //
 // Channel, complex and function values cannot be encoded. Any attempt to do so causes Marshal to return an error.
 func Marshal(v interface{}, format int) ([]byte, error) {
@@ -117,10 +230,24 @@ func Marshal(v interface{}, format int) ([]byte, error) {
 // begins on a new line and is preceded by one or more copies of indent according to its nesting depth.
 func MarshalIndent(v interface{}, format int, indent string) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	enc := NewEncoderForFormat(buf, format)
-	enc.Indent(indent)
-	if err := enc.Encode(v); err != nil {
+	enc := encoderPool.Get().(*Encoder)
+	defer encoderPool.Put(enc)
+
+	enc.Reset(buf)
+	enc.format = format
+	enc.indent = indent
+	enc.shareObjects = false
+	enc.extendedTypes = false
+	enc.compactReferences = false
+	enc.optimizeSize = false
+	err := enc.Encode(v)
+	enc.Reset(nil)
+	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
+
+var encoderPool = sync.Pool{
+	New: func() interface{} { return &Encoder{} },
+}
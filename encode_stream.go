@@ -0,0 +1,257 @@
+package plist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+)
+
+// A streamGenerator writes a document one piece at a time, for a StreamEncoder.
+// parent is the kind of the container a value is being written into, or InvalidKind
+// for the top-level value.
+type streamGenerator interface {
+	startDocument()
+	startDictionary(parent PlistKind)
+	writeKey(key string)
+	endDictionary(parent PlistKind)
+	startArray(parent PlistKind)
+	endArray(parent PlistKind)
+	writeValue(parent PlistKind, pval cfValue)
+	endDocument()
+}
+
+// A StreamEncoder writes a property list to an output stream incrementally, one
+// dictionary key, array or value at a time, without holding the document in memory.
+//
+// Call StartDict or StartArray to open a container and End to close it. Inside a
+// dictionary, each value (or container) must be preceded by a call to Key. Value writes
+// any Go value that Marshal accepts, in one piece. The document is complete, and
+// flushed to the output stream, once its top-level value has been written.
+//
+// Dictionary keys are written in the order they are given, and are not checked for
+// duplicates. Dictionaries passed to Value are sorted, as Encoder sorts them.
+//
+// Binary property lists are written as the document goes, each container after its
+// contents. Only the references to the contents of the currently open containers, and
+// a compact list of object offsets for the offset table, are kept in memory.
+// Every object reference takes four bytes, and only dictionary keys are written once
+// and shared; the result is somewhat larger than what Encoder would produce.
+//
+// After a write to the output stream fails, every method returns that error.
+type StreamEncoder struct {
+	writer io.Writer
+	format int
+	indent string
+
+	generator streamGenerator
+	flush     func() error // flushes the text generator's buffer
+	encoder   Encoder      // marshals the values passed to Value
+
+	stack []streamFrame // open containers, innermost last
+	done  bool
+	err   error
+}
+
+type streamFrame struct {
+	kind    PlistKind
+	haveKey bool // for dictionaries, whether a key is waiting for its value
+}
+
+var errStreamComplete = errors.New("plist: the document is already complete")
+
+// NewStreamEncoder returns a StreamEncoder that writes a property list to w in the specified format.
+// Pass AutomaticFormat to allow the library to choose the best encoding (currently BinaryFormat).
+func NewStreamEncoder(w io.Writer, format int) *StreamEncoder {
+	return &StreamEncoder{writer: w, format: format}
+}
+
+// Indent turns on pretty-printing for the XML and Text property list formats, as Encoder.Indent does.
+// It must be called before anything is written.
+func (p *StreamEncoder) Indent(indent string) {
+	p.indent = indent
+}
+
+// StartDict opens a dictionary.
+func (p *StreamEncoder) StartDict() error {
+	return p.write(func(parent PlistKind) {
+		p.generator.startDictionary(parent)
+		p.stack = append(p.stack, streamFrame{kind: DictionaryKind})
+	})
+}
+
+// StartArray opens an array.
+func (p *StreamEncoder) StartArray() error {
+	return p.write(func(parent PlistKind) {
+		p.generator.startArray(parent)
+		p.stack = append(p.stack, streamFrame{kind: ArrayKind})
+	})
+}
+
+// Key writes the key for the next value in the innermost open dictionary.
+func (p *StreamEncoder) Key(key string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.stack) == 0 || p.stack[len(p.stack)-1].kind != DictionaryKind {
+		return errors.New("plist: Key called outside of a dictionary")
+	}
+	top := &p.stack[len(p.stack)-1]
+	if top.haveKey {
+		return fmt.Errorf("plist: Key called twice without a value (at %q)", key)
+	}
+
+	return p.guard(func() {
+		p.generator.writeKey(key)
+		top.haveKey = true
+	})
+}
+
+// Value writes v, which is encoded as Marshal would encode it.
+func (p *StreamEncoder) Value(v interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	var pval cfValue
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(runtime.Error); ok {
+					panic(r)
+				}
+				err = r.(error)
+			}
+		}()
+
+		enc := &p.encoder
+		enc.format = p.format
+		enc.keypath = enc.keypath[:0]
+		enc.references = enc.references[:0]
+		pval = enc.marshal(reflect.ValueOf(v))
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	if pval == nil {
+		return errors.New("plist: no value to encode")
+	}
+
+	return p.write(func(parent PlistKind) {
+		p.generator.writeValue(parent, pval)
+		p.valueWritten()
+	})
+}
+
+// End closes the innermost open dictionary or array.
+func (p *StreamEncoder) End() error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.stack) == 0 {
+		if p.done {
+			return errStreamComplete
+		}
+		return errors.New("plist: End called with no open dictionary or array")
+	}
+	top := p.stack[len(p.stack)-1]
+	if top.haveKey {
+		return errors.New("plist: dictionary closed with a key that has no value")
+	}
+
+	return p.guard(func() {
+		p.stack = p.stack[:len(p.stack)-1]
+		parent := p.parent()
+		if top.kind == DictionaryKind {
+			p.generator.endDictionary(parent)
+		} else {
+			p.generator.endArray(parent)
+		}
+		p.valueWritten()
+	})
+}
+
+// parent returns the kind of the innermost open container.
+func (p *StreamEncoder) parent() PlistKind {
+	if len(p.stack) == 0 {
+		return InvalidKind
+	}
+	return p.stack[len(p.stack)-1].kind
+}
+
+// write checks that a value may be written now, starting the document if it hasn't
+// been, and calls f with the kind of the container the value is going into.
+func (p *StreamEncoder) write(f func(parent PlistKind)) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.done {
+		return errStreamComplete
+	}
+	if len(p.stack) > 0 {
+		top := p.stack[len(p.stack)-1]
+		if top.kind == DictionaryKind && !top.haveKey {
+			return errors.New("plist: dictionary value written without a key")
+		}
+	}
+
+	return p.guard(func() {
+		if p.generator == nil {
+			p.start()
+		}
+		f(p.parent())
+	})
+}
+
+func (p *StreamEncoder) start() {
+	switch p.format {
+	case XMLFormat:
+		g := newXMLPlistGenerator(p.writer)
+		g.Indent(p.indent)
+		p.generator = g
+	case BinaryFormat, AutomaticFormat:
+		p.generator = newBplistStreamGenerator(p.writer)
+	case OpenStepFormat, GNUStepFormat:
+		w := bufio.NewWriter(p.writer)
+		g := newTextPlistGenerator(w, p.format)
+		g.Indent(p.indent)
+		p.generator, p.flush = g, w.Flush
+	default:
+		panic(fmt.Errorf("plist: unknown format %d", p.format))
+	}
+	p.generator.startDocument()
+}
+
+// valueWritten finishes the document once its top-level value has been written.
+func (p *StreamEncoder) valueWritten() {
+	if len(p.stack) > 0 {
+		p.stack[len(p.stack)-1].haveKey = false
+		return
+	}
+
+	p.done = true
+	p.generator.endDocument()
+	if p.flush != nil {
+		if err := p.flush(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// guard calls f, turning any error it panics with into the StreamEncoder's error.
+func (p *StreamEncoder) guard(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			p.err = r.(error)
+			err = p.err
+		}
+	}()
+	f()
+	return nil
+}
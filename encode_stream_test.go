@@ -0,0 +1,212 @@
+package plist
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type streamManifestEntry struct {
+	Name     string
+	Size     uint64
+	Modified time.Time
+	Tags     []string `plist:",omitempty"`
+}
+
+// writeStreamManifest streams a small manifest. Its keys are given in sorted order, so
+// that the result can be compared with the same document produced by Marshal.
+func writeStreamManifest(enc *StreamEncoder) error {
+	steps := []func() error{
+		enc.StartDict,
+		func() error { return enc.Key("Entries") },
+		enc.StartArray,
+		func() error {
+			return enc.Value(streamManifestEntry{Name: "a.txt", Size: 12, Modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)})
+		},
+		enc.StartDict,
+		func() error { return enc.Key("Name") },
+		func() error { return enc.Value("b \"quoted\" <name>") },
+		func() error { return enc.Key("Sizes") },
+		enc.StartArray,
+		func() error { return enc.Value(1) },
+		func() error { return enc.Value(-2.5) },
+		enc.End,
+		enc.End,
+		func() error { return enc.Value(true) },
+		enc.End,
+		func() error { return enc.Key("Version") },
+		func() error { return enc.Value(uint64(3)) },
+		enc.End,
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+var streamManifestValue = map[string]interface{}{
+	"Entries": []interface{}{
+		streamManifestEntry{Name: "a.txt", Size: 12, Modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		map[string]interface{}{
+			"Name":  "b \"quoted\" <name>",
+			"Sizes": []interface{}{1, -2.5},
+		},
+		true,
+	},
+	"Version": uint64(3),
+}
+
+func TestStreamEncoder(t *testing.T) {
+	for _, format := range []int{XMLFormat, OpenStepFormat, GNUStepFormat} {
+		for _, indent := range []string{"", "\t"} {
+			subtest(t, fmt.Sprintf("%s/%q", FormatNames[format], indent), func(t *testing.T) {
+				var buf bytes.Buffer
+				enc := NewStreamEncoder(&buf, format)
+				enc.Indent(indent)
+				if err := writeStreamManifest(enc); err != nil {
+					t.Fatal(err)
+				}
+
+				expected, err := MarshalIndent(streamManifestValue, format, indent)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf.Bytes(), expected) {
+					t.Errorf("expected\n%s\ngot\n%s", expected, buf.Bytes())
+				}
+			})
+		}
+	}
+}
+
+func TestStreamEncoderBinary(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeStreamManifest(NewStreamEncoder(&buf, BinaryFormat)); err != nil {
+		t.Fatal(err)
+	}
+
+	var streamed, expected interface{}
+	if _, err := Unmarshal(buf.Bytes(), &streamed); err != nil {
+		t.Fatal(err)
+	}
+	doc, _ := Marshal(streamManifestValue, BinaryFormat)
+	Unmarshal(doc, &expected)
+	if !reflect.DeepEqual(streamed, expected) {
+		t.Errorf("expected\n%#v\ngot\n%#v", expected, streamed)
+	}
+}
+
+func TestStreamEncoderBinaryLarge(t *testing.T) {
+	// Enough objects, and a long enough document, to need wide offsets.
+	const n = 70000
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf, BinaryFormat)
+	enc.StartArray()
+	for i := 0; i < n; i++ {
+		enc.StartDict()
+		enc.Key("Index")
+		enc.Value(i)
+		enc.Key("Name")
+		enc.Value(fmt.Sprintf("entry %d", i))
+		if err := enc.End(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []struct {
+		Index int
+		Name  string
+	}
+	if _, err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != n {
+		t.Fatalf("expected %d entries, got %d", n, len(decoded))
+	}
+	for i, e := range decoded {
+		if e.Index != i || e.Name != fmt.Sprintf("entry %d", i) {
+			t.Fatalf("entry %d: got %+v", i, e)
+		}
+	}
+}
+
+func TestStreamEncoderMisuse(t *testing.T) {
+	for name, steps := range map[string][]func(*StreamEncoder) error{
+		"key outside dictionary": {(*StreamEncoder).StartArray, func(e *StreamEncoder) error { return e.Key("a") }},
+		"value without key":      {(*StreamEncoder).StartDict, func(e *StreamEncoder) error { return e.Value(1) }},
+		"two keys":               {(*StreamEncoder).StartDict, func(e *StreamEncoder) error { return e.Key("a") }, func(e *StreamEncoder) error { return e.Key("b") }},
+		"end with dangling key":  {(*StreamEncoder).StartDict, func(e *StreamEncoder) error { return e.Key("a") }, (*StreamEncoder).End},
+		"end with nothing open":  {(*StreamEncoder).End},
+		"nil value":              {func(e *StreamEncoder) error { return e.Value(nil) }},
+		"unencodable value":      {func(e *StreamEncoder) error { return e.Value(make(chan int)) }},
+		"value after document":   {func(e *StreamEncoder) error { return e.Value(1) }, func(e *StreamEncoder) error { return e.Value(2) }},
+	} {
+		subtest(t, name, func(t *testing.T) {
+			enc := NewStreamEncoder(&bytes.Buffer{}, XMLFormat)
+			for i, step := range steps {
+				err := step(enc)
+				if last := i == len(steps)-1; last && err == nil {
+					t.Error("expected an error")
+				} else if !last && err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamEncoderWriteError(t *testing.T) {
+	enc := NewStreamEncoder(&failingWriter{}, OpenStepFormat)
+	enc.StartArray()
+	var err error
+	for i := 0; i < 10000 && err == nil; i++ {
+		err = enc.Value("a value long enough to fill the buffer before long")
+	}
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if err2 := enc.End(); err2 != err {
+		t.Errorf("expected the write error again, got %v", err2)
+	}
+}
+
+func ExampleStreamEncoder() {
+	buf := &bytes.Buffer{}
+	enc := NewStreamEncoder(buf, XMLFormat)
+	enc.Indent("\t")
+
+	enc.StartDict()
+	enc.Key("Files")
+	enc.StartArray()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		enc.Value(name)
+	}
+	enc.End()
+	enc.Key("Count")
+	enc.Value(2)
+	if err := enc.End(); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(buf.String())
+
+	// Output: <?xml version="1.0" encoding="UTF-8"?>
+	// <!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+	// <plist version="1.0">
+	// 	<dict>
+	// 		<key>Files</key>
+	// 		<array>
+	// 			<string>a.txt</string>
+	// 			<string>b.txt</string>
+	// 		</array>
+	// 		<key>Count</key>
+	// 		<integer>2</integer>
+	// 	</dict>
+	// </plist>
+}
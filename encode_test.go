@@ -2,7 +2,9 @@ package plist
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
 )
 
@@ -24,6 +26,55 @@ func BenchmarkOpenStepEncode(b *testing.B) {
 	}
 }
 
+type smallInfoPlist struct {
+	Identifier   string          `plist:"CFBundleIdentifier"`
+	Name         string          `plist:"CFBundleName"`
+	Version      string          `plist:"CFBundleShortVersionString"`
+	Build        int             `plist:"CFBundleVersion"`
+	Capabilities []string        `plist:"UIRequiredDeviceCapabilities"`
+	Entitlements map[string]bool `plist:"Entitlements"`
+}
+
+var smallInfoPlistValue = &smallInfoPlist{
+	Identifier:   "net.howett.plist",
+	Name:         "plist",
+	Version:      "1.0",
+	Build:        12,
+	Capabilities: []string{"arm64", "metal"},
+	Entitlements: map[string]bool{"com.apple.security.app-sandbox": true, "com.apple.security.network.client": false},
+}
+
+func benchmarkSmallEncode(b *testing.B, format int, reset bool) {
+	b.ReportAllocs()
+	var buf bytes.Buffer
+	enc := NewEncoderForFormat(&buf, format)
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if reset {
+			enc.Reset(&buf)
+		} else {
+			enc = NewEncoderForFormat(&buf, format)
+		}
+		if err := enc.Encode(smallInfoPlistValue); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSmallXMLEncode(b *testing.B)         { benchmarkSmallEncode(b, XMLFormat, false) }
+func BenchmarkSmallXMLEncodeReset(b *testing.B)    { benchmarkSmallEncode(b, XMLFormat, true) }
+func BenchmarkSmallBplistEncode(b *testing.B)      { benchmarkSmallEncode(b, BinaryFormat, false) }
+func BenchmarkSmallBplistEncodeReset(b *testing.B) { benchmarkSmallEncode(b, BinaryFormat, true) }
+
+func BenchmarkSmallMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(smallInfoPlistValue, BinaryFormat); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestEncode(t *testing.T) {
 	for _, test := range tests {
 		subtest(t, test.Name, func(t *testing.T) {
@@ -54,6 +105,146 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+func TestEncoderReset(t *testing.T) {
+	for _, format := range []int{XMLFormat, BinaryFormat, OpenStepFormat, GNUStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			var buf bytes.Buffer
+			enc := NewEncoderForFormat(&buf, format)
+			// Twice through, so that every document follows a different one.
+			for i := 0; i < 2; i++ {
+				for _, test := range tests {
+					doc, ok := test.Documents[format]
+					if !ok || test.SkipEncode[format] {
+						continue
+					}
+
+					buf.Reset()
+					enc.Reset(&buf)
+					if err := enc.Encode(test.Value); err != nil {
+						t.Errorf("%s: %v", test.Name, err)
+						continue
+					}
+					if !bytes.Equal(doc, buf.Bytes()) {
+						t.Errorf("%s: reused encoder produced\n%q\nexpected\n%q", test.Name, buf.Bytes(), doc)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncoderResetAfterError(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewBinaryEncoder(&buf)
+	if err := enc.Encode(map[string]interface{}{"a": "b", "c": make(chan int)}); err == nil {
+		t.Fatal("expected an error encoding a channel")
+	}
+
+	buf.Reset()
+	enc.Reset(&buf)
+	if err := enc.Encode(smallInfoPlistValue); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := Marshal(smallInfoPlistValue, BinaryFormat)
+	if !bytes.Equal(expected, buf.Bytes()) {
+		t.Errorf("encoder reused after an error produced\n%x\nexpected\n%x", buf.Bytes(), expected)
+	}
+}
+
+// dataReaderTestBytes is long enough to be copied in several pieces, and not a multiple
+// of the four bytes that text property lists group data into.
+var dataReaderTestBytes = bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 200)[:7001]
+
+// chunkedReader returns data in pieces of varying size, and hides any methods
+// that would tell the encoder how long it is.
+type chunkedReader struct {
+	data []byte
+	n    int
+}
+
+func (r *chunkedReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	r.n = r.n%7 + 1
+	if len(b) > r.n {
+		b = b[:r.n]
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+type dataReaderTest struct {
+	Chunked io.Reader
+	Len     *bytes.Reader
+	Seeker  *io.SectionReader
+	Empty   io.Reader
+	Nil     io.Reader `plist:",omitempty"`
+}
+
+type dataReaderBytes struct {
+	Chunked []byte
+	Len     []byte
+	Seeker  []byte
+	Empty   []byte
+}
+
+func TestEncodeDataReader(t *testing.T) {
+	data := dataReaderTestBytes
+	for _, format := range []int{XMLFormat, BinaryFormat, OpenStepFormat, GNUStepFormat} {
+		for _, indent := range []string{"", "\t"} {
+			subtest(t, fmt.Sprintf("%s/%q", FormatNames[format], indent), func(t *testing.T) {
+				section := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+				section.Seek(100, 0)
+				v := dataReaderTest{
+					Chunked: &chunkedReader{data: data},
+					Len:     bytes.NewReader(data[:5]),
+					Seeker:  section,
+					Empty:   bytes.NewReader(nil),
+				}
+				got, err := MarshalIndent(v, format, indent)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expected, _ := MarshalIndent(dataReaderBytes{data, data[:5], data[100:], []byte{}}, format, indent)
+				if format == XMLFormat {
+					// An empty reader can't be known to be empty until the element has been started.
+					expected = bytes.Replace(expected, []byte("<data/>"), []byte("<data></data>"), 1)
+				}
+				if !bytes.Equal(got, expected) {
+					t.Errorf("expected\n%s\ngot\n%s", expected, got)
+				}
+			})
+		}
+	}
+}
+
+type lyingLenReader struct {
+	io.Reader
+}
+
+func (lyingLenReader) Len() int { return 1000 }
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("read failed") }
+
+func TestEncodeDataReaderError(t *testing.T) {
+	for _, format := range []int{XMLFormat, BinaryFormat, OpenStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			if _, err := Marshal(map[string]io.Reader{"a": failingReader{}}, format); err == nil || err.Error() != "read failed" {
+				t.Errorf("expected the read error, got %v", err)
+			}
+		})
+	}
+
+	if _, err := Marshal([]interface{}{lyingLenReader{bytes.NewReader(make([]byte, 10))}}, BinaryFormat); err == nil {
+		t.Error("expected an error for a reader shorter than its length")
+	}
+}
+
 func ExampleEncoder_Encode() {
 	type sparseBundleHeader struct {
 		InfoDictionaryVersion string `plist:"CFBundleInfoDictionaryVersion"`
@@ -0,0 +1,50 @@
+package plist_test
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"howett.net/plist"
+)
+
+// Blob accepts either plist data or a base64-encoded string.
+type Blob []byte
+
+func (b *Blob) UnmarshalPlistNode(node *plist.Node) error {
+	switch node.Kind() {
+	case plist.DataKind:
+		data, err := node.DataValue()
+		if err != nil {
+			return err
+		}
+		*b = append(Blob(nil), data...)
+		return nil
+	case plist.StringKind:
+		s, err := node.StringValue()
+		if err != nil {
+			return err
+		}
+		*b, err = base64.StdEncoding.DecodeString(s)
+		return err
+	}
+	return fmt.Errorf("can't decode a %v into a Blob", node.Kind())
+}
+
+func ExampleNodeUnmarshaler() {
+	var blobs []Blob
+	_, err := plist.Unmarshal([]byte(`<plist><array>
+		<data>RHVzdGlu</data>
+		<string>RHVzdGlu</string>
+	</array></plist>`), &blobs)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, b := range blobs {
+		fmt.Println(string(b))
+	}
+
+	// Output:
+	// Dustin
+	// Dustin
+}
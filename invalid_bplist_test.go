@@ -494,3 +494,18 @@ func TestInvalidBinaryPlists(t *testing.T) {
 		}
 	}
 }
+
+func TestInvalidBinaryPlistsLazily(t *testing.T) {
+	for _, data := range InvalidBplists {
+		r, err := NewBinaryReader(bytes.NewReader(data), int64(len(data)))
+		if err == nil {
+			var v interface{}
+			err = r.Decode("", &v)
+		}
+		if err == nil {
+			t.Fatal("invalid plist failed to throw error")
+		} else {
+			t.Log(err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package plist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keypathElement is a single step taken while walking a property list:
+// either a dictionary key or an array index.
+type keypathElement struct {
+	key   string
+	index int // -1 for dictionary keys
+}
+
+// keypath records the route from the root of a property list to the value
+// currently being processed. It is rendered in the same syntax ply uses,
+// e.g. /dict/key[2]. A backslash escapes any /, [ or \ in a key.
+type keypath []keypathElement
+
+func (k *keypath) pushKey(key string) {
+	*k = append(*k, keypathElement{key: key, index: -1})
+}
+
+func (k *keypath) pushIndex(index int) {
+	*k = append(*k, keypathElement{index: index})
+}
+
+func (k *keypath) pop() {
+	*k = (*k)[:len(*k)-1]
+}
+
+func (k keypath) String() string {
+	if len(k) == 0 {
+		return "/"
+	}
+
+	var b strings.Builder
+	for _, e := range k {
+		if e.index >= 0 {
+			b.WriteByte('[')
+			b.WriteString(strconv.Itoa(e.index))
+			b.WriteByte(']')
+		} else {
+			b.WriteByte('/')
+			writeKeypathKey(&b, e.key)
+		}
+	}
+	return b.String()
+}
+
+func writeKeypathKey(b *strings.Builder, key string) {
+	for {
+		i := strings.IndexAny(key, `/[\`)
+		if i < 0 {
+			b.WriteString(key)
+			return
+		}
+		b.WriteString(key[:i])
+		b.WriteByte('\\')
+		b.WriteByte(key[i])
+		key = key[i+1:]
+	}
+}
+
+// parseKeypath parses a keypath in the form produced by keypath.String.
+func parseKeypath(s string) (keypath, error) {
+	if s == "" || s == "/" {
+		return nil, nil
+	}
+
+	var kp keypath
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '/':
+			var key strings.Builder
+			for i++; i < len(s) && s[i] != '/' && s[i] != '['; i++ {
+				if s[i] == '\\' {
+					i++
+					if i == len(s) {
+						return nil, fmt.Errorf("plist: unterminated escape in keypath %q", s)
+					}
+				}
+				key.WriteByte(s[i])
+			}
+			kp.pushKey(key.String())
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("plist: unterminated index in keypath %q", s)
+			}
+			index, err := strconv.Atoi(s[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("plist: invalid index %q in keypath %q", s[i+1:i+end], s)
+			}
+			kp.pushIndex(index)
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("plist: keypath %q must begin with / or [", s)
+		}
+	}
+	return kp, nil
+}
@@ -2,6 +2,8 @@ package plist
 
 import (
 	"encoding"
+	"io"
+	"net/url"
 	"reflect"
 	"time"
 )
@@ -27,7 +29,10 @@ func isEmptyValue(v reflect.Value) bool {
 var (
 	plistMarshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
 	textMarshalerType  = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	binMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
 	timeType           = reflect.TypeOf((*time.Time)(nil)).Elem()
+	readerType         = reflect.TypeOf((*io.Reader)(nil)).Elem()
+	setType            = reflect.TypeOf(Set(nil))
 )
 
 func implementsInterface(val reflect.Value, interfaceType reflect.Type) (interface{}, bool) {
@@ -49,7 +54,101 @@ func (p *Encoder) marshalPlistInterface(marshalable Marshaler) cfValue {
 	if err != nil {
 		panic(err)
 	}
-	return p.marshal(reflect.ValueOf(value))
+	return p.marshalInterface(value)
+}
+
+// marshalInterface marshals a value that is not yet reflected, such as the result of
+// MarshalPlist. The types that marshalers (including those generated by plistgen) most
+// often return are handled without reflection.
+func (p *Encoder) marshalInterface(v interface{}) cfValue {
+	switch v := v.(type) {
+	case nil:
+		return p.marshalNil()
+	case string:
+		return cfString(v)
+	case bool:
+		return cfBoolean(v)
+	case int:
+		return &cfNumber{signed: true, value: uint64(v)}
+	case int8:
+		return &cfNumber{signed: true, value: uint64(v)}
+	case int16:
+		return &cfNumber{signed: true, value: uint64(v)}
+	case int32:
+		return &cfNumber{signed: true, value: uint64(v)}
+	case int64:
+		return &cfNumber{signed: true, value: uint64(v)}
+	case uint:
+		return &cfNumber{signed: false, value: uint64(v)}
+	case uint8:
+		return &cfNumber{signed: false, value: uint64(v)}
+	case uint16:
+		return &cfNumber{signed: false, value: uint64(v)}
+	case uint32:
+		return &cfNumber{signed: false, value: uint64(v)}
+	case uint64:
+		return &cfNumber{signed: false, value: v}
+	case uintptr:
+		return &cfNumber{signed: false, value: uint64(v)}
+	case float32:
+		return &cfReal{wide: false, value: float64(v)}
+	case float64:
+		return &cfReal{wide: true, value: v}
+	case []byte:
+		return cfData(v)
+	case time.Time:
+		return cfDate(v)
+	case UID:
+		return cfUID(v)
+	case map[string]interface{}:
+		if v != nil {
+			val := reflect.ValueOf(v)
+			key, pval, ok := p.enterReference(val)
+			if !ok {
+				pval = p.marshalInterfaceMap(v)
+				p.leaveReference(key, val, pval)
+			}
+			return pval
+		}
+	case []interface{}:
+		if v != nil {
+			val := reflect.ValueOf(v)
+			key, pval, ok := p.enterReference(val)
+			if !ok {
+				pval = p.marshalInterfaceSlice(v)
+				p.leaveReference(key, val, pval)
+			}
+			return pval
+		}
+	}
+	return p.marshal(reflect.ValueOf(v))
+}
+
+func (p *Encoder) marshalInterfaceMap(m map[string]interface{}) cfValue {
+	dict := &cfDictionary{
+		keys:   make([]string, 0, len(m)),
+		values: make([]cfValue, 0, len(m)),
+	}
+	for k, v := range m {
+		p.keypath.pushKey(k)
+		if subpval := p.marshalInterface(v); subpval != nil {
+			dict.keys = append(dict.keys, k)
+			dict.values = append(dict.values, subpval)
+		}
+		p.keypath.pop()
+	}
+	return dict
+}
+
+func (p *Encoder) marshalInterfaceSlice(s []interface{}) cfValue {
+	values := make([]cfValue, len(s))
+	array := &cfArray{values}
+	for i, v := range s {
+		p.keypath.pushIndex(i)
+		values[i] = p.marshalInterface(v)
+		p.keypath.pop()
+	}
+	return array
 }
 
 // marshalTextInterface marshals a TextMarshaler to a plist string.
@@ -61,6 +160,15 @@ func (p *Encoder) marshalTextInterface(marshalable encoding.TextMarshaler) cfVal
 	return cfString(s)
 }
 
+// marshalBinaryInterface marshals a BinaryMarshaler to plist data.
+func (p *Encoder) marshalBinaryInterface(marshalable encoding.BinaryMarshaler) cfValue {
+	b, err := marshalable.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return cfData(b)
+}
+
 // marshalStruct marshals a reflected struct value to a plist dictionary
 func (p *Encoder) marshalStruct(typ reflect.Type, val reflect.Value) cfValue {
 	tinfo, _ := getTypeInfo(typ)
@@ -74,27 +182,160 @@ func (p *Encoder) marshalStruct(typ reflect.Type, val reflect.Value) cfValue {
 		if !value.IsValid() || finfo.omitEmpty && isEmptyValue(value) {
 			continue
 		}
-		dict.keys = append(dict.keys, finfo.name)
-		dict.values = append(dict.values, p.marshal(value))
+		p.keypath.pushKey(finfo.name)
+		if subpval := p.marshal(value); subpval != nil {
+			dict.keys = append(dict.keys, finfo.name)
+			dict.values = append(dict.values, subpval)
+		}
+		p.keypath.pop()
 	}
 
 	return dict
 }
 
+// referenceKey identifies the storage behind a pointer, map or slice.
+// The type is part of the key because a pointer to a struct and a pointer
+// to its first field share an address.
+type referenceKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// sharedObject is what a reference was marshaled to. It keeps the value behind the
+// reference alive, so that no other value can be given its address (as the result
+// of a later MarshalPlist call might be) while the Encoder still remembers it.
+type sharedObject struct {
+	val  reflect.Value
+	pval cfValue
+}
+
+func isReference(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Map:
+		return !val.IsNil()
+	case reflect.Slice:
+		return !val.IsNil() && val.Type().Elem().Kind() != reflect.Uint8
+	}
+	return false
+}
+
+// marshalReference marshals a pointer, map or slice, detecting cycles
+// along the way. When object sharing is enabled, values reached through
+// the same reference are marshaled once and the resulting object is reused.
+func (p *Encoder) marshalReference(val reflect.Value) cfValue {
+	key, pval, ok := p.enterReference(val)
+	if ok {
+		return pval
+	}
+
+	if val.Kind() == reflect.Ptr {
+		pval = p.marshal(val.Elem())
+	} else {
+		pval = p.marshalContainer(val)
+	}
+	p.leaveReference(key, val, pval)
+	return pval
+}
+
+// enterReference records that the value behind a pointer, map or slice is about to be
+// marshaled. If it has already been marshaled and sharing is enabled, it returns the
+// existing object instead. A value that is still being marshaled is part of a cycle,
+// which no property list can hold, even with sharing enabled.
+func (p *Encoder) enterReference(val reflect.Value) (referenceKey, cfValue, bool) {
+	key := referenceKey{val.Pointer(), val.Type(), 0}
+	if val.Kind() == reflect.Slice {
+		key.len = val.Len()
+	}
+
+	if obj, ok := p.shared[key]; ok {
+		return key, obj.pval, true
+	}
+
+	for _, ref := range p.references {
+		if ref == key {
+			panic(&cyclicValueError{val.Type(), p.keypath.String()})
+		}
+	}
+
+	p.references = append(p.references, key)
+	return key, nil, false
+}
+
+// leaveReference completes a reference to val begun by enterReference.
+func (p *Encoder) leaveReference(key referenceKey, val reflect.Value, pval cfValue) {
+	p.references = p.references[:len(p.references)-1]
+
+	if p.shared != nil && pval != nil {
+		p.shared[key] = sharedObject{val, pval}
+	}
+}
+
 func (p *Encoder) marshalTime(val reflect.Value) cfValue {
 	time := val.Interface().(time.Time)
 	return cfDate(time)
 }
 
+// marshalNil returns the value that stands in for nil: null if extended types are enabled,
+// or nothing at all.
+func (p *Encoder) marshalNil() cfValue {
+	if p.extended() {
+		return cfNull{}
+	}
+	return nil
+}
+
+// marshalExtended marshals the values that are only encoded as themselves when extended
+// types are enabled. It returns nil for any other value.
+func (p *Encoder) marshalExtended(val reflect.Value) cfValue {
+	if val.Kind() == reflect.Ptr && !val.IsNil() && (val.Type().Elem() == urlType || val.Type().Elem() == uuidType) {
+		val = val.Elem()
+	}
+	if !val.CanInterface() {
+		return nil
+	}
+
+	switch val.Type() {
+	case setType:
+		if val.IsNil() {
+			return nil
+		}
+		key, pval, ok := p.enterReference(val)
+		if !ok {
+			set := &cfSet{values: make([]cfValue, val.Len())}
+			for i := range set.values {
+				p.keypath.pushIndex(i)
+				set.values[i] = p.marshal(val.Index(i))
+				p.keypath.pop()
+			}
+			pval = set
+			p.leaveReference(key, val, pval)
+		}
+		return pval
+	case uuidType:
+		return cfUUID(val.Interface().(UUID))
+	case urlType:
+		u := val.Interface().(url.URL)
+		return &cfURL{str: u.String()}
+	}
+	return nil
+}
+
 func (p *Encoder) marshal(val reflect.Value) cfValue {
 	if !val.IsValid() {
-		return nil
+		return p.marshalNil()
 	}
 
 	if receiver, can := implementsInterface(val, plistMarshalerType); can {
 		return p.marshalPlistInterface(receiver.(Marshaler))
 	}
 
+	if p.extended() {
+		if pval := p.marshalExtended(val); pval != nil {
+			return pval
+		}
+	}
+
 	// time.Time implements TextMarshaler, but we need to store it in RFC3339
 	if val.Type() == timeType {
 		return p.marshalTime(val)
@@ -111,14 +352,33 @@ func (p *Encoder) marshal(val reflect.Value) cfValue {
 		return p.marshalTextInterface(receiver.(encoding.TextMarshaler))
 	}
 
-	// Descend into pointers or interfaces
-	if val.Kind() == reflect.Ptr || (val.Kind() == reflect.Interface && val.NumMethod() == 0) {
-		val = val.Elem()
+	// Check for binary marshaler; text takes precedence, as it did before we supported binary.
+	if receiver, can := implementsInterface(val, binMarshalerType); can {
+		return p.marshalBinaryInterface(receiver.(encoding.BinaryMarshaler))
+	}
+
+	// Readers are streamed into the document as data. Only values that are readers
+	// themselves count: a struct isn't read from just because its address is one.
+	if val.CanInterface() && val.Type().Implements(readerType) {
+		if (val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface) && val.IsNil() {
+			return p.marshalNil()
+		}
+		return &cfDataReader{val.Interface().(io.Reader)}
+	}
+
+	// Descend into interfaces, giving the value inside the same consideration.
+	if val.Kind() == reflect.Interface && val.NumMethod() == 0 {
+		return p.marshal(val.Elem())
+	}
+
+	// Pointers, maps and slices are followed by marshalReference, which guards against cycles.
+	if isReference(val) {
+		return p.marshalReference(val)
 	}
 
 	// We got this far and still may have an invalid anything or nil ptr/interface
 	if !val.IsValid() || ((val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface) && val.IsNil()) {
-		return nil
+		return p.marshalNil()
 	}
 
 	typ := val.Type()
@@ -144,6 +404,18 @@ func (p *Encoder) marshal(val reflect.Value) cfValue {
 		return &cfReal{wide: true, value: val.Float()}
 	case reflect.Bool:
 		return cfBoolean(val.Bool())
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return p.marshalContainer(val)
+	default:
+		panic(&unknownTypeError{typ})
+	}
+}
+
+// marshalContainer marshals a reflected slice, array or map to a plist array,
+// dictionary or data.
+func (p *Encoder) marshalContainer(val reflect.Value) cfValue {
+	typ := val.Type()
+	switch val.Kind() {
 	case reflect.Slice, reflect.Array:
 		if typ.Elem().Kind() == reflect.Uint8 {
 			bytes := []byte(nil)
@@ -156,12 +428,15 @@ func (p *Encoder) marshal(val reflect.Value) cfValue {
 			return cfData(bytes)
 		} else {
 			values := make([]cfValue, val.Len())
+			array := &cfArray{values}
 			for i, length := 0, val.Len(); i < length; i++ {
+				p.keypath.pushIndex(i)
 				if subpval := p.marshal(val.Index(i)); subpval != nil {
 					values[i] = subpval
 				}
+				p.keypath.pop()
 			}
-			return &cfArray{values}
+			return array
 		}
 	case reflect.Map:
 		if typ.Key().Kind() != reflect.String {
@@ -174,13 +449,14 @@ func (p *Encoder) marshal(val reflect.Value) cfValue {
 			values: make([]cfValue, 0, l),
 		}
 		for _, keyv := range val.MapKeys() {
+			p.keypath.pushKey(keyv.String())
 			if subpval := p.marshal(val.MapIndex(keyv)); subpval != nil {
 				dict.keys = append(dict.keys, keyv.String())
 				dict.values = append(dict.values, subpval)
 			}
+			p.keypath.pop()
 		}
 		return dict
-	default:
-		panic(&unknownTypeError{typ})
 	}
+	panic(&unknownTypeError{typ})
 }
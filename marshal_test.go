@@ -1,7 +1,10 @@
 package plist
 
 import (
+	"bytes"
+	"net"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -71,3 +74,216 @@ func TestInvalidMarshal(t *testing.T) {
 		})
 	}
 }
+
+type cyclicNode struct {
+	Name     string
+	Next     *cyclicNode   `plist:",omitempty"`
+	Children []*cyclicNode `plist:",omitempty"`
+}
+
+func TestMarshalCycle(t *testing.T) {
+	loop := &cyclicNode{Name: "a"}
+	loop.Next = &cyclicNode{Name: "b", Next: loop}
+
+	selfMap := map[string]interface{}{}
+	selfMap["self"] = selfMap
+
+	selfSlice := []interface{}{nil}
+	selfSlice[0] = selfSlice
+
+	tests := []struct {
+		Name    string
+		Thing   interface{}
+		Keypath string
+	}{
+		{"Pointer", loop, "/Next/Next"},
+		{"Map", selfMap, "/self"},
+		{"Slice", selfSlice, "[0]"},
+	}
+
+	for _, v := range tests {
+		subtest(t, v.Name, func(t *testing.T) {
+			for _, format := range []int{XMLFormat, BinaryFormat, OpenStepFormat} {
+				data, err := Marshal(v.Thing, format)
+				if err == nil {
+					t.Fatalf("expected error; got plist data: %x", data)
+				}
+				cerr, ok := err.(*cyclicValueError)
+				if !ok {
+					t.Fatalf("expected a cycle error, got %v", err)
+				}
+				if cerr.keypath != v.Keypath {
+					t.Errorf("expected cycle at %s, got %s", v.Keypath, cerr.keypath)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalSharedObjects(t *testing.T) {
+	shared := &cyclicNode{Name: "shared"}
+	root := &cyclicNode{Name: "root", Children: []*cyclicNode{shared, shared, shared}}
+
+	plain, err := Marshal(root, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewBinaryEncoder(buf)
+	enc.ShareObjects(true)
+	if err := enc.Encode(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() >= len(plain) {
+		t.Errorf("expected shared encoding (%d bytes) to be smaller than unshared encoding (%d bytes)", buf.Len(), len(plain))
+	}
+
+	var decoded cyclicNode
+	if _, err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Children) != 3 || decoded.Children[2].Name != "shared" {
+		t.Errorf("unexpected decoded value %#v", decoded)
+	}
+}
+
+// temporaryMarshaler returns a new slice every time it is marshaled, after a collection
+// that frees the one it returned before.
+type temporaryMarshaler int
+
+func (m temporaryMarshaler) MarshalPlist() (interface{}, error) {
+	runtime.GC()
+	return []interface{}{int(m), int(m)}, nil
+}
+
+func TestMarshalSharedTemporaries(t *testing.T) {
+	values := make([]temporaryMarshaler, 20)
+	for i := range values {
+		values[i] = temporaryMarshaler(i)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewBinaryEncoder(buf)
+	enc.ShareObjects(true)
+	if err := enc.Encode(values); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded [][]int
+	if _, err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range decoded {
+		if len(v) != 2 || v[0] != i || v[1] != i {
+			t.Errorf("element %d: expected [%d %d], got %v", i, i, i, v)
+		}
+	}
+}
+
+func TestMarshalSharedCycle(t *testing.T) {
+	loop := &cyclicNode{Name: "a"}
+	loop.Next = &cyclicNode{Name: "b", Next: loop}
+
+	// Sharing merges values reached more than once, but a cycle is still an error:
+	// neither our parser nor CoreFoundation accepts a document with one.
+	for _, format := range []int{BinaryFormat, XMLFormat} {
+		enc := NewEncoderForFormat(&bytes.Buffer{}, format)
+		enc.ShareObjects(true)
+		err := enc.Encode(loop)
+		cerr, ok := err.(*cyclicValueError)
+		if !ok {
+			t.Fatalf("%s: expected a cycle error, got %v", FormatNames[format], err)
+		}
+		if cerr.keypath != "/Next/Next" {
+			t.Errorf("%s: expected cycle at /Next/Next, got %s", FormatNames[format], cerr.keypath)
+		}
+	}
+}
+
+type mapMarshaler struct {
+	m map[string]interface{}
+}
+
+func (m mapMarshaler) MarshalPlist() (interface{}, error) {
+	return m.m, nil
+}
+
+func TestMarshalerResultFastPath(t *testing.T) {
+	value := map[string]interface{}{
+		"string":  "hello",
+		"bool":    true,
+		"ints":    []interface{}{int(-1), int8(-8), int16(-16), int32(-32), int64(-64)},
+		"uints":   []interface{}{uint(1), uint8(8), uint16(16), uint32(32), uint64(64), uintptr(128)},
+		"floats":  []interface{}{float32(1.5), float64(2.5)},
+		"data":    []byte{1, 2, 3},
+		"date":    time.Date(2013, 11, 27, 0, 34, 0, 0, time.UTC),
+		"uid":     UID(7),
+		"nested":  map[string]interface{}{"inner": []interface{}{"a", map[string]interface{}{}}},
+		"nil":     nil,
+		"strings": []string{"not", "fast"},
+	}
+
+	for _, format := range []int{XMLFormat, BinaryFormat, OpenStepFormat, GNUStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			expected, err := Marshal(value, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := Marshal(mapMarshaler{value}, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, actual) {
+				t.Errorf("expected %q, got %q", expected, actual)
+			}
+		})
+	}
+
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+	_, err := Marshal(mapMarshaler{cyclic}, XMLFormat)
+	if _, ok := err.(*cyclicValueError); !ok {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+}
+
+func TestMarshalerInInterface(t *testing.T) {
+	value := map[string]interface{}{
+		"marshaler": mapMarshaler{map[string]interface{}{"a": "b"}},
+		"text":      net.IP{127, 0, 0, 1},
+	}
+	actual, err := Marshal(value, OpenStepFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{marshaler={a=b;};text="127.0.0.1";}`
+	if string(actual) != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestMarshalNilStructFields(t *testing.T) {
+	type nilFields struct {
+		Any  interface{}
+		Ptr  *int
+		Name string
+	}
+
+	for _, format := range []int{XMLFormat, BinaryFormat, OpenStepFormat, GNUStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			expected, err := Marshal(map[string]interface{}{"Name": "x"}, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := Marshal(nilFields{Name: "x"}, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, actual) {
+				t.Errorf("expected %q, got %q", expected, actual)
+			}
+		})
+	}
+}
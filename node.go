@@ -0,0 +1,263 @@
+package plist
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// A Node is a single value in a property list document, as seen by a NodeUnmarshaler.
+//
+// A Node is only valid for the duration of the UnmarshalPlistNode call it was passed to.
+type Node struct {
+	dec  *Decoder
+	pval cfValue
+
+	// A node's keypath is its parent's, followed by step. Only nodes created by
+	// the Decoder itself have no parent; their keypath is stored in full.
+	parent  *Node
+	step    keypathElement
+	keypath keypath
+}
+
+var (
+	nodeUnmarshalerType = reflect.TypeOf((*NodeUnmarshaler)(nil)).Elem()
+
+	stringType  = reflect.TypeOf("")
+	int64Type   = reflect.TypeOf(int64(0))
+	uint64Type  = reflect.TypeOf(uint64(0))
+	float64Type = reflect.TypeOf(float64(0))
+	boolType    = reflect.TypeOf(false)
+	bytesType   = reflect.TypeOf([]byte(nil))
+)
+
+func (p *Decoder) newNode(pval cfValue, kp keypath) *Node {
+	return &Node{
+		dec:     p,
+		pval:    pval,
+		keypath: kp[:len(kp):len(kp)], // a Node doesn't outlive the keypath it was created at
+	}
+}
+
+func (p *Decoder) unmarshalNodeInterface(pval cfValue, unmarshalable NodeUnmarshaler) {
+	err := unmarshalable.UnmarshalPlistNode(p.newNode(pval, p.keypath))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Kind returns the kind of the property list value.
+func (n *Node) Kind() PlistKind {
+	return n.pval.kind()
+}
+
+// Keypath returns the location of the value in the document, in the form /key/key[index].
+// Any /, [ or \ in a key is escaped with a backslash.
+func (n *Node) Keypath() string {
+	return n.path().String()
+}
+
+func (n *Node) path() keypath {
+	return n.appendPath(nil)
+}
+
+// appendPath appends the node's keypath to kp.
+func (n *Node) appendPath(kp keypath) keypath {
+	if n.parent == nil {
+		return append(kp, n.keypath...)
+	}
+	return append(n.parent.appendPath(kp), n.step)
+}
+
+// TypeMismatch returns the error Unmarshal reports when the value cannot be stored
+// into the value pointed to by v.
+func (n *Node) TypeMismatch(v interface{}) error {
+	return n.incompatible(reflect.TypeOf(v).Elem())
+}
+
+// Decode unmarshals the value into v, exactly as Unmarshal would have.
+// It is safe to call Decode more than once.
+func (n *Node) Decode(v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	// Build the keypath in the spare capacity after the decoder's current one,
+	// which is restored once we're done.
+	saved := n.dec.keypath
+	n.dec.keypath = n.appendPath(saved[len(saved):])
+	defer func() {
+		n.dec.keypath = saved
+	}()
+
+	n.dec.unmarshal(n.pval, reflect.ValueOf(v))
+	return
+}
+
+// Interface returns the value as Unmarshal would decode it into an empty interface.
+func (n *Node) Interface() interface{} {
+	return n.dec.valueInterface(n.pval)
+}
+
+// Len returns the number of elements in an array or set, or entries in a dictionary.
+// It returns 0 for any other kind of value.
+func (n *Node) Len() int {
+	switch pval := n.pval.(type) {
+	case *cfArray:
+		return len(pval.values)
+	case *cfSet:
+		return len(pval.values)
+	case *cfDictionary:
+		return len(pval.keys)
+	}
+	return 0
+}
+
+// Keys returns the keys of a dictionary, in document order.
+// It returns nil for any other kind of value.
+func (n *Node) Keys() []string {
+	if dict, ok := n.pval.(*cfDictionary); ok {
+		return append([]string(nil), dict.keys...)
+	}
+	return nil
+}
+
+// Index returns the i'th element of an array or set. It returns nil if the value
+// is not an array or set, or i is out of range.
+func (n *Node) Index(i int) *Node {
+	var values []cfValue
+	switch pval := n.pval.(type) {
+	case *cfArray:
+		values = pval.values
+	case *cfSet:
+		values = pval.values
+	}
+	if i < 0 || i >= len(values) || values[i] == nil {
+		return nil
+	}
+
+	return &Node{dec: n.dec, pval: values[i], parent: n, step: keypathElement{index: i}}
+}
+
+// Lookup returns the value stored under key in a dictionary, and whether it was present.
+// As when unmarshaling, if a key appears more than once the last value wins.
+func (n *Node) Lookup(key string) (*Node, bool) {
+	dict, ok := n.pval.(*cfDictionary)
+	if !ok {
+		return nil, false
+	}
+
+	for i := len(dict.keys) - 1; i >= 0; i-- {
+		if dict.keys[i] == key && dict.values[i] != nil {
+			return &Node{dec: n.dec, pval: dict.values[i], parent: n, step: keypathElement{key: key, index: -1}}, true
+		}
+	}
+	return nil, false
+}
+
+func (n *Node) incompatible(typ reflect.Type) error {
+	return &incompatibleDecodeTypeError{typ, n.pval.typeName()}
+}
+
+// laxString returns the string value of the node if the document it came from
+// can only store strings, for conversion into the requested type.
+func (n *Node) laxString() (string, bool) {
+	if !n.dec.lax {
+		return "", false
+	}
+	str, ok := n.pval.(cfString)
+	return string(str), ok
+}
+
+// StringValue returns the value of a string.
+func (n *Node) StringValue() (string, error) {
+	if str, ok := n.pval.(cfString); ok {
+		return string(str), nil
+	}
+	return "", n.incompatible(stringType)
+}
+
+// IntValue returns the value of an integer (or UID) as a signed integer.
+func (n *Node) IntValue() (int64, error) {
+	switch pval := n.pval.(type) {
+	case *cfNumber:
+		return int64(pval.value), nil
+	case cfUID:
+		return int64(pval), nil
+	}
+	if s, ok := n.laxString(); ok {
+		return strconv.ParseInt(s, 10, 64)
+	}
+	return 0, n.incompatible(int64Type)
+}
+
+// UintValue returns the value of an integer (or UID) as an unsigned integer.
+func (n *Node) UintValue() (uint64, error) {
+	switch pval := n.pval.(type) {
+	case *cfNumber:
+		return pval.value, nil
+	case cfUID:
+		return uint64(pval), nil
+	}
+	if s, ok := n.laxString(); ok {
+		return strconv.ParseUint(s, 10, 64)
+	}
+	return 0, n.incompatible(uint64Type)
+}
+
+// FloatValue returns the value of a real.
+func (n *Node) FloatValue() (float64, error) {
+	if real, ok := n.pval.(*cfReal); ok {
+		return real.value, nil
+	}
+	if s, ok := n.laxString(); ok {
+		return strconv.ParseFloat(s, 64)
+	}
+	return 0, n.incompatible(float64Type)
+}
+
+// BoolValue returns the value of a boolean.
+func (n *Node) BoolValue() (bool, error) {
+	if b, ok := n.pval.(cfBoolean); ok {
+		return bool(b), nil
+	}
+	if s, ok := n.laxString(); ok {
+		return strconv.ParseBool(s)
+	}
+	return false, n.incompatible(boolType)
+}
+
+// DataValue returns the contents of a data value.
+// The returned slice may refer to the decoder's input, and must be copied if it is to be retained.
+func (n *Node) DataValue() ([]byte, error) {
+	if data, ok := n.pval.(cfData); ok {
+		return []byte(data), nil
+	}
+	return nil, n.incompatible(bytesType)
+}
+
+// DateValue returns the value of a date.
+func (n *Node) DateValue() (time.Time, error) {
+	if date, ok := n.pval.(cfDate); ok {
+		return time.Time(date), nil
+	}
+	if s, ok := n.laxString(); ok {
+		t, err := time.Parse(textPlistTimeLayout, s)
+		return t.In(time.UTC), err
+	}
+	return time.Time{}, n.incompatible(timeType)
+}
+
+// UIDValue returns the value of a CoreFoundation Keyed Archiver UID.
+func (n *Node) UIDValue() (UID, error) {
+	if uid, ok := n.pval.(cfUID); ok {
+		return UID(uid), nil
+	}
+	return 0, n.incompatible(uidType)
+}
@@ -1,6 +1,8 @@
 package plist
 
 import (
+	"encoding/hex"
+	"fmt"
 	"reflect"
 )
 
@@ -34,6 +36,15 @@ func (u *unknownTypeError) Error() string {
 	return "plist: can't marshal value of type " + u.typ.String()
 }
 
+type cyclicValueError struct {
+	typ     reflect.Type
+	keypath string
+}
+
+func (e *cyclicValueError) Error() string {
+	return "plist: encountered a cycle via " + e.typ.String() + " at " + e.keypath
+}
+
 type invalidPlistError struct {
 	format string
 	err    error
@@ -60,10 +71,103 @@ func (e plistParseError) Error() string {
 	return s
 }
 
+// A PlistKind represents the type of a value in a property list document,
+// independent of the Go type it might be decoded into.
+type PlistKind int
+
+// Property list value kinds
+const (
+	InvalidKind PlistKind = iota
+	StringKind
+	IntegerKind
+	RealKind
+	BooleanKind
+	DateKind
+	DataKind
+	ArrayKind
+	DictionaryKind
+	UIDKind
+	SetKind
+	URLKind
+	UUIDKind
+)
+
+var kindNames = map[PlistKind]string{
+	InvalidKind:    "invalid",
+	StringKind:     "string",
+	IntegerKind:    "integer",
+	RealKind:       "real",
+	BooleanKind:    "boolean",
+	DateKind:       "date",
+	DataKind:       "data",
+	ArrayKind:      "array",
+	DictionaryKind: "dictionary",
+	UIDKind:        "UID",
+	SetKind:        "set",
+	URLKind:        "URL",
+	UUIDKind:       "UUID",
+}
+
+func (k PlistKind) String() string {
+	if s, ok := kindNames[k]; ok {
+		return s
+	}
+	return kindNames[InvalidKind]
+}
+
 // A UID represents a unique object identifier. UIDs are serialized in a manner distinct from
 // that of integers.
 type UID uint64
 
+// A Set is an unordered collection of values, as stored by the set and ordered set objects
+// of binary property lists. Sets are decoded in the order they appear in the document.
+type Set []interface{}
+
+// A UUID is a universally unique identifier, as stored by the UUID objects of binary property lists.
+type UUID [16]byte
+
+// String returns the UUID in its canonical form, such as 6ba7b810-9dad-11d1-80b4-00c04fd430c8.
+func (u UUID) String() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+// MarshalText implements encoding.TextMarshaler; UUIDs are written as strings to the
+// property list formats that can't store them as UUIDs.
+func (u UUID) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts the canonical form, in either case.
+func (u *UUID) UnmarshalText(text []byte) error {
+	if len(text) != 36 || text[8] != '-' || text[13] != '-' || text[18] != '-' || text[23] != '-' {
+		return fmt.Errorf("plist: invalid UUID %q", text)
+	}
+	var v UUID
+	for _, part := range [...]struct{ dst, src []byte }{
+		{v[0:4], text[0:8]},
+		{v[4:6], text[9:13]},
+		{v[6:8], text[14:18]},
+		{v[8:10], text[19:23]},
+		{v[10:], text[24:]},
+	} {
+		if _, err := hex.Decode(part.dst, part.src); err != nil {
+			return fmt.Errorf("plist: invalid UUID %q", text)
+		}
+	}
+	*u = v
+	return nil
+}
+
 // Marshaler is the interface implemented by types that can marshal themselves into valid
 // property list objects. The returned value is marshaled in place of the original value
 // implementing Marshaler
@@ -81,3 +185,13 @@ type Marshaler interface {
 type Unmarshaler interface {
 	UnmarshalPlist(unmarshal func(interface{}) error) error
 }
+
+// NodeUnmarshaler is the interface implemented by types that need to inspect a property list
+// value before deciding how to unmarshal it. The UnmarshalPlistNode method receives the Node
+// being decoded, which reports the value's kind and can decode it (or any of its elements)
+// into a field or variable.
+//
+// If a type implements both NodeUnmarshaler and Unmarshaler, UnmarshalPlistNode is used.
+type NodeUnmarshaler interface {
+	UnmarshalPlistNode(node *Node) error
+}
@@ -1,7 +1,8 @@
 package plist
 
 import (
-	"hash/crc32"
+	"io"
+	"net/url"
 	"sort"
 	"time"
 	"strconv"
@@ -13,20 +14,38 @@ const cfUIDMagic = "CF$UID"
 
 type cfValue interface {
 	typeName() string
-	hash() interface{}
+	kind() PlistKind
+}
+
+// cfDataReader is data supplied by an io.Reader. It is only ever encoded, and is read
+// as the document is written.
+type cfDataReader struct {
+	reader io.Reader
+}
+
+func (*cfDataReader) typeName() string {
+	return "data"
+}
+
+func (*cfDataReader) kind() PlistKind {
+	return DataKind
 }
 
 type cfDictionary struct {
 	keys   sort.StringSlice
 	values []cfValue
+
+	// keepOrder keeps the keys in the order they were read in, rather than sorting them
+	// when the dictionary is written.
+	keepOrder bool
 }
 
 func (*cfDictionary) typeName() string {
 	return "dictionary"
 }
 
-func (p *cfDictionary) hash() interface{} {
-	return p
+func (*cfDictionary) kind() PlistKind {
+	return DictionaryKind
 }
 
 func (p *cfDictionary) Len() int {
@@ -43,7 +62,9 @@ func (p *cfDictionary) Swap(i, j int) {
 }
 
 func (p *cfDictionary) sort() {
-	sort.Sort(p)
+	if !p.keepOrder {
+		sort.Sort(p)
+	}
 }
 
 func (p *cfDictionary) maybeUID(lax bool) cfValue {
@@ -72,8 +93,8 @@ func (*cfArray) typeName() string {
 	return "array"
 }
 
-func (p *cfArray) hash() interface{} {
-	return p
+func (*cfArray) kind() PlistKind {
+	return ArrayKind
 }
 
 type cfString string
@@ -82,24 +103,22 @@ func (cfString) typeName() string {
 	return "string"
 }
 
-func (p cfString) hash() interface{} {
-	return string(p)
+func (cfString) kind() PlistKind {
+	return StringKind
 }
 
 type cfNumber struct {
 	signed bool
 	value  uint64
+	width  uint8 // the number of bytes the integer was stored in, if it was read from a binary property list
 }
 
 func (*cfNumber) typeName() string {
 	return "integer"
 }
 
-func (p *cfNumber) hash() interface{} {
-	if p.signed {
-		return int64(p.value)
-	}
-	return p.value
+func (*cfNumber) kind() PlistKind {
+	return IntegerKind
 }
 
 type cfReal struct {
@@ -111,11 +130,8 @@ func (cfReal) typeName() string {
 	return "real"
 }
 
-func (p *cfReal) hash() interface{} {
-	if p.wide {
-		return p.value
-	}
-	return float32(p.value)
+func (cfReal) kind() PlistKind {
+	return RealKind
 }
 
 type cfBoolean bool
@@ -124,8 +140,8 @@ func (cfBoolean) typeName() string {
 	return "boolean"
 }
 
-func (p cfBoolean) hash() interface{} {
-	return bool(p)
+func (cfBoolean) kind() PlistKind {
+	return BooleanKind
 }
 
 type cfUID UID
@@ -134,8 +150,8 @@ func (cfUID) typeName() string {
 	return "UID"
 }
 
-func (p cfUID) hash() interface{} {
-	return p
+func (cfUID) kind() PlistKind {
+	return UIDKind
 }
 
 func (p cfUID) toDict() *cfDictionary {
@@ -154,11 +170,8 @@ func (cfData) typeName() string {
 	return "data"
 }
 
-func (p cfData) hash() interface{} {
-	// Data are uniqued by their checksums.
-	// Todo: Look at calculating this only once and storing it somewhere;
-	// crc32 is fairly quick, however.
-	return crc32.ChecksumIEEE([]byte(p))
+func (cfData) kind() PlistKind {
+	return DataKind
 }
 
 type cfDate time.Time
@@ -167,6 +180,68 @@ func (cfDate) typeName() string {
 	return "date"
 }
 
-func (p cfDate) hash() interface{} {
-	return time.Time(p)
+func (cfDate) kind() PlistKind {
+	return DateKind
+}
+
+// cfSet is a set or ordered set, which only binary property lists can store.
+type cfSet struct {
+	values  []cfValue
+	ordered bool
+}
+
+func (*cfSet) typeName() string {
+	return "set"
+}
+
+func (*cfSet) kind() PlistKind {
+	return SetKind
+}
+
+// cfURL is a URL, which is resolved against base (another URL) if there is one.
+type cfURL struct {
+	base *cfURL
+	str  string
+}
+
+func (*cfURL) typeName() string {
+	return "URL"
+}
+
+func (*cfURL) kind() PlistKind {
+	return URLKind
+}
+
+// resolve parses the URL, along with any base it has.
+func (p *cfURL) resolve() (*url.URL, error) {
+	ref, err := url.Parse(p.str)
+	if err != nil || p.base == nil {
+		return ref, err
+	}
+	base, err := p.base.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(ref), nil
+}
+
+type cfUUID UUID
+
+func (cfUUID) typeName() string {
+	return "UUID"
+}
+
+func (cfUUID) kind() PlistKind {
+	return UUIDKind
+}
+
+// cfNull is an explicit nil. It is only ever encoded; decoded nulls are nil, like any missing value.
+type cfNull struct{}
+
+func (cfNull) typeName() string {
+	return "null"
+}
+
+func (cfNull) kind() PlistKind {
+	return InvalidKind
 }
@@ -0,0 +1,397 @@
+package plist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+// A SizeReport attributes the bytes of an encoded property list to the values in it.
+type SizeReport struct {
+	Format int   // the format the document was encoded in
+	Total  int64 // the size of the encoded document
+
+	// Overhead is the number of bytes that belong to no value: the header and trailer of
+	// a binary property list, or the XML declaration and plist element of an XML one.
+	Overhead int64
+
+	// Values holds every value in the document, in the order it is encoded in.
+	Values []ValueSize
+
+	// Types holds the number of bytes taken by each type of value (named as in ValueSize),
+	// not counting the values inside containers. The bytes taken by dictionary keys are
+	// counted as "key". Overhead and the totals for every type add up to Total.
+	Types map[string]int64
+}
+
+// A ValueSize is the number of bytes taken by one value in an encoded property list.
+type ValueSize struct {
+	// Keypath is where the value is, in the form reported by Node.Keypath.
+	Keypath string
+
+	// Type is the type of the value, such as "dictionary", "string" or "integer".
+	Type string
+
+	// Size is the number of bytes taken by the value, everything inside it, and its key
+	// if it is in a dictionary. In a binary property list, it includes the value's entry
+	// in the offset table; an object that is shared by several values is counted only
+	// in the first of them, so the others may be very small.
+	Size int64
+}
+
+// MeasureSize encodes v as Marshal would in the given format, and reports how many bytes
+// of the encoded document each value in it takes. The binary, XML, OpenStep and GNUStep
+// formats can be measured; the automatic format is measured as binary.
+//
+// The sizes in a text format are found by encoding each value on its own, without
+// indentation. The separators between the elements of an array are counted as part of
+// the array rather than as part of its elements.
+func MeasureSize(v interface{}, format int) (report *SizeReport, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	enc := &Encoder{format: format}
+	pval := enc.marshal(reflect.ValueOf(v))
+	if pval == nil {
+		return nil, errors.New("plist: no root element to measure")
+	}
+
+	report = &SizeReport{Format: format, Types: make(map[string]int64)}
+	switch format {
+	case BinaryFormat, AutomaticFormat:
+		report.Format = BinaryFormat
+		buf := &bytes.Buffer{}
+		newBplistGenerator(buf).generateDocument(pval)
+		report.measureBinary(buf.Bytes())
+	case XMLFormat, OpenStepFormat, GNUStepFormat:
+		// Each value is encoded more than once; data from a reader can only be read once.
+		pval = readDataReaders(pval)
+		var total sizeCounter
+		if format == XMLFormat {
+			newXMLPlistGenerator(&total).generateDocument(pval)
+		} else {
+			newTextPlistGenerator(&total, format).generateDocument(pval)
+		}
+		report.Total = int64(total)
+		report.measureText(pval)
+	default:
+		return nil, fmt.Errorf("plist: can't measure the size of documents in format %d", format)
+	}
+	return report, nil
+}
+
+// MeasureDocument reports how many bytes of doc, a property list in any format, each value
+// in it takes. A binary property list is measured object by object, as it is. In an XML or
+// text property list, each value is measured as MeasureSize would measure it, keeping the
+// order of the keys in doc; whatever else doc holds, such as whitespace and comments, is
+// counted as overhead.
+//
+// To measure a document in another format, convert it (with Convert) first.
+func MeasureDocument(doc []byte) (report *SizeReport, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	if bytes.HasPrefix(doc, []byte("bplist")) {
+		report = &SizeReport{Format: BinaryFormat, Types: make(map[string]int64)}
+		report.measureBinary(doc)
+		return report, nil
+	}
+
+	dec := &Decoder{}
+	pval, err := dec.parseDocument(doc, reflect.Value{})
+	if err != nil {
+		return nil, err
+	}
+	keepOrder(pval)
+	report = &SizeReport{Format: dec.Format, Total: int64(len(doc)), Types: make(map[string]int64)}
+	report.measureText(pval)
+	return report, nil
+}
+
+// Heaviest returns the n values that take the most bytes, heaviest first, leaving out
+// the top-level value (which takes every byte but the overhead).
+func (r *SizeReport) Heaviest(n int) []ValueSize {
+	values := make([]ValueSize, 0, len(r.Values))
+	for _, v := range r.Values {
+		if v.Keypath != "/" {
+			values = append(values, v)
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Size > values[j].Size })
+	if n < len(values) {
+		values = values[:n]
+	}
+	return values
+}
+
+// sizeCounter is an io.Writer that counts the bytes written to it.
+type sizeCounter int64
+
+func (c *sizeCounter) Write(p []byte) (int, error) {
+	*c += sizeCounter(len(p))
+	return len(p), nil
+}
+
+// addValue adds a value at kp to the report, and returns its index.
+func (r *SizeReport) addValue(kp keypath, typ string) int {
+	r.Values = append(r.Values, ValueSize{Keypath: kp.String(), Type: typ})
+	return len(r.Values) - 1
+}
+
+// measureBinary attributes every object in the binary property list doc to the first
+// value, in the order they are encoded, that refers to it.
+func (r *SizeReport) measureBinary(doc []byte) {
+	p := &bplistParser{readerAt: bytes.NewReader(doc), lazyObjects: make(map[uint64]cfValue)}
+	if err := p.openLazily(int64(len(doc))); err != nil {
+		panic(err)
+	}
+	t := p.trailer
+
+	// An object runs up to the one after it, or to the offset table.
+	offsets := make([]offset, t.NumObjects)
+	for id := range offsets {
+		offsets[id] = p.offsetForObject(uint64(id))
+	}
+	sorted := append([]offset(nil), offsets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	end := func(off offset) offset {
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i] > off })
+		if i == len(sorted) {
+			return offset(t.OffsetTableOffset)
+		}
+		return sorted[i]
+	}
+
+	counted := make([]bool, t.NumObjects)
+	cost := func(id uint64) int64 {
+		if id >= t.NumObjects {
+			panic(fmt.Errorf("invalid object#%d (max %d)", id, t.NumObjects))
+		}
+		if counted[id] {
+			return 0
+		}
+		counted[id] = true
+		off := offsets[id]
+		return int64(end(off)-off) + int64(t.OffsetIntSize)
+	}
+
+	// whole returns the bytes of an object and everything it refers to that haven't been counted yet.
+	var whole func(id uint64) int64
+	whole = func(id uint64) int64 {
+		if id >= t.NumObjects {
+			panic(fmt.Errorf("invalid object#%d (max %d)", id, t.NumObjects))
+		}
+		if counted[id] {
+			return 0
+		}
+		n := cost(id)
+		refs, _ := p.objectRefsAtOffset(offsets[id])
+		for _, ref := range refs {
+			n += whole(ref)
+		}
+		return n
+	}
+
+	var kp keypath
+	var value func(id uint64, key int64) int64
+	value = func(id uint64, key int64) int64 {
+		if id >= t.NumObjects {
+			panic(fmt.Errorf("invalid object#%d (max %d)", id, t.NumObjects))
+		}
+		off := offsets[id]
+		tag := p.bytesAt(off, 1)[0]
+
+		var typ string
+		switch tag & 0xF0 {
+		case bpTagDictionary:
+			typ = "dictionary"
+		case bpTagArray:
+			typ = "array"
+		case bpTagSet, bpTagOrderedSet:
+			typ = "set"
+		default:
+			if tag == bpTagURL || tag == bpTagURLWithBase {
+				typ = "URL"
+			} else if pval := p.parseTagAtOffset(off); pval != nil {
+				typ = pval.typeName()
+			} else {
+				typ = "null"
+			}
+		}
+		i := r.addValue(kp, typ)
+
+		first := !counted[id]
+		own := cost(id)
+		size := own + key
+		if first {
+			refs, _ := p.objectRefsAtOffset(off)
+			switch tag & 0xF0 {
+			case bpTagDictionary:
+				n := len(refs) / 2
+				for j, kid := range refs[:n] {
+					k, ok := p.objectAtIndex(kid).(cfString)
+					if !ok {
+						panic(fmt.Errorf("dictionary@0x%x contains non-string key at index %d", off, j))
+					}
+					kp.pushKey(string(k))
+					keySize := cost(kid)
+					r.Types["key"] += keySize
+					size += value(refs[n+j], keySize)
+					kp.pop()
+				}
+			case bpTagArray, bpTagSet, bpTagOrderedSet:
+				for j, ref := range refs {
+					kp.pushIndex(j)
+					size += value(ref, 0)
+					kp.pop()
+				}
+			default:
+				// A URL's base and string are part of it.
+				for _, ref := range refs {
+					n := whole(ref)
+					own += n
+					size += n
+				}
+			}
+		}
+		r.Types[typ] += own
+		r.Values[i].Size = size
+		return size
+	}
+
+	r.Total = int64(len(doc))
+	r.Overhead = r.Total - value(t.TopObject, 0)
+}
+
+// measureText attributes the bytes of a text or XML property list to the values in it.
+//
+// Written without indentation, a container takes the same bytes around its contents whatever
+// they are, so each value is encoded only once: a container's size is that of a copy with a
+// placeholder for each of its values, with the placeholders swapped for the values' own sizes.
+func (r *SizeReport) measureText(root cfValue) {
+	size := func(pval cfValue) int64 {
+		var n sizeCounter
+		if r.Format == XMLFormat {
+			g := newXMLPlistGenerator(&n)
+			g.writePlistValue(pval)
+			if err := g.Flush(); err != nil {
+				panic(err)
+			}
+		} else {
+			newTextPlistGenerator(&n, r.Format).writePlistValue(pval)
+		}
+		return int64(n)
+	}
+	placeholder := cfString("")
+	placeholderSize := size(placeholder)
+	emptyDictionary := size(&cfDictionary{})
+	element := size(&cfArray{[]cfValue{placeholder}}) - size(&cfArray{}) - placeholderSize
+
+	var kp keypath
+	// value measures pval, which takes key bytes for its dictionary key and another
+	// separator bytes of its own in the container around it.
+	var value func(pval cfValue, key, separator int64) int64
+	value = func(pval cfValue, key, separator int64) int64 {
+		typ := pval.typeName()
+		i := r.addValue(kp, typ)
+
+		own, contents := separator, int64(0)
+		switch pval := pval.(type) {
+		case *cfDictionary:
+			pval.sort()
+			skeleton := &cfDictionary{keepOrder: true}
+			for j, k := range pval.keys {
+				if pval.values[j] != nil {
+					skeleton.keys = append(skeleton.keys, k)
+					skeleton.values = append(skeleton.values, placeholder)
+				}
+			}
+			own += size(skeleton) - int64(len(skeleton.keys))*placeholderSize
+
+			for j, k := range pval.keys {
+				v := pval.values[j]
+				if v == nil {
+					continue
+				}
+				keySize := size(&cfDictionary{keys: []string{k}, values: []cfValue{placeholder}}) - emptyDictionary - placeholderSize
+				r.Types["key"] += keySize
+				own -= keySize
+				kp.pushKey(k)
+				contents += value(v, keySize, 0)
+				kp.pop()
+			}
+		case *cfArray:
+			skeleton := &cfArray{}
+			for j, v := range pval.values {
+				if v == nil {
+					continue
+				}
+				skeleton.values = append(skeleton.values, placeholder)
+				kp.pushIndex(j)
+				contents += value(v, 0, element)
+				kp.pop()
+			}
+			own += size(skeleton) - int64(len(skeleton.values))*(placeholderSize+element)
+		default:
+			own += size(pval)
+		}
+
+		r.Types[typ] += own
+		r.Values[i].Size = key + own + contents
+		return r.Values[i].Size
+	}
+
+	r.Overhead = r.Total - value(root, 0, 0)
+}
+
+// keepOrder marks every dictionary in pval to keep its keys in the order they were read in.
+func keepOrder(pval cfValue) {
+	switch pval := pval.(type) {
+	case *cfDictionary:
+		pval.keepOrder = true
+		for _, v := range pval.values {
+			keepOrder(v)
+		}
+	case *cfArray:
+		for _, v := range pval.values {
+			keepOrder(v)
+		}
+	}
+}
+
+// readDataReaders returns pval with the data from every reader in it read into memory.
+func readDataReaders(pval cfValue) cfValue {
+	switch pval := pval.(type) {
+	case *cfDataReader:
+		data, err := ioutil.ReadAll(pval.reader)
+		if err != nil {
+			panic(err)
+		}
+		return cfData(data)
+	case *cfDictionary:
+		for i, v := range pval.values {
+			pval.values[i] = readDataReaders(v)
+		}
+	case *cfArray:
+		for i, v := range pval.values {
+			pval.values[i] = readDataReaders(v)
+		}
+	}
+	return pval
+}
@@ -0,0 +1,168 @@
+package plist
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeasureSize(t *testing.T) {
+	doc := map[string]interface{}{
+		"Blob":  make([]byte, 1000),
+		"Names": []string{"a", "b", "a"},
+		"Info":  map[string]interface{}{"Count": 3, "Reader": bytes.NewReader([]byte{1, 2, 3})},
+	}
+
+	for _, format := range []int{BinaryFormat, XMLFormat, OpenStepFormat, GNUStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			doc["Info"].(map[string]interface{})["Reader"] = bytes.NewReader([]byte{1, 2, 3})
+			report, err := MeasureSize(doc, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			doc["Info"].(map[string]interface{})["Reader"] = bytes.NewReader([]byte{1, 2, 3})
+			encoded, err := Marshal(doc, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Total != int64(len(encoded)) {
+				t.Errorf("expected a total of %d bytes, got %d", len(encoded), report.Total)
+			}
+
+			sum := report.Overhead
+			for _, n := range report.Types {
+				sum += n
+			}
+			if sum != report.Total {
+				t.Errorf("types and overhead add up to %d bytes, not %d: %v", sum, report.Total, report.Types)
+			}
+
+			sizes := make(map[string]ValueSize)
+			for _, v := range report.Values {
+				sizes[v.Keypath] = v
+			}
+			if top := sizes["/"]; top.Type != "dictionary" || top.Size != report.Total-report.Overhead {
+				t.Errorf("unexpected top-level value %v", top)
+			}
+			if sizes["/Info/Count"].Type != "integer" || sizes["/Info/Reader"].Type != "data" {
+				t.Errorf("unexpected values %v", report.Values)
+			}
+			if names := sizes["/Names"]; names.Size <= sizes["/Names[0]"].Size+sizes["/Names[1]"].Size+sizes["/Names[2]"].Size {
+				t.Errorf("/Names is no bigger than its elements: %v", report.Values)
+			}
+
+			heaviest := report.Heaviest(2)
+			if len(heaviest) != 2 || heaviest[0].Keypath != "/Blob" || heaviest[0].Size < 1000 || heaviest[1].Size > heaviest[0].Size {
+				t.Errorf("unexpected heaviest values %v", heaviest)
+			}
+
+			// "a" is written once in a binary property list, and counted the first time it appears.
+			if format == BinaryFormat && (sizes["/Names[0]"].Size == 0 || sizes["/Names[2]"].Size != 0) {
+				t.Errorf("expected the shared string to be counted once, got %v and %v", sizes["/Names[0]"], sizes["/Names[2]"])
+			}
+		})
+	}
+
+	if _, err := MeasureSize(doc, 99); err == nil {
+		t.Error("expected an error measuring an unknown format")
+	}
+	if _, err := MeasureSize(nil, BinaryFormat); err == nil {
+		t.Error("expected an error measuring nothing")
+	}
+}
+
+func TestMeasureDocument(t *testing.T) {
+	doc := map[string]interface{}{
+		"Blob":  make([]byte, 100),
+		"Names": []string{"a", "b", "a"},
+		"Info":  map[string]interface{}{"Count": 3, "When": time.Date(2013, 11, 27, 0, 34, 0, 0, time.UTC)},
+	}
+
+	for _, format := range []int{BinaryFormat, XMLFormat, OpenStepFormat, GNUStepFormat} {
+		subtest(t, FormatNames[format], func(t *testing.T) {
+			expected, err := MeasureSize(doc, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := Marshal(doc, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := MeasureDocument(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format == OpenStepFormat && len(report.Values) == len(expected.Values) {
+				// An OpenStep property list can only hold strings.
+				for i := range expected.Values {
+					expected.Values[i].Type = report.Values[i].Type
+				}
+				expected.Types = report.Types
+			}
+			if !reflect.DeepEqual(report, expected) {
+				t.Errorf("expected %+v, got %+v", expected, report)
+			}
+
+			if format == BinaryFormat {
+				return
+			}
+			indented, err := MarshalIndent(doc, format, "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err = MeasureDocument(indented)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report.Values, expected.Values) || report.Overhead != expected.Overhead+int64(len(indented)-len(encoded)) {
+				t.Errorf("expected the indentation to be counted as overhead, got %+v", report)
+			}
+		})
+	}
+
+	report, err := MeasureDocument([]byte(`{b = 1; a = (x, y);}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keypaths []string
+	for _, v := range report.Values {
+		keypaths = append(keypaths, v.Keypath)
+	}
+	if expected := []string{"/", "/b", "/a", "/a[0]", "/a[1]"}; !reflect.DeepEqual(keypaths, expected) {
+		t.Errorf("expected the keys in document order %v, got %v", expected, keypaths)
+	}
+
+	if _, err := MeasureDocument([]byte("{a = ")); err == nil {
+		t.Error("expected an error measuring an invalid document")
+	}
+
+	// A URL whose string is object#5, in a document of one object.
+	badURL := append([]byte("bplist00"), 0x0C, 0x05, 0x08)
+	badURL = append(badURL, 0, 0, 0, 0, 0, 0, 1, 1)
+	badURL = append(badURL, 0, 0, 0, 0, 0, 0, 0, 1)
+	badURL = append(badURL, 0, 0, 0, 0, 0, 0, 0, 0)
+	badURL = append(badURL, 0, 0, 0, 0, 0, 0, 0, 10)
+	if _, err := MeasureDocument(badURL); err == nil || !strings.Contains(err.Error(), "invalid object#5") {
+		t.Errorf("expected an invalid object error measuring a URL with a bad reference, got %v", err)
+	}
+}
+
+func TestMeasureSizeDeep(t *testing.T) {
+	const depth = 4000
+	doc := strings.Repeat("<array>", depth) + "<string>x</string>" + strings.Repeat("</array>", depth)
+	report, err := MeasureDocument([]byte("<plist>" + doc + "</plist>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Values) != depth+1 {
+		t.Fatalf("expected %d values, got %d", depth+1, len(report.Values))
+	}
+	for i, v := range report.Values[:depth] {
+		if expected := int64(len(doc) - i*len("<array></array>")); v.Size != expected {
+			t.Fatalf("%s: expected %d bytes, got %d", v.Keypath, expected, v.Size)
+		}
+	}
+}
@@ -168,25 +168,13 @@ func (p *textPlistGenerator) writePlistValue(pval cfValue) {
 			}
 		}
 	case cfData:
-		var hexencoded [9]byte
-		var l int
-		var asc = 9
-		hexencoded[8] = ' '
-
 		p.writer.Write([]byte(`<`))
-		b := []byte(pval)
-		for i := 0; i < len(b); i += 4 {
-			l = i + 4
-			if l >= len(b) {
-				l = len(b)
-				// We no longer need the space - or the rest of the buffer.
-				// (we used >= above to get this part without another conditional :P)
-				asc = (l - i) * 2
-			}
-			// Fill the buffer (only up to 8 characters, to preserve the space we implicitly include
-			// at the end of every encode)
-			hex.Encode(hexencoded[:8], b[i:l])
-			io.WriteString(p.writer, string(hexencoded[:asc]))
+		(&textDataWriter{w: p.writer}).Write([]byte(pval))
+		p.writer.Write([]byte(`>`))
+	case *cfDataReader:
+		p.writer.Write([]byte(`<`))
+		if _, err := io.Copy(&textDataWriter{w: p.writer}, pval.reader); err != nil {
+			panic(err)
 		}
 		p.writer.Write([]byte(`>`))
 	case cfDate:
@@ -202,6 +190,94 @@ func (p *textPlistGenerator) writePlistValue(pval cfValue) {
 	}
 }
 
+// textDataWriter hex-encodes data for a text property list, with a space between every
+// group of four bytes.
+type textDataWriter struct {
+	w io.Writer
+	n int // bytes written so far
+}
+
+func (t *textDataWriter) Write(b []byte) (int, error) {
+	var hexencoded [9]byte
+	hexencoded[0] = ' '
+	n := len(b)
+	for len(b) > 0 {
+		// Finish the current group of four bytes, or start a new one after a space.
+		group := 4 - t.n%4
+		if group > len(b) {
+			group = len(b)
+		}
+		l := hex.Encode(hexencoded[1:], b[:group])
+		if t.n > 0 && t.n%4 == 0 {
+			t.w.Write(hexencoded[:1+l])
+		} else {
+			t.w.Write(hexencoded[1 : 1+l])
+		}
+		t.n += group
+		b = b[group:]
+	}
+	return n, nil
+}
+
+// startValue and endValue surround each value written by a StreamEncoder with the
+// indentation and delimiter that its container calls for.
+func (p *textPlistGenerator) startValue(parent PlistKind) {
+	if parent == ArrayKind {
+		p.writeIndent()
+	}
+}
+
+func (p *textPlistGenerator) endValue(parent PlistKind) {
+	switch parent {
+	case DictionaryKind:
+		p.writer.Write(p.dictEntryDelimiter)
+	case ArrayKind:
+		p.writer.Write(p.arrayDelimiter)
+	}
+}
+
+func (p *textPlistGenerator) startDocument() {}
+
+func (p *textPlistGenerator) startDictionary(parent PlistKind) {
+	p.startValue(parent)
+	p.writer.Write([]byte(`{`))
+	p.deltaIndent(1)
+}
+
+func (p *textPlistGenerator) writeKey(key string) {
+	p.writeIndent()
+	io.WriteString(p.writer, p.plistQuotedString(key))
+	p.writer.Write(p.dictKvDelimiter)
+}
+
+func (p *textPlistGenerator) endDictionary(parent PlistKind) {
+	p.deltaIndent(-1)
+	p.writeIndent()
+	p.writer.Write([]byte(`}`))
+	p.endValue(parent)
+}
+
+func (p *textPlistGenerator) startArray(parent PlistKind) {
+	p.startValue(parent)
+	p.writer.Write([]byte(`(`))
+	p.deltaIndent(1)
+}
+
+func (p *textPlistGenerator) endArray(parent PlistKind) {
+	p.deltaIndent(-1)
+	p.writeIndent()
+	p.writer.Write([]byte(`)`))
+	p.endValue(parent)
+}
+
+func (p *textPlistGenerator) writeValue(parent PlistKind, pval cfValue) {
+	p.startValue(parent)
+	p.writePlistValue(pval)
+	p.endValue(parent)
+}
+
+func (p *textPlistGenerator) endDocument() {}
+
 func (p *textPlistGenerator) Indent(i string) {
 	p.indent = i
 	if i == "" {
@@ -212,6 +288,11 @@ func (p *textPlistGenerator) Indent(i string) {
 	}
 }
 
+func (p *textPlistGenerator) reset(w io.Writer) {
+	p.writer = mustWriter{w}
+	p.depth = 0
+}
+
 func newTextPlistGenerator(w io.Writer, format int) *textPlistGenerator {
 	table := &osQuotable
 	if format == GNUStepFormat {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"reflect"
 	"runtime"
 	"strings"
 	"time"
@@ -15,6 +16,7 @@ import (
 
 type textPlistParser struct {
 	reader io.Reader
+	buffer []byte // the raw document, when it has already been read
 	format int
 
 	input string
@@ -72,16 +74,70 @@ func (p *textPlistParser) parseDocument() (pval cfValue, parseError error) {
 		}
 	}()
 
-	buffer, err := ioutil.ReadAll(p.reader)
-	if err != nil {
-		panic(err)
+	p.readInput()
+	pval = p.parseTopLevelValue()
+	return
+}
+
+// decodeDocument parses the document in a single pass, storing it into val as it goes.
+func (p *textPlistParser) decodeDocument(dec *Decoder, val reflect.Value) (parseError error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			parseError = unwrapStreamError(r, "text")
+		}
+	}()
+
+	p.readInput()
+
+	if strings.Contains(p.input, "<*") {
+		// A GNUStep-typed value anywhere makes this a GNUStep document, which is decoded
+		// without OpenStep's lax conversions. Until the whole document has been read, it
+		// isn't known which applies, so it is parsed before any of it is decoded.
+		pval := p.parseTopLevelValue()
+		dec.lax = p.format == OpenStepFormat
+		dec.unmarshalStreamed(pval, val)
+		return
+	}
+
+	// OpenStep property lists can only store strings, so they are decoded in lax mode.
+	dec.lax = true
+
+	p.skipWhitespaceAndComments()
+	switch p.peek() {
+	case '{', '(':
+		p.decodePlistValue(dec, val)
+
+		p.skipWhitespaceAndComments()
+		if p.peek() != eof {
+			p.error("garbage after end of document")
+		}
+	default:
+		// A document that does not start with a container may be a strings file,
+		// which can only be told apart from a lone string by parsing past it.
+		dec.unmarshalStreamed(p.parseTopLevelValue(), val)
+	}
+	return
+}
+
+func (p *textPlistParser) readInput() {
+	var err error
+	buffer := p.buffer
+	if p.reader != nil {
+		if buffer, err = ioutil.ReadAll(p.reader); err != nil {
+			panic(err)
+		}
 	}
 
 	p.input, err = guessEncodingAndConvert(buffer)
 	if err != nil {
 		panic(err)
 	}
+}
 
+func (p *textPlistParser) parseTopLevelValue() cfValue {
 	val := p.parsePlistValue()
 
 	p.skipWhitespaceAndComments()
@@ -95,9 +151,7 @@ func (p *textPlistParser) parseDocument() (pval cfValue, parseError error) {
 		val = p.parseDictionary(true)
 	}
 
-	pval = val
-
-	return
+	return val
 }
 
 const eof rune = -1
@@ -480,6 +534,72 @@ func (p *textPlistParser) parseHexData() cfData {
 	}
 }
 
+// scanHexData checks the hex digits of a data value, without decoding them, and returns
+// their text. The < has already been consumed.
+func (p *textPlistParser) scanHexData() string {
+	p.ignore()
+	c := 0
+	for {
+		r := p.next()
+		switch {
+		case r == eof:
+			p.error("unexpected eof in data")
+		case r == '>':
+			if c&1 == 1 {
+				p.error("uneven number of hex digits in data")
+			}
+			text := p.input[p.start : p.pos-1]
+			p.ignore()
+			return text
+		case r == ' ', r == '\t', r == '\n', r == '\r', r == '\u2028', r == '\u2029':
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'f', r >= 'A' && r <= 'F':
+			c++
+		default:
+			p.error("unexpected hex digit `%c'", r)
+		}
+	}
+}
+
+// textDataReader decodes the hex digits of a data value, already checked by scanHexData,
+// as it is read. Anything that isn't a hex digit is skipped.
+type textDataReader struct {
+	text string
+	high byte // the first digit of a byte whose second is still to come
+	half bool
+}
+
+func (r *textDataReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) && len(r.text) > 0 {
+		c := r.text[0]
+		r.text = r.text[1:]
+
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = 10 + c - 'a'
+		case c >= 'A' && c <= 'F':
+			v = 10 + c - 'A'
+		default:
+			continue
+		}
+
+		if r.half {
+			b[n] = r.high<<4 | v
+			n++
+		} else {
+			r.high = v
+		}
+		r.half = !r.half
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
 func (p *textPlistParser) parsePlistValue() cfValue {
 	for {
 		p.skipWhitespaceAndComments()
@@ -508,9 +628,211 @@ func (p *textPlistParser) parsePlistValue() cfValue {
 	}
 }
 
+// decodePlistValue parses a value in a single pass, storing it into val as it goes.
+func (p *textPlistParser) decodePlistValue(dec *Decoder, val reflect.Value) {
+	p.skipWhitespaceAndComments()
+
+	switch p.peek() {
+	case '{':
+		if target, ok := dec.streamTarget(val, DictionaryKind); ok {
+			p.next()
+			p.decodeDictionary(dec, target)
+			return
+		}
+	case '(':
+		if target, ok := dec.streamTarget(val, ArrayKind); ok {
+			p.next()
+			p.decodeArray(dec, target)
+			return
+		}
+	case '<':
+		if strings.HasPrefix(p.input[p.pos:], "<*") {
+			break
+		}
+		if target, ok := dec.readerTarget(val); ok {
+			p.next()
+			target.Set(reflect.ValueOf(&textDataReader{text: p.scanHexData()}))
+			return
+		}
+	}
+	dec.unmarshalStreamed(p.parsePlistValue(), val)
+}
+
+// the { has already been consumed
+func (p *textPlistParser) decodeDictionary(dec *Decoder, val reflect.Value) {
+	d := newStreamDictionary(dec, val)
+	for {
+		p.skipWhitespaceAndComments()
+
+		var key cfString
+		switch p.next() {
+		case eof:
+			p.error("unexpected eof in dictionary")
+		case '}':
+			d.finish()
+			return
+		case '"':
+			key = p.parseQuotedString()
+		default:
+			p.backup()
+			key = p.parseUnquotedString()
+		}
+
+		p.skipWhitespaceAndComments()
+
+		entry, wanted := d.entry(string(key))
+		n := p.next()
+		if n == ';' {
+			if wanted {
+				dec.unmarshalStreamed(key, entry)
+			}
+		} else if n == '=' {
+			if wanted {
+				p.decodePlistValue(dec, entry)
+			} else {
+				p.skipPlistValue()
+			}
+
+			p.skipWhitespaceAndComments()
+
+			if p.next() != ';' {
+				p.error("missing ; in dictionary")
+			}
+		} else {
+			p.error("missing = in dictionary")
+		}
+		d.store()
+	}
+}
+
+// the ( has already been consumed
+func (p *textPlistParser) decodeArray(dec *Decoder, val reflect.Value) {
+	a := newStreamArray(dec, val)
+	for {
+		p.skipWhitespaceAndComments()
+
+		switch p.next() {
+		case eof:
+			p.error("unexpected eof in array")
+		case ')':
+			a.finish()
+			return
+		case ',':
+			continue
+		default:
+			p.backup()
+		}
+
+		if strings.HasPrefix(p.input[p.pos:], `""`) {
+			// Empty strings in arrays are skipped; see parseArray.
+			p.pos += 2
+			p.ignore()
+			continue
+		}
+		if elem, ok := a.next(); ok {
+			p.decodePlistValue(dec, elem)
+			a.store()
+		} else {
+			p.skipPlistValue()
+		}
+	}
+}
+
+// skipPlistValue consumes a value without building it.
+func (p *textPlistParser) skipPlistValue() {
+	p.skipWhitespaceAndComments()
+
+	switch p.next() {
+	case eof:
+		return
+	case '<':
+		if p.next() == '*' {
+			p.format = GNUStepFormat
+			p.parseGNUStepValue()
+			return
+		}
+
+		p.backup()
+		p.parseHexData()
+	case '"':
+		p.skipQuotedString()
+	case '{':
+		for {
+			p.skipWhitespaceAndComments()
+
+			switch p.next() {
+			case eof:
+				p.error("unexpected eof in dictionary")
+			case '}':
+				return
+			case '"':
+				p.skipQuotedString()
+			default:
+				p.backup()
+				p.parseUnquotedString()
+			}
+
+			p.skipWhitespaceAndComments()
+
+			n := p.next()
+			if n == '=' {
+				p.skipPlistValue()
+
+				p.skipWhitespaceAndComments()
+
+				if p.next() != ';' {
+					p.error("missing ; in dictionary")
+				}
+			} else if n != ';' {
+				p.error("missing = in dictionary")
+			}
+		}
+	case '(':
+		for {
+			p.skipWhitespaceAndComments()
+
+			switch p.next() {
+			case eof:
+				p.error("unexpected eof in array")
+			case ')':
+				return
+			case ',':
+				continue
+			default:
+				p.backup()
+			}
+			p.skipPlistValue()
+		}
+	default:
+		p.backup()
+		p.parseUnquotedString()
+	}
+}
+
+// the " has already been consumed
+func (p *textPlistParser) skipQuotedString() {
+	for {
+		p.scanUntilAny(`"\`)
+		switch p.next() {
+		case eof:
+			p.error("unexpected eof in quoted string")
+		case '"':
+			p.ignore()
+			return
+		case '\\':
+			p.next() // whatever follows cannot end the string
+		}
+	}
+}
+
 func newTextPlistParser(r io.Reader) *textPlistParser {
 	return &textPlistParser{
 		reader: r,
 		format: OpenStepFormat,
 	}
 }
+
+// reset prepares the parser to parse the document in buffer, which has already been read.
+func (p *textPlistParser) reset(buffer []byte) {
+	*p = textPlistParser{buffer: buffer, format: OpenStepFormat}
+}
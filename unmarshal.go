@@ -1,8 +1,10 @@
 package plist
 
 import (
+	"bytes"
 	"encoding"
 	"fmt"
+	"net/url"
 	"reflect"
 	"runtime"
 	"time"
@@ -20,7 +22,12 @@ func (u *incompatibleDecodeTypeError) Error() string {
 var (
 	plistUnmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
 	textUnmarshalerType  = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	binUnmarshalerType   = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
 	uidType              = reflect.TypeOf(UID(0))
+	uuidType             = reflect.TypeOf(UUID{})
+	urlType              = reflect.TypeOf(url.URL{})
+	interfaceSliceType   = reflect.TypeOf([]interface{}(nil))
+	interfaceMapType     = reflect.TypeOf(map[string]interface{}(nil))
 )
 
 func isEmptyInterface(v reflect.Value) bool {
@@ -53,6 +60,13 @@ func (p *Decoder) unmarshalTextInterface(pval cfString, unmarshalable encoding.T
 	}
 }
 
+func (p *Decoder) unmarshalBinaryInterface(pval cfData, unmarshalable encoding.BinaryUnmarshaler) {
+	err := unmarshalable.UnmarshalBinary([]byte(pval))
+	if err != nil {
+		panic(err)
+	}
+}
+
 func (p *Decoder) unmarshalTime(pval cfDate, val reflect.Value) {
 	val.Set(reflect.ValueOf(time.Time(pval)))
 }
@@ -95,19 +109,36 @@ func (p *Decoder) unmarshal(pval cfValue, val reflect.Value) {
 		return
 	}
 
-	if val.Kind() == reflect.Ptr {
+	for val.Kind() == reflect.Ptr {
 		if val.IsNil() {
+			if shared, ok := p.sharedValue(pval, val.Type()); ok {
+				val.Set(shared)
+				return
+			}
 			val.Set(reflect.New(val.Type().Elem()))
+			p.recordSharedValue(pval, val)
 		}
 		val = val.Elem()
 	}
 
+	if len(p.hooks) > 0 {
+		var done bool
+		if pval, done = p.runDecodeHooks(pval, val); done {
+			return
+		}
+	}
+
 	if isEmptyInterface(val) {
 		v := p.valueInterface(pval)
 		val.Set(reflect.ValueOf(v))
 		return
 	}
 
+	if receiver, can := implementsInterface(val, nodeUnmarshalerType); can {
+		p.unmarshalNodeInterface(pval, receiver.(NodeUnmarshaler))
+		return
+	}
+
 	incompatibleTypeError := &incompatibleDecodeTypeError{val.Type(), pval.typeName()}
 
 	// time.Time implements TextMarshaler, but we need to parse it as RFC3339
@@ -124,6 +155,32 @@ func (p *Decoder) unmarshal(pval cfValue, val reflect.Value) {
 		return
 	}
 
+	// UUIDs and URLs are stored in their own types, or anywhere a string can be.
+	switch pval := pval.(type) {
+	case cfUUID:
+		if val.Type() == uuidType {
+			val.Set(reflect.ValueOf(UUID(pval)))
+		} else {
+			p.unmarshalAsString(UUID(pval).String(), val, incompatibleTypeError)
+		}
+		return
+	case *cfURL:
+		u := p.resolveURL(pval)
+		if val.Type() == urlType {
+			val.Set(reflect.ValueOf(*u))
+		} else {
+			p.unmarshalAsString(u.String(), val, incompatibleTypeError)
+		}
+		return
+	}
+
+	if data, ok := pval.(cfData); ok && val.Type() != timeType {
+		if receiver, can := implementsInterface(val, binUnmarshalerType); can {
+			p.unmarshalBinaryInterface(data, receiver.(encoding.BinaryUnmarshaler))
+			return
+		}
+	}
+
 	if val.Type() != timeType {
 		if receiver, can := implementsInterface(val, textUnmarshalerType); can {
 			if str, ok := pval.(cfString); ok {
@@ -174,6 +231,8 @@ func (p *Decoder) unmarshal(pval cfValue, val reflect.Value) {
 	case cfData:
 		if val.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
 			val.SetBytes([]byte(pval))
+		} else if typ == readerType {
+			val.Set(reflect.ValueOf(bytes.NewReader(pval)))
 		} else {
 			panic(incompatibleTypeError)
 		}
@@ -192,14 +251,142 @@ func (p *Decoder) unmarshal(pval cfValue, val reflect.Value) {
 		}
 	case *cfArray:
 		p.unmarshalArray(pval, val)
+	case *cfSet:
+		// Sets decode like arrays, but each one is decoded afresh.
+		if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+			panic(incompatibleTypeError)
+		}
+		p.unmarshalArray(&cfArray{pval.values}, val)
 	case *cfDictionary:
 		p.unmarshalDictionary(pval, val)
 	}
 }
 
+// unmarshalAsString stores s, the string form of a value with no Go type of its own in val,
+// in a string or a value implementing encoding.TextUnmarshaler.
+func (p *Decoder) unmarshalAsString(s string, val reflect.Value, incompatibleTypeError error) {
+	if val.Kind() == reflect.String {
+		val.SetString(s)
+	} else if receiver, can := implementsInterface(val, textUnmarshalerType); can {
+		p.unmarshalTextInterface(cfString(s), receiver.(encoding.TextUnmarshaler))
+	} else {
+		panic(incompatibleTypeError)
+	}
+}
+
+func (p *Decoder) resolveURL(pval *cfURL) *url.URL {
+	u, err := pval.resolve()
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// runDecodeHooks passes pval through the Decoder's hook chain. It returns the value that
+// should be decoded into val in pval's place, or true if a hook has already stored a value.
+func (p *Decoder) runDecodeHooks(pval cfValue, val reflect.Value) (cfValue, bool) {
+	from := pval.kind()
+	keypath := p.keypath.String()
+
+	original := p.hookValue(pval)
+	value := original
+	for _, hook := range p.hooks {
+		var err error
+		value, err = hook(keypath, from, val.Type(), value)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if isSameValue(original, value) {
+		return pval, false
+	}
+
+	rval := reflect.ValueOf(value)
+	if !rval.IsValid() {
+		// The hook discarded the value; leave val as it is.
+		return nil, true
+	}
+
+	if rval.Type().AssignableTo(val.Type()) {
+		val.Set(rval)
+		return nil, true
+	}
+
+	// Treat the replacement as though it had been read from the document.
+	enc := &Encoder{}
+	pval = enc.marshal(rval)
+	return pval, pval == nil
+}
+
+// hookValue returns pval as it is passed to decode hooks: as valueInterface would return it.
+// Hooks see every container and then everything inside it, so each container is converted
+// only once per document and its contents are reused when the hooks reach them.
+func (p *Decoder) hookValue(pval cfValue) interface{} {
+	switch pval.(type) {
+	case *cfArray, *cfDictionary, *cfSet:
+		if v, ok := p.hookValues[pval]; ok {
+			return v
+		}
+	default:
+		return p.valueInterface(pval)
+	}
+
+	var v interface{}
+	switch pval := pval.(type) {
+	case *cfArray:
+		out := make([]interface{}, len(pval.values))
+		for i, subv := range pval.values {
+			out[i] = p.hookValue(subv)
+		}
+		v = out
+	case *cfDictionary:
+		out := make(map[string]interface{}, len(pval.keys))
+		for i, k := range pval.keys {
+			out[k] = p.hookValue(pval.values[i])
+		}
+		v = out
+	case *cfSet:
+		out := make(Set, len(pval.values))
+		for i, subv := range pval.values {
+			out[i] = p.hookValue(subv)
+		}
+		v = out
+	}
+	if p.hookValues == nil {
+		p.hookValues = make(map[cfValue]interface{})
+	}
+	p.hookValues[pval] = v
+	return v
+}
+
+// isSameValue reports whether a decode hook returned the value it was given.
+func isSameValue(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() {
+		return va.IsValid() == vb.IsValid()
+	}
+	if va.Type() != vb.Type() {
+		return false
+	}
+	switch va.Kind() {
+	case reflect.Map, reflect.Slice:
+		return va.Pointer() == vb.Pointer() && va.Len() == vb.Len()
+	}
+	return va.Type().Comparable() && a == b
+}
+
 func (p *Decoder) unmarshalArray(a *cfArray, val reflect.Value) {
 	var n int
 	if val.Kind() == reflect.Slice {
+		if val.IsNil() {
+			if shared, ok := p.sharedValue(a, val.Type()); ok {
+				val.Set(shared)
+				return
+			}
+			defer p.recordSharedValue(a, val)
+		}
+
 		// Slice of element values.
 		// Grow slice.
 		cnt := len(a.values) + val.Len()
@@ -223,8 +410,10 @@ func (p *Decoder) unmarshalArray(a *cfArray, val reflect.Value) {
 	}
 
 	// Recur to read element into slice.
-	for _, sval := range a.values {
+	for i, sval := range a.values {
+		p.keypath.pushIndex(i)
 		p.unmarshal(sval, val.Index(n))
+		p.keypath.pop()
 		n++
 	}
 	return
@@ -246,11 +435,18 @@ func (p *Decoder) unmarshalDictionary(dict *cfDictionary, val reflect.Value) {
 		}
 
 		for _, finfo := range tinfo.fields {
+			p.keypath.pushKey(finfo.name)
 			p.unmarshal(entries[finfo.name], finfo.value(val))
+			p.keypath.pop()
 		}
 	case reflect.Map:
 		if val.IsNil() {
+			if shared, ok := p.sharedValue(dict, typ); ok {
+				val.Set(shared)
+				return
+			}
 			val.Set(reflect.MakeMap(typ))
+			p.recordSharedValue(dict, val)
 		}
 
 		for i, k := range dict.keys {
@@ -259,7 +455,9 @@ func (p *Decoder) unmarshalDictionary(dict *cfDictionary, val reflect.Value) {
 			keyv := reflect.ValueOf(k).Convert(typ.Key())
 			mapElem := reflect.New(typ.Elem()).Elem()
 
+			p.keypath.pushKey(k)
 			p.unmarshal(sval, mapElem)
+			p.keypath.pop()
 			val.SetMapIndex(keyv, mapElem)
 		}
 	default:
@@ -295,12 +493,27 @@ func (p *Decoder) valueInterface(pval cfValue) interface{} {
 		return time.Time(pval)
 	case cfUID:
 		return UID(pval)
+	case *cfSet:
+		out := make(Set, len(pval.values))
+		for i, subv := range pval.values {
+			out[i] = p.valueInterface(subv)
+		}
+		return out
+	case cfUUID:
+		return UUID(pval)
+	case *cfURL:
+		return p.resolveURL(pval)
 	}
 	return nil
 }
 
 func (p *Decoder) arrayInterface(a *cfArray) []interface{} {
+	if shared, ok := p.sharedValue(a, interfaceSliceType); ok {
+		return shared.Interface().([]interface{})
+	}
+
 	out := make([]interface{}, len(a.values))
+	p.recordSharedValue(a, reflect.ValueOf(out))
 	for i, subv := range a.values {
 		out[i] = p.valueInterface(subv)
 	}
@@ -308,10 +521,42 @@ func (p *Decoder) arrayInterface(a *cfArray) []interface{} {
 }
 
 func (p *Decoder) dictionaryInterface(dict *cfDictionary) map[string]interface{} {
+	if shared, ok := p.sharedValue(dict, interfaceMapType); ok {
+		return shared.Interface().(map[string]interface{})
+	}
+
 	out := make(map[string]interface{})
+	p.recordSharedValue(dict, reflect.ValueOf(out))
 	for i, k := range dict.keys {
 		subv := dict.values[i]
 		out[k] = p.valueInterface(subv)
 	}
 	return out
 }
+
+// sharedKey identifies the Go value a property list container was decoded into.
+// The same container may legitimately be decoded into values of different types.
+type sharedKey struct {
+	pval cfValue
+	typ  reflect.Type
+}
+
+// sharedValue returns the value that pval has already been decoded into, if the
+// Decoder is sharing objects and pval is a container that has been seen before.
+func (p *Decoder) sharedValue(pval cfValue, typ reflect.Type) (reflect.Value, bool) {
+	if p.shared == nil {
+		return reflect.Value{}, false
+	}
+	v, ok := p.shared[sharedKey{pval, typ}]
+	return v, ok
+}
+
+func (p *Decoder) recordSharedValue(pval cfValue, val reflect.Value) {
+	if p.shared == nil {
+		return
+	}
+	switch pval.(type) {
+	case *cfDictionary, *cfArray:
+		p.shared[sharedKey{pval, val.Type()}] = val
+	}
+}
@@ -1,6 +1,7 @@
 package plist
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -30,3 +31,137 @@ func BenchmarkInterfaceUnmarshal(b *testing.B) {
 		d.unmarshal(plistValueTree, reflect.ValueOf(&xval))
 	}
 }
+
+type selectiveUnmarshaler struct {
+	keypaths []string
+	version  int64
+	names    []string
+}
+
+func (s *selectiveUnmarshaler) UnmarshalPlistNode(node *Node) error {
+	if node.Kind() != DictionaryKind {
+		return fmt.Errorf("expected a dictionary, got %v", node.Kind())
+	}
+
+	s.keypaths = append(s.keypaths, node.Keypath())
+	if version, ok := node.Lookup("version"); ok {
+		var err error
+		if s.version, err = version.IntValue(); err != nil {
+			return err
+		}
+	}
+
+	items, ok := node.Lookup("items")
+	if !ok {
+		return nil
+	}
+	for i := 0; i < items.Len(); i++ {
+		item := items.Index(i)
+		s.keypaths = append(s.keypaths, item.Keypath())
+		if item.Kind() == StringKind {
+			var name string
+			if err := item.Decode(&name); err != nil {
+				return err
+			}
+			s.names = append(s.names, name)
+		}
+	}
+	return nil
+}
+
+func TestNodeUnmarshaler(t *testing.T) {
+	docs := map[string]string{
+		"XML":      `<plist><dict><key>wrapped</key><dict><key>version</key><integer>2</integer><key>items</key><array><string>a</string><integer>1</integer><string>b</string></array></dict></dict></plist>`,
+		"OpenStep": `{wrapped={version=2;items=(a,1,b);};}`,
+	}
+
+	for name, doc := range docs {
+		subtest(t, name, func(t *testing.T) {
+			var v struct {
+				Wrapped selectiveUnmarshaler `plist:"wrapped"`
+			}
+			if _, err := Unmarshal([]byte(doc), &v); err != nil {
+				t.Fatal(err)
+			}
+
+			if v.Wrapped.version != 2 {
+				t.Errorf("expected version 2, got %d", v.Wrapped.version)
+			}
+
+			expectedNames := []string{"a", "1", "b"}
+			if name == "XML" {
+				expectedNames = []string{"a", "b"}
+			}
+			if !reflect.DeepEqual(v.Wrapped.names, expectedNames) {
+				t.Errorf("expected names %v, got %v", expectedNames, v.Wrapped.names)
+			}
+
+			expectedKeypaths := []string{"/wrapped", "/wrapped/items[0]", "/wrapped/items[1]", "/wrapped/items[2]"}
+			if !reflect.DeepEqual(v.Wrapped.keypaths, expectedKeypaths) {
+				t.Errorf("expected keypaths %v, got %v", expectedKeypaths, v.Wrapped.keypaths)
+			}
+		})
+	}
+}
+
+func TestNodeAccessorMismatch(t *testing.T) {
+	d := &Decoder{}
+	n := d.newNode(cfString("abc"), nil)
+	if _, err := n.IntValue(); err == nil {
+		t.Error("expected an error reading a string as an integer")
+	}
+	if _, err := n.DataValue(); err == nil {
+		t.Error("expected an error reading a string as data")
+	}
+	if n.Len() != 0 || n.Keys() != nil || n.Index(0) != nil {
+		t.Error("expected a string to have no elements")
+	}
+	if _, ok := n.Lookup("abc"); ok {
+		t.Error("expected a string to have no keys")
+	}
+
+	d.lax = true
+	n = d.newNode(cfString("42"), nil)
+	if i, err := n.IntValue(); err != nil || i != 42 {
+		t.Errorf("expected lax integer 42, got %d (%v)", i, err)
+	}
+}
+
+func TestNodeTypeMismatch(t *testing.T) {
+	d := &Decoder{}
+	var s struct{}
+	err := d.newNode(cfString("abc"), nil).TypeMismatch(&s)
+	expected := (&incompatibleDecodeTypeError{reflect.TypeOf(s), "string"}).Error()
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestUnmarshalNestedPointers(t *testing.T) {
+	var n *selectiveUnmarshaler
+	if _, err := Unmarshal([]byte(`{version=<*I3>;}`), &n); err != nil {
+		t.Fatal(err)
+	}
+	if n == nil || n.version != 3 {
+		t.Errorf("expected a selectiveUnmarshaler at version 3, got %#v", n)
+	}
+
+	var s **string
+	if _, err := Unmarshal([]byte(`<string>abc</string>`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s == nil || *s == nil || **s != "abc" {
+		t.Errorf("expected abc, got %v", s)
+	}
+}
+
+func TestUnmarshalDataIntoTime(t *testing.T) {
+	// time.Time implements encoding.BinaryUnmarshaler, but only dates decode into it.
+	doc := []byte(`<plist><data>AQAAAA7dnlM2AAAAAP//</data></plist>`)
+	var tm time.Time
+	_, err := Unmarshal(doc, &tm)
+	expected := (&incompatibleDecodeTypeError{reflect.TypeOf(tm), "data"}).Error()
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v (decoded %v)", expected, err, tm)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build go1.18
+// +build go1.18
+
+package plist
+
+import (
+	"testing"
+)
+
+// FuzzXMLScanner checks that the scanner parses every document to the same value as
+// encoding/xml, or fails with the same kind of error.
+func FuzzXMLScanner(f *testing.F) {
+	for _, doc := range xmlScannerTestDocuments {
+		f.Add(doc)
+	}
+	for _, test := range tests {
+		if doc, ok := test.Documents[XMLFormat]; ok {
+			f.Add(string(doc))
+		}
+	}
+	f.Fuzz(func(t *testing.T, doc string) {
+		if err := compareXMLScanner(doc); err != nil {
+			t.Fatalf("%q: %v", doc, err)
+		}
+	})
+}
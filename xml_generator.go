@@ -2,6 +2,7 @@ package plist
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/xml"
 	"io"
@@ -133,7 +134,13 @@ func (p *xmlPlistGenerator) writePlistValue(pval cfValue) {
 			p.element(xmlFalseTag, "")
 		}
 	case cfData:
-		p.element(xmlDataTag, base64.StdEncoding.EncodeToString([]byte(pval)))
+		if len(pval) == 0 {
+			p.element(xmlDataTag, "")
+		} else {
+			p.writeData(bytes.NewReader(pval))
+		}
+	case *cfDataReader:
+		p.writeData(pval.reader)
 	case cfDate:
 		p.element(xmlDateTag, time.Time(pval).In(time.UTC).Format(time.RFC3339))
 	case *cfDictionary:
@@ -145,6 +152,20 @@ func (p *xmlPlistGenerator) writePlistValue(pval cfValue) {
 	}
 }
 
+// writeData base64-encodes r straight into the document as it is read.
+func (p *xmlPlistGenerator) writeData(r io.Reader) {
+	p.writeIndent(0)
+	p.WriteString("<" + xmlDataTag + ">")
+	enc := base64.NewEncoder(base64.StdEncoding, p.Writer)
+	if _, err := io.Copy(enc, r); err != nil {
+		panic(err)
+	}
+	if err := enc.Close(); err != nil {
+		panic(err)
+	}
+	p.WriteString("</" + xmlDataTag + ">")
+}
+
 func (p *xmlPlistGenerator) writeIndent(delta int) {
 	if len(p.indent) == 0 {
 		return
@@ -169,10 +190,53 @@ func (p *xmlPlistGenerator) writeIndent(delta int) {
 	}
 }
 
+func (p *xmlPlistGenerator) startDocument() {
+	p.WriteString(xmlHEADER)
+	p.WriteString(xmlDOCTYPE)
+	p.openTag(`plist version="1.0"`)
+}
+
+func (p *xmlPlistGenerator) startDictionary(parent PlistKind) {
+	p.openTag(xmlDictTag)
+}
+
+func (p *xmlPlistGenerator) writeKey(key string) {
+	p.element(xmlKeyTag, key)
+}
+
+func (p *xmlPlistGenerator) endDictionary(parent PlistKind) {
+	p.closeTag(xmlDictTag)
+}
+
+func (p *xmlPlistGenerator) startArray(parent PlistKind) {
+	p.openTag(xmlArrayTag)
+}
+
+func (p *xmlPlistGenerator) endArray(parent PlistKind) {
+	p.closeTag(xmlArrayTag)
+}
+
+func (p *xmlPlistGenerator) writeValue(parent PlistKind, pval cfValue) {
+	p.writePlistValue(pval)
+}
+
+func (p *xmlPlistGenerator) endDocument() {
+	p.closeTag(xmlPlistTag)
+	if err := p.Flush(); err != nil {
+		panic(err)
+	}
+}
+
 func (p *xmlPlistGenerator) Indent(i string) {
 	p.indent = i
 }
 
+func (p *xmlPlistGenerator) reset(w io.Writer) {
+	p.Writer.Reset(w)
+	p.depth = 0
+	p.putNewline = false
+}
+
 func newXMLPlistGenerator(w io.Writer) *xmlPlistGenerator {
 	return &xmlPlistGenerator{Writer: bufio.NewWriter(w)}
 }
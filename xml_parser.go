@@ -1,21 +1,143 @@
 package plist
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"reflect"
 	"runtime"
-	"strings"
 	"time"
 )
 
 type xmlPlistParser struct {
-	reader             io.Reader
-	xmlDecoder         *xml.Decoder
-	whitespaceReplacer *strings.Replacer
-	ntags              int
+	reader    io.Reader
+	input     []byte
+	tokenizer xmlTokenizer
+	scanner   *xmlScanner // kept between documents, as the tokenizer for UTF-8 input
+	ntags     int
+
+	// the entries of the dictionaries and arrays being parsed, innermost last;
+	// each container takes an exactly-sized copy of its own when it ends.
+	keys   []string
+	values []cfValue
+}
+
+// xmlDataText reads the base64 text of a data element, leaving out the whitespace in it.
+type xmlDataText struct {
+	text string
+}
+
+func (t *xmlDataText) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) && len(t.text) > 0 {
+		switch c := t.text[0]; c {
+		case '\t', '\n', ' ', '\r':
+		default:
+			b[n] = c
+			n++
+		}
+		t.text = t.text[1:]
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// newXMLDataReader returns a reader that decodes the base64 text of a data element as it is read.
+func newXMLDataReader(text string) io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, &xmlDataText{text})
+}
+
+// xmlTokenizer reads the parts of an XML document that make up a property list.
+type xmlTokenizer interface {
+	// next returns the name of the next start or end element, discarding any text,
+	// comments and other markup in between. It returns io.EOF at the end of the document.
+	next() (name string, end bool, err error)
+
+	// text returns the character data in the element just started, and consumes its end element.
+	text() (string, error)
+
+	// skip discards the rest of the element just started.
+	skip() error
+}
+
+// stdXMLTokenizer is an xmlTokenizer backed by encoding/xml.
+type stdXMLTokenizer struct {
+	decoder *xml.Decoder
+	element xml.StartElement
+}
+
+func newStdXMLTokenizer(r io.Reader) *stdXMLTokenizer {
+	return &stdXMLTokenizer{decoder: xml.NewDecoder(r)}
+}
+
+func (t *stdXMLTokenizer) next() (string, bool, error) {
+	for {
+		token, err := t.decoder.Token()
+		if err != nil {
+			return "", false, err
+		}
+		switch el := token.(type) {
+		case xml.StartElement:
+			t.element = el
+			return el.Name.Local, false, nil
+		case xml.EndElement:
+			return el.Name.Local, true, nil
+		}
+	}
+}
+
+func (t *stdXMLTokenizer) text() (string, error) {
+	var charData xml.CharData
+	err := t.decoder.DecodeElement(&charData, &t.element)
+	return string(charData), err
+}
+
+func (t *stdXMLTokenizer) skip() error {
+	return t.decoder.Skip()
+}
+
+// firstElement returns the name of the document's first element. Any error before it is
+// taken to mean that the document is not an XML property list at all.
+func (p *xmlPlistParser) firstElement() string {
+	if p.tokenizer == nil {
+		if p.reader != nil {
+			input, err := ioutil.ReadAll(p.reader)
+			if err != nil {
+				panic(invalidPlistError{"XML", err})
+			}
+			p.input = input
+		}
+		input := zeroCopy8BitString(p.input, 0, len(p.input))
+		if p.scanner == nil {
+			p.scanner = newXMLScanner(input)
+		} else {
+			p.scanner.reset(input)
+		}
+		p.tokenizer = p.scanner
+	}
+
+	for {
+		name, end, err := p.tokenizer.next()
+		if err == errXMLEncoding {
+			// The scanner only reads UTF-8; documents in any other encoding are left to encoding/xml.
+			p.tokenizer = newStdXMLTokenizer(bytes.NewReader(p.input))
+			continue
+		}
+		if err != nil {
+			// The first XML parse turned out to be invalid:
+			// we do not have an XML property list.
+			panic(invalidPlistError{"XML", err})
+		}
+		if !end {
+			return name
+		}
+	}
 }
 
 func (p *xmlPlistParser) parseDocument() (pval cfValue, parseError error) {
@@ -32,59 +154,45 @@ func (p *xmlPlistParser) parseDocument() (pval cfValue, parseError error) {
 			}
 		}
 	}()
-	for {
-		if token, err := p.xmlDecoder.Token(); err == nil {
-			if element, ok := token.(xml.StartElement); ok {
-				pval = p.parseXMLElement(element)
-				if p.ntags == 0 {
-					panic(invalidPlistError{"XML", errors.New("no elements encountered")})
-				}
-				return
-			}
-		} else {
-			// The first XML parse turned out to be invalid:
-			// we do not have an XML property list.
-			panic(invalidPlistError{"XML", err})
-		}
+	pval = p.parseXMLElement(p.firstElement())
+	if p.ntags == 0 {
+		panic(invalidPlistError{"XML", errors.New("no elements encountered")})
 	}
+	return
 }
 
-func (p *xmlPlistParser) parseXMLElement(element xml.StartElement) cfValue {
-	var charData xml.CharData
-	switch element.Name.Local {
-	case "plist":
-		p.ntags++
-		for {
-			token, err := p.xmlDecoder.Token()
-			if err != nil {
-				panic(err)
-			}
+// nextElement returns the name of the next start or end element.
+func (p *xmlPlistParser) nextElement() (string, bool) {
+	name, end, err := p.tokenizer.next()
+	if err != nil {
+		panic(err)
+	}
+	return name, end
+}
 
-			if el, ok := token.(xml.EndElement); ok && el.Name.Local == "plist" {
-				break
-			}
+// elementText returns the character data in the element just started.
+func (p *xmlPlistParser) elementText() string {
+	text, err := p.tokenizer.text()
+	if err != nil {
+		panic(err)
+	}
+	return text
+}
 
-			if el, ok := token.(xml.StartElement); ok {
-				return p.parseXMLElement(el)
-			}
+func (p *xmlPlistParser) parseXMLElement(name string) cfValue {
+	switch name {
+	case "plist":
+		p.ntags++
+		if el, end := p.nextElement(); !end {
+			return p.parseXMLElement(el)
 		}
 		return nil
 	case "string":
 		p.ntags++
-		err := p.xmlDecoder.DecodeElement(&charData, &element)
-		if err != nil {
-			panic(err)
-		}
-
-		return cfString(charData)
+		return cfString(p.elementText())
 	case "integer":
 		p.ntags++
-		err := p.xmlDecoder.DecodeElement(&charData, &element)
-		if err != nil {
-			panic(err)
-		}
-
-		s := string(charData)
+		s := p.elementText()
 		if len(s) == 0 {
 			panic(errors.New("invalid empty <integer/>"))
 		}
@@ -100,27 +208,17 @@ func (p *xmlPlistParser) parseXMLElement(element xml.StartElement) cfValue {
 		}
 	case "real":
 		p.ntags++
-		err := p.xmlDecoder.DecodeElement(&charData, &element)
-		if err != nil {
-			panic(err)
-		}
-
-		n := mustParseFloat(string(charData), 64)
+		n := mustParseFloat(p.elementText(), 64)
 		return &cfReal{wide: true, value: n}
 	case "true", "false":
 		p.ntags++
-		p.xmlDecoder.Skip()
+		p.tokenizer.skip()
 
-		b := element.Name.Local == "true"
+		b := name == "true"
 		return cfBoolean(b)
 	case "date":
 		p.ntags++
-		err := p.xmlDecoder.DecodeElement(&charData, &element)
-		if err != nil {
-			panic(err)
-		}
-
-		t, err := time.ParseInLocation(time.RFC3339, string(charData), time.UTC)
+		t, err := time.ParseInLocation(time.RFC3339, p.elementText(), time.UTC)
 		if err != nil {
 			panic(err)
 		}
@@ -128,77 +226,61 @@ func (p *xmlPlistParser) parseXMLElement(element xml.StartElement) cfValue {
 		return cfDate(t)
 	case "data":
 		p.ntags++
-		err := p.xmlDecoder.DecodeElement(&charData, &element)
-		if err != nil {
-			panic(err)
-		}
-
-		str := p.whitespaceReplacer.Replace(string(charData))
-
-		l := base64.StdEncoding.DecodedLen(len(str))
-		bytes := make([]uint8, l)
-		l, err = base64.StdEncoding.Decode(bytes, []byte(str))
-		if err != nil {
+		text := p.elementText()
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+		n, err := io.ReadFull(newXMLDataReader(text), data)
+		if err != nil && err != io.ErrUnexpectedEOF {
 			panic(err)
 		}
 
-		return cfData(bytes[:l])
+		return cfData(data[:n])
 	case "dict":
 		p.ntags++
-		var key *string
-		keys := make([]string, 0, 32)
-		values := make([]cfValue, 0, 32)
+		var key string
+		haveKey := false
+		start := len(p.keys)
 		for {
-			token, err := p.xmlDecoder.Token()
-			if err != nil {
-				panic(err)
-			}
-
-			if el, ok := token.(xml.EndElement); ok && el.Name.Local == "dict" {
-				if key != nil {
+			el, end := p.nextElement()
+			if end {
+				if haveKey {
 					panic(errors.New("missing value in dictionary"))
 				}
 				break
 			}
 
-			if el, ok := token.(xml.StartElement); ok {
-				if el.Name.Local == "key" {
-					var k string
-					p.xmlDecoder.DecodeElement(&k, &el)
-					key = &k
-				} else {
-					if key == nil {
-						panic(errors.New("missing key in dictionary"))
-					}
-					keys = append(keys, *key)
-					values = append(values, p.parseXMLElement(el))
-					key = nil
+			if el == "key" {
+				key, _ = p.tokenizer.text()
+				haveKey = true
+			} else {
+				if !haveKey {
+					panic(errors.New("missing key in dictionary"))
 				}
+				val := p.parseXMLElement(el)
+				p.keys = append(p.keys, key)
+				p.values = append(p.values, val)
+				haveKey = false
 			}
 		}
 
-		dict := &cfDictionary{keys: keys, values: values}
+		keys := make([]string, len(p.keys)-start)
+		copy(keys, p.keys[start:])
+		p.keys = p.keys[:start]
+		dict := &cfDictionary{keys: keys, values: p.popValues(len(p.values) - len(keys))}
 		return dict.maybeUID(false)
 	case "array":
 		p.ntags++
-		values := make([]cfValue, 0, 10)
+		start := len(p.values)
 		for {
-			token, err := p.xmlDecoder.Token()
-			if err != nil {
-				panic(err)
-			}
-
-			if el, ok := token.(xml.EndElement); ok && el.Name.Local == "array" {
+			el, end := p.nextElement()
+			if end {
 				break
 			}
-
-			if el, ok := token.(xml.StartElement); ok {
-				values = append(values, p.parseXMLElement(el))
-			}
+			val := p.parseXMLElement(el)
+			p.values = append(p.values, val)
 		}
-		return &cfArray{values}
+		return &cfArray{p.popValues(start)}
 	}
-	err := fmt.Errorf("encountered unknown element %s", element.Name.Local)
+	err := fmt.Errorf("encountered unknown element %s", name)
 	if p.ntags == 0 {
 		// If out first XML tag is invalid, it might be an openstep data element, ala <abab> or <0101>
 		panic(invalidPlistError{"XML", err})
@@ -206,6 +288,132 @@ func (p *xmlPlistParser) parseXMLElement(element xml.StartElement) cfValue {
 	panic(err)
 }
 
+// decodeDocument parses the document in a single pass, storing it into val as it goes.
+func (p *xmlPlistParser) decodeDocument(dec *Decoder, val reflect.Value) (parseError error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			parseError = unwrapStreamError(r, "XML")
+		}
+	}()
+	// A document that isn't XML is left to the text parser, which must find val untouched,
+	// so that is decided before anything is stored. Past the first element, every error
+	// is reported as an error in the XML document.
+	name := p.firstElement()
+	if !xmlPlistElements[name] {
+		panic(invalidPlistError{"XML", fmt.Errorf("encountered unknown element %s", name)})
+	}
+	p.decodeXMLElement(dec, name, val)
+	return
+}
+
+// xmlPlistElements holds the names of the elements a property list can start with.
+var xmlPlistElements = map[string]bool{
+	"plist": true, "string": true, "integer": true, "real": true, "true": true,
+	"false": true, "date": true, "data": true, "dict": true, "array": true,
+}
+
+func (p *xmlPlistParser) decodeXMLElement(dec *Decoder, name string, val reflect.Value) {
+	switch name {
+	case "plist":
+		p.ntags++
+		if el, end := p.nextElement(); !end {
+			p.decodeXMLElement(dec, el, val)
+		}
+		return
+	case "dict":
+		if target, ok := dec.streamTarget(val, DictionaryKind); ok {
+			p.ntags++
+			p.decodeXMLDictionary(dec, target)
+			return
+		}
+	case "array":
+		if target, ok := dec.streamTarget(val, ArrayKind); ok {
+			p.ntags++
+			p.decodeXMLArray(dec, target)
+			return
+		}
+	case "data":
+		if target, ok := dec.readerTarget(val); ok {
+			p.ntags++
+			target.Set(reflect.ValueOf(newXMLDataReader(p.elementText())))
+			return
+		}
+	}
+	dec.unmarshalStreamed(p.parseXMLElement(name), val)
+}
+
+func (p *xmlPlistParser) decodeXMLDictionary(dec *Decoder, val reflect.Value) {
+	d := newStreamDictionary(dec, val)
+	var key *string
+	for {
+		el, end := p.nextElement()
+		if end {
+			if key != nil {
+				panic(errors.New("missing value in dictionary"))
+			}
+			d.finish()
+			return
+		}
+
+		if el == "key" {
+			k, _ := p.tokenizer.text()
+			key = &k
+		} else {
+			if key == nil {
+				panic(errors.New("missing key in dictionary"))
+			}
+			if entry, ok := d.entry(*key); ok {
+				p.decodeXMLElement(dec, el, entry)
+				d.store()
+			} else if err := p.tokenizer.skip(); err != nil {
+				panic(err)
+			}
+			key = nil
+		}
+	}
+}
+
+func (p *xmlPlistParser) decodeXMLArray(dec *Decoder, val reflect.Value) {
+	a := newStreamArray(dec, val)
+	for {
+		el, end := p.nextElement()
+		if end {
+			a.finish()
+			return
+		}
+		if elem, ok := a.next(); ok {
+			p.decodeXMLElement(dec, el, elem)
+			a.store()
+		} else if err := p.tokenizer.skip(); err != nil {
+			panic(err)
+		}
+	}
+}
+
 func newXMLPlistParser(r io.Reader) *xmlPlistParser {
-	return &xmlPlistParser{r, xml.NewDecoder(r), strings.NewReplacer("\t", "", "\n", "", " ", "", "\r", ""), 0}
+	return &xmlPlistParser{reader: r}
+}
+
+// reset prepares the parser to parse the document in input, which has already been read,
+// keeping the storage it used for the previous document.
+func (p *xmlPlistParser) reset(input []byte) {
+	keys, values := p.keys[:cap(p.keys)], p.values[:cap(p.values)]
+	for i := range keys {
+		keys[i] = ""
+	}
+	for i := range values {
+		values[i] = nil
+	}
+	*p = xmlPlistParser{input: input, scanner: p.scanner, keys: keys[:0], values: values[:0]}
+}
+
+// popValues removes the values parsed since start and returns a copy of them.
+func (p *xmlPlistParser) popValues(start int) []cfValue {
+	values := make([]cfValue, len(p.values)-start)
+	copy(values, p.values[start:])
+	p.values = p.values[:start]
+	return values
 }
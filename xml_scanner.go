@@ -0,0 +1,606 @@
+package plist
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// xmlScanner is an xmlTokenizer purpose-built for property lists.
+//
+// It reads the whole document up front and returns element names and text as
+// slices of it wherever possible. It implements only what a property list needs
+// from XML, but implements that with the same rules as encoding/xml: entities,
+// CDATA sections, comments, processing instructions, line ending normalization
+// and character validation all behave the same way.
+type xmlScanner struct {
+	input string
+	pos   int
+
+	// names of the currently-open elements, for matching end tags
+	stack []string
+
+	// set when the last start tag read was self-closing (<true/>); its end tag is
+	// reported by the next call to next.
+	selfClosing bool
+
+	// the first error encountered; like encoding/xml, the scanner stops there.
+	err error
+}
+
+// errXMLEncoding is returned by the scanner for documents that declare an encoding other
+// than UTF-8. Those are left to encoding/xml, which reports them in its own way.
+var errXMLEncoding = errors.New("plist: unsupported XML encoding")
+
+func newXMLScanner(input string) *xmlScanner {
+	return &xmlScanner{input: input}
+}
+
+// reset prepares the scanner to scan input, keeping the storage it used for the previous document.
+func (s *xmlScanner) reset(input string) {
+	stack := s.stack[:cap(s.stack)]
+	for i := range stack {
+		stack[i] = ""
+	}
+	*s = xmlScanner{input: input, stack: stack[:0]}
+}
+
+func (s *xmlScanner) syntaxError(msg string, args ...interface{}) error {
+	line := 1 + strings.Count(s.input[:s.pos], "\n")
+	return fmt.Errorf("XML syntax error on line %d: %s", line, fmt.Sprintf(msg, args...))
+}
+
+func (s *xmlScanner) next() (string, bool, error) {
+	if s.err != nil {
+		return "", false, s.err
+	}
+	name, end, err := s.scan()
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return localName(name), end, err
+}
+
+// localName strips the namespace prefix from name, as encoding/xml does.
+func localName(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 1 && i < len(name)-1 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func (s *xmlScanner) scan() (string, bool, error) {
+	if s.selfClosing {
+		s.selfClosing = false
+		name := s.stack[len(s.stack)-1]
+		s.stack = s.stack[:len(s.stack)-1]
+		return name, true, nil
+	}
+
+	for {
+		i := strings.IndexByte(s.input[s.pos:], '<')
+		if i < 0 {
+			i = len(s.input) - s.pos
+		}
+
+		// Text between elements is thrown away, but must still be valid.
+		if text := s.input[s.pos : s.pos+i]; text != "" {
+			if err := s.checkCharData(text); err != nil {
+				return "", false, err
+			}
+			if _, err := s.unescape(text); err != nil {
+				return "", false, err
+			}
+		}
+		s.pos += i
+
+		if s.pos == len(s.input) {
+			if len(s.stack) > 0 {
+				return "", false, s.syntaxError("unexpected EOF")
+			}
+			return "", false, io.EOF
+		}
+
+		switch {
+		case strings.HasPrefix(s.input[s.pos:], "</"):
+			name, err := s.endTag()
+			return name, true, err
+		case s.input[s.pos+1:] == "":
+			s.pos++
+			return "", false, s.syntaxError("unexpected EOF")
+		case s.input[s.pos+1] == '!' || s.input[s.pos+1] == '?':
+			if err := s.markup(); err != nil {
+				return "", false, err
+			}
+		default:
+			name, err := s.startTag()
+			return name, false, err
+		}
+	}
+}
+
+// startTag reads a start tag, and returns its name.
+func (s *xmlScanner) startTag() (string, error) {
+	s.pos++ // <
+	name, ok := s.name()
+	if !ok {
+		return "", s.syntaxError("expected element name after <")
+	}
+
+	for {
+		s.skipSpace()
+		if s.pos >= len(s.input) {
+			return "", s.syntaxError("unexpected EOF")
+		}
+		switch s.input[s.pos] {
+		case '/':
+			if !strings.HasPrefix(s.input[s.pos:], "/>") {
+				return "", s.syntaxError("expected /> in element")
+			}
+			s.pos += 2
+			s.stack = append(s.stack, name)
+			s.selfClosing = true
+			return name, nil
+		case '>':
+			s.pos++
+			s.stack = append(s.stack, name)
+			return name, nil
+		}
+
+		// Attributes are checked for well-formedness, but otherwise ignored.
+		if _, ok := s.name(); !ok {
+			return "", s.syntaxError("expected attribute name in element")
+		}
+		s.skipSpace()
+		if s.pos >= len(s.input) || s.input[s.pos] != '=' {
+			return "", s.syntaxError("attribute name without = in element")
+		}
+		s.pos++
+		s.skipSpace()
+		if _, err := s.quoted(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// endTag reads an end tag, and returns its name.
+func (s *xmlScanner) endTag() (string, error) {
+	s.pos += 2 // </
+	name, ok := s.name()
+	if !ok {
+		return "", s.syntaxError("expected element name after </")
+	}
+	s.skipSpace()
+	if s.pos >= len(s.input) || s.input[s.pos] != '>' {
+		return "", s.syntaxError("invalid characters between </%s and >", name)
+	}
+	s.pos++
+
+	if len(s.stack) == 0 {
+		return "", s.syntaxError("unexpected end element </%s>", name)
+	}
+	if open := s.stack[len(s.stack)-1]; open != name {
+		return "", s.syntaxError("element <%s> closed by </%s>", open, name)
+	}
+	s.stack = s.stack[:len(s.stack)-1]
+	return name, nil
+}
+
+// markup skips a comment, processing instruction or DOCTYPE declaration,
+// or a CDATA section outside of an element's text.
+func (s *xmlScanner) markup() error {
+	rest := s.input[s.pos:]
+	switch {
+	case strings.HasPrefix(rest, "<!--"):
+		return s.comment()
+	case strings.HasPrefix(rest, "<![CDATA["):
+		end := strings.Index(rest, "]]>")
+		if end < 0 {
+			s.pos = len(s.input)
+			return s.syntaxError("unexpected EOF in CDATA section")
+		}
+		s.pos += end + 3
+		return s.checkText(rest[len("<![CDATA["):end])
+	case strings.HasPrefix(rest, "<!-"):
+		if len(rest) == 3 {
+			s.pos = len(s.input)
+			return s.syntaxError("unexpected EOF")
+		}
+		return s.syntaxError("invalid sequence <!- not part of <!--")
+	case strings.HasPrefix(rest, "<!["):
+		if len(rest) < len("<![CDATA[") && strings.HasPrefix("<![CDATA[", rest) {
+			s.pos = len(s.input)
+			return s.syntaxError("unexpected EOF")
+		}
+		return s.syntaxError("invalid <![ sequence")
+	case strings.HasPrefix(rest, "<?"):
+		s.pos += 2
+		target, ok := s.name()
+		if !ok {
+			return s.syntaxError("expected target name after <?")
+		}
+		s.skipSpace()
+		end := strings.Index(s.input[s.pos:], "?>")
+		if end < 0 {
+			s.pos = len(s.input)
+			return s.syntaxError("unexpected EOF")
+		}
+		body := s.input[s.pos : s.pos+end]
+		s.pos += end + 2
+		if target == "xml" {
+			if ver := procInstParam("version", body); ver != "" && ver != "1.0" {
+				return fmt.Errorf("xml: unsupported version %q; only version 1.0 is supported", ver)
+			}
+			if enc := procInstParam("encoding", body); enc != "" && !strings.EqualFold(enc, "utf-8") {
+				return errXMLEncoding
+			}
+		}
+		return nil
+	case strings.HasPrefix(rest, "<!"):
+		// A directive such as <!DOCTYPE ...>. Angle brackets nest, except inside
+		// quotes and comments; the first byte is taken as it is, as encoding/xml does.
+		var quote byte
+		depth := 0
+		for i := 3; i < len(rest); i++ {
+			c := rest[i]
+			switch {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				quote = c
+			case c == '>':
+				if depth == 0 {
+					s.pos += i + 1
+					return nil
+				}
+				depth--
+			case c == '<' && strings.HasPrefix(rest[i:], "<!--"):
+				end := strings.Index(rest[i+4:], "-->")
+				if end < 0 {
+					i = len(rest)
+					break
+				}
+				i += 4 + end + 2
+			case c == '<':
+				depth++
+			}
+		}
+		s.pos = len(s.input)
+		return s.syntaxError("unexpected EOF")
+	}
+	return s.syntaxError("invalid markup")
+}
+
+// comment skips a comment, in which the first "--" must end it.
+func (s *xmlScanner) comment() error {
+	rest := s.input[s.pos+len("<!--"):]
+	end := strings.Index(rest, "--")
+	if end < 0 || end+2 == len(rest) {
+		s.pos = len(s.input)
+		return s.syntaxError("unexpected EOF in comment")
+	}
+	if rest[end+2] != '>' {
+		return s.syntaxError(`invalid sequence "--" not allowed in comments`)
+	}
+	s.pos += len("<!--") + end + 3
+	return nil
+}
+
+// procInstParam returns the value of param in the body of an <?xml ...?> declaration.
+// It follows encoding/xml, which only looks for param="value" or param='value'.
+func procInstParam(param, body string) string {
+	param += "="
+	for i := 0; i < len(body); {
+		k := strings.Index(body[i:], param)
+		if k < 0 || i+k+len(param) >= len(body) {
+			return ""
+		}
+		i += k + len(param)
+		if quote := body[i]; quote == '"' || quote == '\'' {
+			if end := strings.IndexByte(body[i+1:], quote); end >= 0 {
+				return body[i+1 : i+1+end]
+			}
+			return ""
+		}
+		i++
+	}
+	return ""
+}
+
+func (s *xmlScanner) skipSpace() {
+	for s.pos < len(s.input) {
+		switch s.input[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':' || c == '.' || c == '-'
+}
+
+// name reads an XML name. Like encoding/xml, it takes every byte up to the first
+// ASCII byte that can't be part of one, and then checks the whole name.
+func (s *xmlScanner) name() (string, bool) {
+	start := s.pos
+	ascii := true
+	for s.pos < len(s.input) {
+		c := s.input[s.pos]
+		if c < utf8.RuneSelf && !isNameByte(c) {
+			break
+		}
+		ascii = ascii && c < utf8.RuneSelf
+		s.pos++
+	}
+
+	name := s.input[start:s.pos]
+	if name == "" {
+		return "", false
+	}
+	if ascii {
+		if c := name[0]; c >= '0' && c <= '9' || c == '.' || c == '-' {
+			return "", false
+		}
+	} else if !isXMLName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// isXMLName reports whether encoding/xml accepts name, which contains characters
+// outside of ASCII. Its character tables aren't exported, and such names are rare
+// in property lists.
+func isXMLName(name string) bool {
+	_, err := xml.NewDecoder(strings.NewReader("<" + name + "/>")).Token()
+	return err == nil
+}
+
+// quoted reads a quoted attribute value.
+func (s *xmlScanner) quoted() (string, error) {
+	if s.pos >= len(s.input) || (s.input[s.pos] != '"' && s.input[s.pos] != '\'') {
+		return "", s.syntaxError("unquoted or missing attribute value in element")
+	}
+	quote := s.input[s.pos]
+	end := strings.IndexByte(s.input[s.pos+1:], quote)
+	if end < 0 {
+		s.pos = len(s.input)
+		return "", s.syntaxError("unexpected EOF")
+	}
+	value := s.input[s.pos+1 : s.pos+1+end]
+	if strings.IndexByte(value, '<') >= 0 {
+		return "", s.syntaxError("unescaped < inside quoted string")
+	}
+	s.pos += end + 2
+	if err := s.checkText(value); err != nil {
+		return "", err
+	}
+	return s.unescape(value)
+}
+
+func (s *xmlScanner) text() (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	text, err := s.scanText()
+	if err != nil {
+		s.err = err
+	}
+	return text, err
+}
+
+func (s *xmlScanner) scanText() (string, error) {
+	if s.selfClosing {
+		s.scan()
+		return "", nil
+	}
+
+	// Fast path: plain text running right up to the element's end tag.
+	name := s.stack[len(s.stack)-1]
+	if i := strings.IndexByte(s.input[s.pos:], '<'); i >= 0 {
+		text := s.input[s.pos : s.pos+i]
+		rest := s.input[s.pos+i:]
+		if strings.HasPrefix(rest, "</") && strings.HasPrefix(rest[2:], name) && strings.HasPrefix(rest[2+len(name):], ">") &&
+			strings.IndexByte(text, '\r') < 0 {
+			if err := s.checkCharData(text); err != nil {
+				return "", err
+			}
+			text, err := s.unescape(text)
+			if err != nil {
+				return "", err
+			}
+			s.pos += i + len(name) + 3
+			s.stack = s.stack[:len(s.stack)-1]
+			return text, nil
+		}
+	}
+
+	// Slow path: collect the text from between comments, CDATA sections and nested
+	// elements (whose contents are skipped, as encoding/xml does).
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s.input[s.pos:], '<')
+		if i < 0 {
+			s.pos = len(s.input)
+			return "", s.syntaxError("unexpected EOF")
+		}
+
+		text := s.input[s.pos : s.pos+i]
+		if err := s.checkCharData(text); err != nil {
+			return "", err
+		}
+		text, err := s.unescape(normalizeNewlines(text))
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(text)
+		s.pos += i
+
+		rest := s.input[s.pos:]
+		switch {
+		case strings.HasPrefix(rest, "<![CDATA["):
+			end := strings.Index(rest, "]]>")
+			if end < 0 {
+				s.pos = len(s.input)
+				return "", s.syntaxError("unexpected EOF in CDATA section")
+			}
+			cdata := rest[len("<![CDATA["):end]
+			if err := s.checkText(cdata); err != nil {
+				return "", err
+			}
+			b.WriteString(normalizeNewlines(cdata))
+			s.pos += end + 3
+		case strings.HasPrefix(rest, "</"):
+			if _, err := s.endTag(); err != nil {
+				return "", err
+			}
+			return b.String(), nil
+		case len(rest) > 1 && (rest[1] == '!' || rest[1] == '?'):
+			if err := s.markup(); err != nil {
+				return "", err
+			}
+		default:
+			if _, err := s.startTag(); err != nil {
+				return "", err
+			}
+			if err := s.skipElement(); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+func (s *xmlScanner) skip() error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.skipElement(); err != nil {
+		s.err = err
+	}
+	return s.err
+}
+
+func (s *xmlScanner) skipElement() error {
+	depth := 1
+	for depth > 0 {
+		_, end, err := s.scan()
+		if err != nil {
+			if err == io.EOF {
+				return s.syntaxError("unexpected EOF")
+			}
+			return err
+		}
+		if end {
+			depth--
+		} else {
+			depth++
+		}
+	}
+	return nil
+}
+
+// checkText applies encoding/xml's rules for the characters allowed in a document.
+func (s *xmlScanner) checkText(text string) error {
+	for i := 0; i < len(text); {
+		c := text[i]
+		if c < utf8.RuneSelf {
+			if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+				return s.syntaxError("illegal character code %U", rune(c))
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == utf8.RuneError && size == 1 {
+			return s.syntaxError("invalid UTF-8")
+		}
+		if !isInCharacterRange(r) {
+			return s.syntaxError("illegal character code %U", r)
+		}
+		i += size
+	}
+	return nil
+}
+
+// checkCharData checks text outside of CDATA sections, which may not contain "]]>".
+func (s *xmlScanner) checkCharData(text string) error {
+	if strings.Contains(text, "]]>") {
+		return s.syntaxError("unescaped ]]> not in CDATA section")
+	}
+	return s.checkText(text)
+}
+
+func isInCharacterRange(r rune) bool {
+	return r == 0x09 ||
+		r == 0x0A ||
+		r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+func normalizeNewlines(s string) string {
+	if strings.IndexByte(s, '\r') < 0 {
+		return s
+	}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\r", "\n", -1)
+}
+
+var xmlEntities = map[string]string{
+	"lt":   "<",
+	"gt":   ">",
+	"amp":  "&",
+	"apos": "'",
+	"quot": `"`,
+}
+
+// unescape replaces the entity and character references in text.
+func (s *xmlScanner) unescape(text string) (string, error) {
+	i := strings.IndexByte(text, '&')
+	if i < 0 {
+		return text, nil
+	}
+
+	var b strings.Builder
+	for i >= 0 {
+		b.WriteString(text[:i])
+		text = text[i+1:]
+
+		end := strings.IndexByte(text, ';')
+		if end < 0 {
+			return "", s.syntaxError("invalid character entity &%s (no semicolon)", text)
+		}
+		entity := text[:end]
+		text = text[end+1:]
+
+		if strings.HasPrefix(entity, "#") {
+			var n uint64
+			var err error
+			if strings.HasPrefix(entity, "#x") {
+				n, err = strconv.ParseUint(entity[2:], 16, 32)
+			} else {
+				n, err = strconv.ParseUint(entity[1:], 10, 32)
+			}
+			if err != nil || !isInCharacterRange(rune(n)) {
+				return "", s.syntaxError("invalid character entity &%s;", entity)
+			}
+			b.WriteRune(rune(n))
+		} else if e, ok := xmlEntities[entity]; ok {
+			b.WriteString(e)
+		} else {
+			return "", s.syntaxError("invalid character entity &%s;", entity)
+		}
+		i = strings.IndexByte(text, '&')
+	}
+	b.WriteString(text)
+	return b.String(), nil
+}
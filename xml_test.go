@@ -2,7 +2,9 @@ package plist
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -25,6 +27,19 @@ func BenchmarkXMLParse(b *testing.B) {
 	}
 }
 
+func BenchmarkXMLParseEncodingXML(b *testing.B) {
+	buf := bytes.NewReader([]byte(plistValueTreeAsXML))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StartTimer()
+		d := newXMLPlistParser(buf)
+		d.tokenizer = newStdXMLTokenizer(buf)
+		d.parseDocument()
+		b.StopTimer()
+		buf.Seek(0, 0)
+	}
+}
+
 func TestVariousIllegalXMLPlists(t *testing.T) {
 	plists := []string{
 		`<plist version="1.0"><integer>0x</integer></plist>`,
@@ -61,3 +76,123 @@ func TestVariousIllegalXMLPlists(t *testing.T) {
 		}
 	}
 }
+
+var xmlScannerTestDocuments = []string{
+	plistValueTreeAsXML,
+	`<plist><string>a &lt;b&gt; &amp; &apos;c&apos; &quot;d&quot; &#65;&#x42;&#x1F600;</string></plist>`,
+	`<plist><string>a<![CDATA[<b> & ]]>c</string></plist>`,
+	`<plist><string>a<!-- comment -->b<?pi x?>c</string></plist>`,
+	`<plist><string>a<nested>x<deeper/></nested>b</string></plist>`,
+	"<plist><string>line\r\nline\rline</string></plist>",
+	"<plist><string><![CDATA[line\r\nline]]></string></plist>",
+	"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\r\n<!DOCTYPE plist [ <!ENTITY x \"y\"> ]>\r\n<plist version=\"1.0\">\r\n<dict>\r\n\t<key>a</key>\r\n\t<string>b</string>\r\n</dict>\r\n</plist>\r\n",
+	`<plist version='1.0' x:y="z"><dict><key>a</key><true/><key>b</key><false></false><key>c</key><integer>-0x10</integer></dict></plist>`,
+	`<x:plist><x:array><x:string>ns</x:string></x:array></x:plist>`,
+	`<plist><dict><key>a &amp; b</key><string/><key/><data> aGVs
+	bG8= </data></dict></plist>`,
+	`<plist><array><true /><array></array><dict></dict><string></string></array></plist>`,
+	"\xEF\xBB\xBF<plist><string>bom</string></plist>",
+	`   <plist><string>leading space</string></plist>`,
+	`<plist><dict><key>a</key><string>b</string><key>a</key><string>c</string></dict></plist>`,
+	`<?xml version="1.1"?><plist><string>a</string></plist>`,
+	`<?xml version="1.0" encoding="ISO-8859-1"?><plist><string>a</string></plist>`,
+	`<plist><string>&bogus;</string></plist>`,
+	`<plist><string>&#0;</string></plist>`,
+	`<plist><string>&amp</string></plist>`,
+	"<plist><string>\x01</string></plist>",
+	"<plist><string>\xff</string></plist>",
+	`<plist><string>a</strin></plist>`,
+	`<plist><string>a</string></plist`,
+	`<plist><dict><key>a</key><true></false></dict></plist>`,
+	`<plist><dict><key>a</key><string>b</string></array></plist>`,
+	`<plist><string a=b>x</string></plist>`,
+	`<plist><string a="<">x</string></plist>`,
+	`<plist><string>a<!-- unterminated</string></plist>`,
+	`<plist><string>a<![CDATA[unterminated</string></plist>`,
+	`<plist><string>unterminated`,
+	`<plist><1string>x</1string></plist>`,
+	`<dict><key>a</key><string>b</string></dict>`,
+	`<abab>`,
+	`<0101>`,
+	`{a=b;}`,
+	`</plist>`,
+	`<?>`,
+	`<?xml?>`,
+	`<??>`,
+	`000<!><string></string>`,
+	`<!-><string></string>`,
+	`<![CDAT><string></string>`,
+	`<!DOCTYPE x [<!-- ]> --> <!ENTITY y "<>">]><string>a</string>`,
+	`<!DOCTYPE x [<!-- unterminated`,
+	`<string>a<!-- a -- b --></string>`,
+	`<string>]]></string>`,
+	"<plist a=\"\x1d\">",
+	`<plist><string a="]]>">a</string></plist>`,
+	"<?A\x90?><string>a</string>",
+	`<plist><strïng>a</strïng><string>b</string></plist>`,
+	`<?xml encoding="UTF8"?><string>a</string>`,
+	`<?xml version = "2.0"?><string>a</string>`,
+	`<?xml version="1.0" version="2.0"?><string>a</string>`,
+	`<?xml aversion=1 version='1.1'?><string>a</string>`,
+	``,
+}
+
+func TestXMLScannerMatchesEncodingXML(t *testing.T) {
+	documents := xmlScannerTestDocuments
+	for _, test := range tests {
+		if doc, ok := test.Documents[XMLFormat]; ok {
+			documents = append(documents, string(doc))
+		}
+	}
+	for _, illegal := range []string{
+		"<plist><doct><key>helo</key><string></string></doct></plist>",
+		"<plist><integer>10</plist>",
+		"<plist><dict><key>10</plist>",
+		"<plist/>",
+		"<pl",
+	} {
+		documents = append(documents, illegal)
+	}
+
+	for _, doc := range documents {
+		name := doc
+		if len(name) > 40 {
+			name = name[:40]
+		}
+		subtest(t, name, func(t *testing.T) {
+			if err := compareXMLScanner(doc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// compareXMLScanner parses doc with the scanner and with encoding/xml, and reports
+// any difference between the values they parse or the kinds of error they return.
+func compareXMLScanner(doc string) error {
+	scanned, scanErr := newXMLPlistParser(strings.NewReader(doc)).parseDocument()
+
+	std := newXMLPlistParser(nil)
+	std.tokenizer = newStdXMLTokenizer(strings.NewReader(doc))
+	want, wantErr := std.parseDocument()
+
+	if (scanErr == nil) != (wantErr == nil) {
+		return fmt.Errorf("scanner error %v, encoding/xml error %v", scanErr, wantErr)
+	}
+	_, scanInvalid := scanErr.(invalidPlistError)
+	_, wantInvalid := wantErr.(invalidPlistError)
+	if scanInvalid != wantInvalid {
+		return fmt.Errorf("scanner error %#v, encoding/xml error %#v", scanErr, wantErr)
+	}
+	if scanErr != nil {
+		return nil
+	}
+	// Compare the values by their XML encodings, which (unlike DeepEqual) treat NaN as equal to itself.
+	var got, expected bytes.Buffer
+	newXMLPlistGenerator(&got).generateDocument(scanned)
+	newXMLPlistGenerator(&expected).generateDocument(want)
+	if got.String() != expected.String() {
+		return fmt.Errorf("scanner parsed\n%s\nencoding/xml parsed\n%s", got.String(), expected.String())
+	}
+	return nil
+}